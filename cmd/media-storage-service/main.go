@@ -97,6 +97,90 @@ func main() {
 				log.Fatal(err)
 			}
 
+		case "add-account":
+			if err := server.AddAccount(exePath, version); err != nil {
+				log.Fatalf("Error adding account %v", err)
+			}
+			fmt.Println("Account added, restart the service to serve it.")
+
+		case "rotate-credentials":
+			if err := server.RotateCredentials(exePath, version); err != nil {
+				log.Fatalf("Error rotating credentials %v", err)
+			}
+			fmt.Println("Credentials rotated, upload the new connection file to the system controller.")
+
+		case "add-ip":
+			if len(os.Args) < 3 {
+				log.Fatalf("Usage: %s add-ip <ip>", os.Args[0])
+			}
+			if err := server.AddIP(exePath, os.Args[2]); err != nil {
+				log.Fatalf("Error adding IP %v", err)
+			}
+			fmt.Println("IP added, restart the service to listen on it.")
+
+		case "add-endpoint":
+			if len(os.Args) < 3 {
+				log.Fatalf("Usage: %s add-endpoint <host name or URL>", os.Args[0])
+			}
+			if err := server.AddEndpoint(exePath, os.Args[2]); err != nil {
+				log.Fatalf("Error adding endpoint %v", err)
+			}
+			fmt.Println("Endpoint added, upload the connection file to the system controller again.")
+
+		case "set-certificate":
+			if err := server.SetServerCertificate(exePath); err != nil {
+				log.Fatalf("Error setting server certificate %v", err)
+			}
+
+		case "set-legal-hold-admin":
+			if err := server.SetLegalHoldAdmin(exePath); err != nil {
+				log.Fatalf("Error setting legal hold admin %v", err)
+			}
+			fmt.Println("Legal hold admin set, restart the service to use it.")
+
+		case "issue-client-cert":
+			if len(os.Args) < 3 {
+				log.Fatalf("Usage: %s issue-client-cert <SCUSerialNumber> [account]", os.Args[0])
+			}
+			account := ""
+			if len(os.Args) > 3 {
+				account = os.Args[3]
+			}
+			if err := server.IssueClientCertificate(exePath, os.Args[2], account); err != nil {
+				log.Fatalf("Error issuing client certificate %v", err)
+			}
+
+		case "revoke-client-cert":
+			if len(os.Args) < 3 {
+				log.Fatalf("Usage: %s revoke-client-cert <SCUSerialNumber|certificate.crt>", os.Args[0])
+			}
+			if err := server.RevokeClientCertificate(exePath, os.Args[2]); err != nil {
+				log.Fatalf("Error revoking client certificate %v", err)
+			}
+			fmt.Println("Revoked, the service rejects it from now on.")
+
+		case "revoke-token", "revoke-user":
+			if len(os.Args) < 3 {
+				log.Fatalf("Usage: %s %s <token|username>", os.Args[0], os.Args[1])
+			}
+			revoke := server.RevokeToken
+			if os.Args[1] == "revoke-user" {
+				revoke = server.RevokeUser
+			}
+			if err := revoke(exePath, os.Args[2]); err != nil {
+				log.Fatalf("Error revoking %v", err)
+			}
+			fmt.Println("Revoked, the service rejects it from now on.")
+
+		case "verify-audit":
+			path := filepath.Join(exePath, "audit.log")
+			if len(os.Args) > 2 {
+				path = os.Args[2]
+			}
+			if err := verifyAudit(path); err != nil {
+				log.Fatalf("Audit log %s failed verification: %v", path, err)
+			}
+
 		default:
 			fmt.Printf("%q is an unknown command. Type '%s help' for help.\n", os.Args[1], os.Args[0])
 		}
@@ -109,6 +193,15 @@ func main() {
 	}
 }
 
+func verifyAudit(path string) error {
+	n, err := server.VerifyAuditLog(path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Audit log %s verified, %d entries\n", path, n)
+	return nil
+}
+
 func printUsage() {
 	fmt.Println(`Axis body worn Swift service example usage
 
@@ -116,9 +209,41 @@ Arguments
   help		Show this message.
   install	Enter install dialog to generate a connection config and install
   		as a service.
+  add-ip <ip>	Listen on another IP, with a certificate from the local CA.
+  add-endpoint <host name or URL>
+  		Publish a host name, or the URL of a NAT or load balancer, in the
+  		connection config, and issue certificates valid for it.
+  set-certificate
+  		Enter dialog to use a certificate from PEM or PKCS#12 files or an
+  		ACME server, or from the local CA again.
+  add-account	Enter dialog to add an account with its own credentials and
+  		storage location, and generate a connection config for it.
   uninstall 	Uninstall service.
   start		Start the service.
   stop		Stop the service.
+  rotate-credentials
+  		Replace the password and token secret while the service runs,
+  		and generate a new connection config. The old password and
+  		tokens stay valid for RotationOverlapMinutes, by default 60.
+  set-legal-hold-admin
+  		Enter dialog to set the user and password required to release
+  		legal holds. The system controller can only place them.
+  issue-client-cert <SCUSerialNumber> [account]
+  		Issue a client certificate for a system controller, required
+  		when MutualTLS is set. With an account, the certificate is
+  		only accepted with tokens of that account.
+  revoke-client-cert <SCUSerialNumber|certificate.crt>
+  		Revoke the client certificate issued for a system controller,
+  		or the one in a file.
+  revoke-token <token>
+  		Revoke a leaked token.
+  revoke-user <username>
+  		Revoke every token issued to a user so far, for instance after
+  		changing its password.
+  verify-audit [file]
+  		Verify that the audit log, by default audit.log next to the
+  		executable, hasn't been edited and has no missing entries. The
+  		audit.key and audit.head files next to it are needed.
 
 config.json
   This is the connection file you upload to a system controller in order to
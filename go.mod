@@ -8,7 +8,7 @@ require (
 	github.com/kardianos/service v1.2.2
 	github.com/ncw/swift/v2 v2.0.2
 	golang.org/x/crypto v0.31.0
+	golang.org/x/sys v0.28.0
 	golang.org/x/term v0.27.0
+	software.sslmate.com/src/go-pkcs12 v0.7.3
 )
-
-require golang.org/x/sys v0.28.0 // indirect
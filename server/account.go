@@ -0,0 +1,213 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Accounts are served below RootStoragePrefix, the account of the settings
+// as defaultAccount at RootStorageEndpoint.
+const (
+	RootStoragePrefix = "/v1.0/"
+	defaultAccount    = "abc"
+)
+
+// Account is an additional storage account with its own credentials and
+// storage location, isolated from the other accounts. The storage location
+// holds the System container of the account, with its own Capabilities.json
+// and Categories.json. Accounts are always stored as files, and use the
+// Quota of the settings unless they have one of their own.
+type Account struct {
+	// Name is the account in the storage URL, RootStoragePrefix + Name
+	Name                    string
+	Username                string
+	Password                []byte
+	StorageLocation         string
+	FullStoreAndReadSupport bool   `json:",omitempty"`
+	Quota                   *Quota `json:",omitempty"`
+}
+
+// accountName returns the name of the account served by s.
+func (s *Server) accountName() string {
+	if s.account == "" {
+		return defaultAccount
+	}
+	return s.account
+}
+
+// accountFromPath returns the account a storage request is for.
+func accountFromPath(r *http.Request) string {
+	account, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, RootStoragePrefix), "/")
+	return account
+}
+
+// addAccounts adds a server for every account, sharing the audit log and
+// backpressure of s.
+func (s *Server) addAccounts(accounts []Account) error {
+	s.accounts = map[string]*Server{}
+	usernames := map[string]bool{s.settings.Username: true}
+	for _, account := range accounts {
+		if account.Name == defaultAccount || !validTarget(account.Name) || strings.Contains(account.Name, "/") || s.accounts[account.Name] != nil {
+			return fmt.Errorf("invalid or duplicate account name %q", account.Name)
+		}
+		if account.Username == "" || usernames[account.Username] {
+			return fmt.Errorf("account %s: missing or duplicate username %q", account.Name, account.Username)
+		}
+		usernames[account.Username] = true
+		if account.StorageLocation == "" {
+			return fmt.Errorf("account %s: missing storage location", account.Name)
+		}
+		if err := setupAccountStorage(account); err != nil {
+			return fmt.Errorf("account %s: %v", account.Name, err)
+		}
+
+		settings := *s.settings
+		settings.Username = account.Username
+		settings.Password = account.Password
+		settings.StorageLocation = account.StorageLocation
+		settings.StorageBackend, settings.Swift, settings.S3 = fileBackend, nil, nil
+		settings.Accounts = nil
+		if account.Quota != nil {
+			settings.Quota = account.Quota
+		}
+		s.accounts[account.Name] = &Server{
+			settings:     &settings,
+			settingsPath: s.settingsPath,
+			backend:      NewFileBackend(account.StorageLocation),
+			auditLog:     s.auditLog,
+			throttle:     s.throttle,
+			account:      account.Name,
+		}
+	}
+	return nil
+}
+
+// setupAccountStorage creates the storage location of an account and its
+// System objects. Existing System objects are kept, they may have been
+// edited.
+func setupAccountStorage(account Account) error {
+	system := filepath.Join(account.StorageLocation, "System")
+	if err := os.MkdirAll(system, 0777); err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(system, "Capabilities.json")); isNotExist(err) && !account.FullStoreAndReadSupport {
+		if err := writeCapabilities(system, "Capabilities.json"); err != nil {
+			return fmt.Errorf("failed to write capability file: %v", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(system, "Categories.json")); isNotExist(err) {
+		if err := writeCategories(system, "Categories.json"); err != nil {
+			return fmt.Errorf("failed to write categories file: %v", err)
+		}
+	}
+	return nil
+}
+
+// servers returns the server of every account, the default account first.
+func (s *Server) servers() []*Server {
+	servers := []*Server{s}
+	names := []string{}
+	for name := range s.accounts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		servers = append(servers, s.accounts[name])
+	}
+	return servers
+}
+
+// accountServer returns the server of the named account, or nil.
+func (s *Server) accountServer(name string) *Server {
+	if name == defaultAccount {
+		return s
+	}
+	return s.accounts[name]
+}
+
+// userServer returns the server of the account of username, or nil.
+func (s *Server) userServer(username string) *Server {
+	for _, srv := range s.servers() {
+		if srv.settings.Username == username {
+			return srv
+		}
+	}
+	return nil
+}
+
+// tokenServer verifies the token of a request and returns the server of the
+// account it was issued for.
+func (s *Server) tokenServer(r *http.Request) (*Server, error) {
+	claims, err := s.verifyToken(r.Header[TokenTag])
+	if err != nil {
+		return nil, err
+	}
+	name := claims.Audience
+	if name == "" {
+		name = defaultAccount
+	}
+	srv := s.accountServer(name)
+	if srv == nil {
+		return nil, fmt.Errorf("token for unknown account %s", name)
+	}
+	return srv, nil
+}
+
+// AddAccount asks for an account and adds it to the settings in configPath,
+// together with a connection file in the storage location of the account.
+// The service must be restarted to serve the account.
+func AddAccount(configPath, version string) error {
+	settingsFile := filepath.Join(configPath, settingsFilename)
+	data, err := os.ReadFile(settingsFile)
+	if err != nil {
+		return err
+	}
+	settings := Settings{}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	account := Account{
+		Name:     ask(scanner, "Enter the account name used in the storage URL >"),
+		Username: ask(scanner, "Create a username >"),
+	}
+	plaintext, hash := selectPassword()
+	account.Password = hash
+	account.StorageLocation, err = filepath.Abs(ask(scanner, "Enter storage location >"))
+	if err != nil {
+		return err
+	}
+	account.FullStoreAndReadSupport = yesNoQuestion("Do you want to set FullStoreAndReadSupport? (Y/N)")
+
+	// Validates the account against the existing ones and sets up its storage
+	s := &Server{settings: &settings}
+	if err := s.addAccounts(append(settings.Accounts, account)); err != nil {
+		return err
+	}
+	settings.Accounts = append(settings.Accounts, account)
+	confJson, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(settingsFile, confJson, 0644); err != nil {
+		return err
+	}
+
+	connection := settings
+	connection.Username = account.Username
+	connection.plainPassword = plaintext
+	connection.StorageLocation = account.StorageLocation
+	connection.fullStoreAndReadSupport = account.FullStoreAndReadSupport
+	if err := generateConnectionFile(configPath, version, connection); err != nil {
+		return errors.New("failed to generate a connection file: " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testingHash is the bcrypt hash of the password "testing"
+var testingHash = []byte("$2a$10$opFgX6pZq0t0kRMoOZ4/J.Er7ekZ0pCxcfTinWnrUVThb64g.8Mle")
+
+func newAccountsServer(t *testing.T) (s *Server, defaultRoot, agencyRoot string) {
+	defaultRoot, agencyRoot = t.TempDir(), t.TempDir()
+	s = &Server{
+		scheme:   "http://",
+		settings: &Settings{StorageLocation: defaultRoot, TokenSecret: tokenSecret, Username: "test:tester", Password: testingHash},
+		backend:  NewFileBackend(defaultRoot),
+	}
+	err := s.addAccounts([]Account{{Name: "agency", Username: "agency:tester", Password: testingHash, StorageLocation: agencyRoot}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, defaultRoot, agencyRoot
+}
+
+func login(t *testing.T, s *Server, username string) (token, storageURL string) {
+	req, err := http.NewRequest("GET", "/auth/v1.0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "localhost:8080"
+	req.Header.Add("X-Auth-User", username)
+	req.Header.Add("X-Auth-Key", "testing")
+	rr := httptest.NewRecorder()
+	s.authentication(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("authentication of %s failed: %v", username, rr.Code)
+	}
+	return rr.Header().Get(TokenTag), rr.Header().Get(StorageUrlTag)
+}
+
+// Check that every account has its own storage and can only be reached with
+// its own credentials
+func TestAccounts(t *testing.T) {
+	s, defaultRoot, agencyRoot := newAccountsServer(t)
+
+	token, storageURL := login(t, s, "agency:tester")
+	if storageURL != "http://localhost:8080/v1.0/agency" {
+		t.Errorf("wrong storage URL: got %s want http://localhost:8080/v1.0/agency", storageURL)
+	}
+	defaultToken, storageURL := login(t, s, "test:tester")
+	if storageURL != "http://localhost:8080"+RootStorageEndpoint {
+		t.Errorf("wrong storage URL: got %s want http://localhost:8080%s", storageURL, RootStorageEndpoint)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{"create container", "PUT", "/v1.0/agency/rec", token, http.StatusCreated},
+		{"create object", "PUT", "/v1.0/agency/rec/clip.mkv", token, http.StatusCreated},
+		{"other account", "PUT", "/v1.0/abc/rec", token, http.StatusForbidden},
+		{"default token", "HEAD", "/v1.0/agency/rec", defaultToken, http.StatusForbidden},
+		{"unknown account", "HEAD", "/v1.0/other/rec", token, http.StatusForbidden},
+		{"default account", "HEAD", "/v1.0/abc/rec", defaultToken, http.StatusNotFound},
+		{"capabilities", "GET", "/v1.0/agency/System/Capabilities.json", token, http.StatusOK},
+	}
+	for _, test := range tests {
+		if code := storageRequest(t, s, test.method, test.path, strings.NewReader("clip"), map[string]string{"X-Auth-Token": test.token}).Code; code != test.want {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", test.name, code, test.want)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(agencyRoot, "rec", "clip.mkv")); err != nil {
+		t.Errorf("object not stored in the storage location of the account: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(defaultRoot, "rec")); !os.IsNotExist(err) {
+		t.Errorf("container stored in the default account: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(agencyRoot, "System", "Categories.json")); err != nil {
+		t.Errorf("categories not created for the account: %v", err)
+	}
+}
+
+// Check that every storage location is monitored and only the accounts on a
+// full disk refuse uploads
+func TestAccountBackpressure(t *testing.T) {
+	s, defaultRoot, agencyRoot := newAccountsServer(t)
+	s.throttle = newThrottle(Backpressure{HighWatermark: 90})
+	s.accounts["agency"].throttle = s.throttle
+	if got := s.storageLocations(); !reflect.DeepEqual(got, []string{defaultRoot, agencyRoot}) {
+		t.Errorf("wrong storage locations monitored: got %v want %v", got, []string{defaultRoot, agencyRoot})
+	}
+
+	token, _ := login(t, s, "agency:tester")
+	defaultToken, _ := login(t, s, "test:tester")
+	s.throttle.update(defaultRoot, 95)
+	tests := []struct {
+		name  string
+		path  string
+		token string
+		want  int
+	}{
+		{"full disk", "/v1.0/abc/rec", defaultToken, http.StatusServiceUnavailable},
+		{"other disk", "/v1.0/agency/rec", token, http.StatusCreated},
+	}
+	for _, test := range tests {
+		if code := storageRequest(t, s, "PUT", test.path, nil, map[string]string{"X-Auth-Token": test.token}).Code; code != test.want {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", test.name, code, test.want)
+		}
+	}
+}
+
+func TestInvalidAccounts(t *testing.T) {
+	tests := map[string]Account{
+		"default name":       {Name: defaultAccount, Username: "other", StorageLocation: t.TempDir()},
+		"nested name":        {Name: "a/b", Username: "other", StorageLocation: t.TempDir()},
+		"duplicate username": {Name: "agency", Username: "test:tester", StorageLocation: t.TempDir()},
+		"no storage":         {Name: "agency", Username: "other"},
+	}
+	for name, account := range tests {
+		s := &Server{settings: &Settings{Username: "test:tester"}}
+		if err := s.addAccounts([]Account{account}); err == nil {
+			t.Errorf("%s: invalid account accepted", name)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	acmeAccountKeyFilename = "acme_account.key"
+	defaultChallengePort   = "80"
+	acmeTimeout            = 5 * time.Minute
+)
+
+// ACMESettings orders the server certificate from an ACME server, validating
+// the IPs with http-01 challenges. A local stand-in such as Pebble is used
+// by setting DirectoryURL to its directory, ChallengePort to the port it
+// validates on and CAFile to the CA of its HTTPS certificate.
+type ACMESettings struct {
+	DirectoryURL string
+	Email        string `json:",omitempty"`
+	// ChallengePort is where the http-01 challenges are answered, 80 unless
+	// set
+	ChallengePort string `json:",omitempty"`
+	// CAFile is a PEM file of the CA of the HTTPS certificate of the ACME
+	// server, the system CAs are trusted unless set
+	CAFile string `json:",omitempty"`
+}
+
+// acmeAccountKey returns the key of the ACME account in rootPath, generating
+// it if there is none.
+func acmeAccountKey(rootPath string) (crypto.Signer, error) {
+	name := filepath.Join(rootPath, acmeAccountKeyFilename)
+	data, err := os.ReadFile(name)
+	if err == nil {
+		return parsePrivateKey(data)
+	}
+	if !isNotExist(err) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	b, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, os.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), 0600)
+}
+
+// acmeClient returns a client of the ACME server with a registered account.
+func acmeClient(ctx context.Context, rootPath string, a *ACMESettings) (*acme.Client, error) {
+	key, err := acmeAccountKey(rootPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load ACME account key: %v", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if a.CAFile != "" {
+		data, err := os.ReadFile(settingsFile(rootPath, a.CAFile))
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", a.CAFile)
+		}
+	}
+	client := &acme.Client{
+		Key:          key,
+		DirectoryURL: a.DirectoryURL,
+		HTTPClient: &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}},
+	}
+	account := &acme.Account{}
+	if a.Email != "" {
+		account.Contact = []string{"mailto:" + a.Email}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("failed to register ACME account: %v", err)
+	}
+	return client, nil
+}
+
+// challengeResponder answers http-01 challenges.
+type challengeResponder struct {
+	mu        sync.Mutex
+	responses map[string]string
+}
+
+func (c *challengeResponder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	response, ok := c.responses[r.URL.Path]
+	c.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(response))
+}
+
+func (c *challengeResponder) add(path, response string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.responses[path] = response
+}
+
+// orderACMECertificate orders a certificate for every IP and endpoint host
+// from the ACME server, and returns its chain and key.
+func orderACMECertificate(rootPath string, s Settings) ([]*x509.Certificate, crypto.Signer, error) {
+	a := s.ServerCertificate.ACME
+	ctx, cancel := context.WithTimeout(context.Background(), acmeTimeout)
+	defer cancel()
+	client, err := acmeClient(ctx, rootPath, a)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	port := a.ChallengePort
+	if port == "" {
+		port = defaultChallengePort
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort("", port))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to answer ACME challenges: %v", err)
+	}
+	responder := &challengeResponder{responses: map[string]string{}}
+	challengeServer := &http.Server{Handler: responder}
+	go challengeServer.Serve(listener)
+	defer challengeServer.Close()
+
+	ips, names := []net.IP{}, []string{}
+	for _, host := range serverHosts(s) {
+		if ip := net.ParseIP(host); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			names = append(names, host)
+		}
+	}
+	ids := acme.DomainIDs(names...)
+	for _, ip := range ips {
+		ids = append(ids, acme.AuthzID{Type: "ip", Value: ip.String()})
+	}
+	order, err := client.AuthorizeOrder(ctx, ids)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to order certificate: %v", err)
+	}
+	for _, url := range order.AuthzURLs {
+		authz, err := client.GetAuthorization(ctx, url)
+		if err != nil {
+			return nil, nil, err
+		}
+		if authz.Status == acme.StatusValid {
+			continue
+		}
+		var challenge *acme.Challenge
+		for _, c := range authz.Challenges {
+			if c.Type == "http-01" {
+				challenge = c
+			}
+		}
+		if challenge == nil {
+			return nil, nil, fmt.Errorf("no http-01 challenge for %s", authz.Identifier.Value)
+		}
+		response, err := client.HTTP01ChallengeResponse(challenge.Token)
+		if err != nil {
+			return nil, nil, err
+		}
+		responder.add(client.HTTP01ChallengePath(challenge.Token), response)
+		if _, err := client.Accept(ctx, challenge); err != nil {
+			return nil, nil, err
+		}
+		if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+			return nil, nil, fmt.Errorf("failed to validate %s: %v", authz.Identifier.Value, err)
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The subject is left empty, since CAs don't accept an IP address as
+	// common name and the SANs identify the server anyway
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		IPAddresses: ips,
+		DNSNames:    names,
+	}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to issue certificate: %v", err)
+	}
+	chain := []*x509.Certificate{}
+	for _, b := range der {
+		cert, err := x509.ParseCertificate(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		chain = append(chain, cert)
+	}
+	return chain, key, nil
+}
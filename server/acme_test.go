@@ -0,0 +1,288 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeACME is a minimal RFC 8555 server standing in for Pebble. Signatures of
+// requests aren't verified, and challenges are validated when accepted.
+type fakeACME struct {
+	t             *testing.T
+	server        *httptest.Server
+	ca            *x509.Certificate
+	caKey         crypto.Signer
+	challengePort string
+
+	mu       sync.Mutex
+	accounts map[string]bool
+	orders   map[string]*fakeOrder
+	authzs   map[string]*fakeAuthz
+}
+
+type fakeOrder struct {
+	Status         string        `json:"status"`
+	Identifiers    []fakeAuthzID `json:"identifiers"`
+	Authorizations []string      `json:"authorizations"`
+	Finalize       string        `json:"finalize"`
+	Certificate    string        `json:"certificate,omitempty"`
+	authzs         []*fakeAuthz  `json:"-"`
+	chain          []byte        `json:"-"`
+}
+
+type fakeAuthzID struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type fakeAuthz struct {
+	Status     string          `json:"status"`
+	Identifier fakeAuthzID     `json:"identifier"`
+	Challenges []fakeChallenge `json:"challenges"`
+}
+
+type fakeChallenge struct {
+	Type   string `json:"type"`
+	URL    string `json:"url"`
+	Token  string `json:"token"`
+	Status string `json:"status"`
+}
+
+func newFakeACME(t *testing.T, challengePort string) *fakeACME {
+	a := &fakeACME{
+		t:             t,
+		challengePort: challengePort,
+		accounts:      map[string]bool{},
+		orders:        map[string]*fakeOrder{},
+		authzs:        map[string]*fakeAuthz{},
+	}
+	a.ca, a.caKey = testCA(t, "Fake ACME Root CA", nil, nil)
+	a.server = httptest.NewTLSServer(a)
+	t.Cleanup(a.server.Close)
+	return a
+}
+
+func (a *fakeACME) reply(w http.ResponseWriter, status int, location string, v interface{}) {
+	if location != "" {
+		w.Header().Set("Location", location)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (a *fakeACME) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	url := a.server.URL
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", time.Now().UnixNano()))
+	if r.URL.Path == "/dir" {
+		a.reply(w, http.StatusOK, "", map[string]string{
+			"newNonce":   url + "/nonce",
+			"newAccount": url + "/account",
+			"newOrder":   url + "/order",
+		})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	var jws struct{ Protected, Payload string }
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+	protected, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+
+	id := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	switch {
+	case r.URL.Path == "/account":
+		var header struct{ JWK json.RawMessage }
+		json.Unmarshal(protected, &header)
+		status := http.StatusCreated
+		if a.accounts[string(header.JWK)] {
+			status = http.StatusOK
+		}
+		a.accounts[string(header.JWK)] = true
+		a.reply(w, status, url+"/account/1", map[string]string{"status": "valid"})
+	case r.URL.Path == "/order":
+		var req struct{ Identifiers []fakeAuthzID }
+		json.Unmarshal(payload, &req)
+		id := fmt.Sprint(len(a.orders))
+		order := &fakeOrder{Status: "pending", Identifiers: req.Identifiers, Finalize: url + "/finalize/" + id}
+		for i, identifier := range req.Identifiers {
+			authzID := fmt.Sprintf("%s-%d", id, i)
+			authz := &fakeAuthz{Status: "pending", Identifier: identifier, Challenges: []fakeChallenge{
+				{Type: "http-01", URL: url + "/challenge/" + authzID, Token: "token-" + authzID, Status: "pending"},
+			}}
+			a.authzs[authzID] = authz
+			order.authzs = append(order.authzs, authz)
+			order.Authorizations = append(order.Authorizations, url+"/authz/"+authzID)
+		}
+		a.orders[id] = order
+		a.reply(w, http.StatusCreated, url+"/order/"+id, order)
+	case strings.HasPrefix(r.URL.Path, "/order/"):
+		order := a.orders[id]
+		a.updateOrder(order)
+		a.reply(w, http.StatusOK, r.URL.String(), order)
+	case strings.HasPrefix(r.URL.Path, "/authz/"):
+		a.reply(w, http.StatusOK, "", a.authzs[id])
+	case strings.HasPrefix(r.URL.Path, "/challenge/"):
+		authz := a.authzs[id]
+		challenge := &authz.Challenges[0]
+		if a.validate(authz.Identifier.Value, challenge.Token) {
+			challenge.Status, authz.Status = "valid", "valid"
+		} else {
+			challenge.Status, authz.Status = "invalid", "invalid"
+		}
+		a.reply(w, http.StatusOK, "", challenge)
+	case strings.HasPrefix(r.URL.Path, "/finalize/"):
+		order := a.orders[id]
+		if a.updateOrder(order); order.Status != "ready" {
+			http.Error(w, "order not ready", http.StatusForbidden)
+			return
+		}
+		var req struct{ CSR string }
+		json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Certificates for IP addresses are identified by the SANs only
+		if csr.Subject.CommonName != "" {
+			http.Error(w, "common name in the CSR", http.StatusBadRequest)
+			return
+		}
+		serial, err := randomSerial()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		leaf, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: serial,
+			IPAddresses:  csr.IPAddresses,
+			NotBefore:    time.Now(),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}, a.ca, csr.PublicKey, a.caKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Like Pebble, the chain doesn't include the root
+		order.chain = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf})
+		order.Status, order.Certificate = "valid", url+"/cert/"+id
+		a.reply(w, http.StatusOK, url+"/order/"+id, order)
+	case strings.HasPrefix(r.URL.Path, "/cert/"):
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(a.orders[id].chain)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// updateOrder makes the order ready once every authorization is valid.
+func (a *fakeACME) updateOrder(order *fakeOrder) {
+	if order.Status != "pending" {
+		return
+	}
+	for _, authz := range order.authzs {
+		if authz.Status != "valid" {
+			return
+		}
+	}
+	order.Status = "ready"
+}
+
+// validate fetches the http-01 challenge response from ip.
+func (a *fakeACME) validate(ip, token string) bool {
+	resp, err := http.Get("http://" + net.JoinHostPort(ip, a.challengePort) + "/.well-known/acme-challenge/" + token)
+	if err != nil {
+		a.t.Log(err)
+		return false
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode == http.StatusOK && strings.HasPrefix(string(body), token+".")
+}
+
+func freePort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return port
+}
+
+// Check that a certificate is ordered from an ACME server, answering its
+// http-01 challenges, and its root CA is published
+func TestACMECertificate(t *testing.T) {
+	configPath, storage := t.TempDir(), t.TempDir()
+	port := freePort(t)
+	a := newFakeACME(t, port)
+	writePem(t, filepath.Join(configPath, "acme_ca.pem"), []*x509.Certificate{a.server.Certificate()}, nil)
+	writePem(t, filepath.Join(configPath, "acme_root.pem"), []*x509.Certificate{a.ca}, nil)
+	acme := &ACMESettings{DirectoryURL: a.server.URL + "/dir", Email: "admin@example.com", ChallengePort: port, CAFile: "acme_ca.pem"}
+	settings := Settings{StorageLocation: storage, IPs: []string{"127.0.0.1"}, Port: "8080", UseHttps: true, Username: "test:tester",
+		ServerCertificate: &ServerCertificate{ACME: acme}}
+
+	if err := updateServerCertificate(configPath, settings); err == nil {
+		t.Error("certificate installed without its root CA")
+	}
+	settings.ServerCertificate.RootCAFile = "acme_root.pem"
+	if err := updateServerCertificate(configPath, settings); err != nil {
+		t.Fatal(err)
+	}
+	cert, _, err := loadCert(configPath, buildCertName(0), buildKeyName(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.CheckSignatureFrom(a.ca); err != nil {
+		t.Errorf("certificate not issued by the ACME server: %v", err)
+	}
+	if err := generateConnectionFile(configPath, "test", settings); err != nil {
+		t.Fatal(err)
+	}
+	data, err := base64.StdEncoding.DecodeString(readConnectionFile(t, storage).HTTPSCertificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if published, err := parseCertificates(data); err != nil || len(published) != 1 || !published[0].Equal(a.ca) {
+		t.Error("root CA of the ACME server not published in the connection file")
+	}
+
+	// Renewed with the same account before it expires
+	m := newCertManager(configPath, settings)
+	m.check(cert.NotAfter.Add(-24 * time.Hour))
+	renewed, err := m.load(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.Leaf.Equal(cert) {
+		t.Error("certificate not renewed before it expires")
+	}
+	if len(a.accounts) != 1 {
+		t.Errorf("wrong number of ACME accounts: got %d want 1", len(a.accounts))
+	}
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The audit log, and next to it the key of its hashes and its head, the last
+// entry written.
+const (
+	auditFilename     = "audit.log"
+	auditKeyFilename  = "audit.key"
+	auditHeadFilename = "audit.head"
+)
+
+const auditKeyLength = 32
+
+// AuditEntry is a line of the audit log. Every entry carries the hash of the
+// entry before it, so removing, reordering or editing entries breaks the
+// chain.
+type AuditEntry struct {
+	Seq    uint64
+	Time   time.Time
+	Action string
+	Target string `json:",omitempty"`
+	// Account is empty for the default account
+	Account string `json:",omitempty"`
+	User    string `json:",omitempty"`
+	Remote  string `json:",omitempty"`
+	// Client is the identity of the client certificate of the request
+	Client string   `json:",omitempty"`
+	Keys   []string `json:",omitempty"`
+	Detail string   `json:",omitempty"`
+	Prev   string
+	Hash   string
+}
+
+// hash returns the hex encoded HMAC-SHA256 of the entry without its own hash.
+// Without the key the chain can't be recomputed after editing the log.
+func (e AuditEntry) hash(key []byte) string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// auditHead is the last entry written to the audit log, kept outside of it so
+// entries removed from the end are detected.
+type auditHead struct {
+	Seq  uint64
+	Hash string
+}
+
+// auditLog appends hash chained entries to a file, one JSON object per line.
+type auditLog struct {
+	mu       sync.Mutex
+	file     *os.File
+	key      []byte
+	headPath string
+	seq      uint64
+	last     string
+}
+
+// openAuditLog opens the audit log at path for appending, continuing the
+// chain from its last entry. A partial last entry, left by a crash while it
+// was written, is moved to path.partial. If entries are missing from the end
+// the sequence continues after them, so the gap stays detectable. Both
+// repairs are recorded in the log.
+func openAuditLog(path string) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(path)
+	a := &auditLog{file: file, headPath: filepath.Join(dir, auditHeadFilename)}
+	fail := func(err error) (*auditLog, error) {
+		file.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(file)
+	var size int64
+	var partial []byte
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return fail(err)
+		}
+		if len(line) == 0 {
+			break
+		}
+		var e AuditEntry
+		if line[len(line)-1] != '\n' || json.Unmarshal(line, &e) != nil {
+			if _, err := reader.Peek(1); err != io.EOF {
+				return fail(fmt.Errorf("corrupt audit log %s: entry after %d can't be read", path, a.seq))
+			}
+			partial = line
+			break
+		}
+		a.seq, a.last = e.Seq, e.Hash
+		size += int64(len(line))
+	}
+
+	a.key, err = loadAuditKey(filepath.Join(dir, auditKeyFilename), a.seq == 0)
+	if err != nil {
+		return fail(err)
+	}
+	head, err := loadAuditHead(a.headPath)
+	if err != nil {
+		return fail(err)
+	}
+
+	if partial != nil {
+		if err := appendFile(path+".partial", partial); err != nil {
+			return fail(err)
+		}
+		if err := file.Truncate(size); err != nil {
+			return fail(err)
+		}
+		detail := fmt.Sprintf("moved partial entry of %d bytes to %s.partial", len(partial), filepath.Base(path))
+		if err := a.append(AuditEntry{Time: time.Now(), Action: "audit-log-repaired", Detail: detail}); err != nil {
+			return fail(err)
+		}
+	}
+	if a.seq > 0 && head.Seq == 0 {
+		if err := a.append(AuditEntry{Time: time.Now(), Action: "audit-log-head-missing", Detail: auditHeadFilename + " was removed"}); err != nil {
+			return fail(err)
+		}
+	}
+	if head.Seq > a.seq {
+		detail := fmt.Sprintf("entries %d to %d are missing", a.seq+1, head.Seq)
+		a.seq = head.Seq
+		if err := a.append(AuditEntry{Time: time.Now(), Action: "audit-log-truncated", Detail: detail}); err != nil {
+			return fail(err)
+		}
+	}
+	return a, nil
+}
+
+// loadAuditKey returns the key of the audit log hashes at path. A key is only
+// generated for a new log, an existing log can't be continued without its key.
+func loadAuditKey(path string, create bool) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err == nil || !isNotExist(err) {
+		return key, err
+	}
+	if !create {
+		return nil, fmt.Errorf("audit log key %s is missing", path)
+	}
+	if key, err = generateTokenSecret(auditKeyLength); err != nil {
+		return nil, err
+	}
+	return key, os.WriteFile(path, key, 0600)
+}
+
+// loadAuditHead returns the head of the audit log stored at path, the zero
+// head if there is none.
+func loadAuditHead(path string) (auditHead, error) {
+	head := auditHead{}
+	data, err := os.ReadFile(path)
+	if isNotExist(err) {
+		return head, nil
+	}
+	if err != nil {
+		return head, err
+	}
+	return head, json.Unmarshal(data, &head)
+}
+
+// appendFile appends data to the file at path, creating it if needed.
+func appendFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// append chains e to the log, writes it and then moves the head to it.
+func (a *auditLog) append(e AuditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.seq++
+	e.Seq = a.seq
+	e.Time = e.Time.UTC()
+	e.Prev = a.last
+	e.Hash = e.hash(a.key)
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := a.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	a.last = e.Hash
+	if err := a.file.Sync(); err != nil {
+		return err
+	}
+	head, err := json.Marshal(auditHead{Seq: e.Seq, Hash: e.Hash})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(a.headPath, bytes.NewReader(head))
+}
+
+func (a *auditLog) Close() error {
+	return a.file.Close()
+}
+
+// audit records an action in the audit log, if the server has one. Failing to
+// audit is logged but doesn't fail the request.
+func (s *Server) audit(e AuditEntry) {
+	if s.auditLog == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Account = s.account
+	if err := s.auditLog.append(e); err != nil {
+		logger.Errorf("Failed to write audit log: %v", err)
+	}
+}
+
+// changedKeys returns the sorted metadata keys that differ between oldMeta
+// and newMeta.
+func changedKeys(oldMeta, newMeta map[string]string) []string {
+	keys := []string{}
+	for k, v := range newMeta {
+		if old, ok := oldMeta[k]; !ok || old != v {
+			keys = append(keys, k)
+		}
+	}
+	for k := range oldMeta {
+		if _, ok := newMeta[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// VerifyAuditLog checks that the audit log at path is an unbroken chain,
+// hashed with the key next to it and ending at the head next to it. It
+// returns the number of entries, and an error describing the first edited,
+// missing or reordered entry.
+func VerifyAuditLog(path string) (int, error) {
+	dir := filepath.Dir(path)
+	key, err := loadAuditKey(filepath.Join(dir, auditKeyFilename), false)
+	if err != nil {
+		return 0, err
+	}
+	head, err := loadAuditHead(filepath.Join(dir, auditHeadFilename))
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return verifyAuditChain(f, key, head)
+}
+
+// verifyAuditChain checks the audit log read from r against key and head.
+func verifyAuditChain(r io.Reader, key []byte, head auditHead) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	n := 0
+	var prev AuditEntry
+	for scanner.Scan() {
+		n++
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return n - 1, fmt.Errorf("line %d: %v", n, err)
+		}
+		if !hmac.Equal([]byte(e.hash(key)), []byte(e.Hash)) {
+			return n - 1, fmt.Errorf("line %d: entry %d was edited", n, e.Seq)
+		}
+		if n > 1 && e.Seq != prev.Seq+1 {
+			return n - 1, fmt.Errorf("line %d: entries %d to %d are missing", n, prev.Seq+1, e.Seq-1)
+		}
+		if n > 1 && e.Prev != prev.Hash {
+			return n - 1, fmt.Errorf("line %d: entry %d doesn't follow entry %d", n, e.Seq, prev.Seq)
+		}
+		if n == 1 && (e.Seq != 1 || e.Prev != "") {
+			return n - 1, fmt.Errorf("line %d: the log doesn't start at the first entry", n)
+		}
+		if e.Seq == head.Seq && e.Hash != head.Hash {
+			return n - 1, fmt.Errorf("line %d: entry %d isn't the head of the log", n, e.Seq)
+		}
+		prev = e
+	}
+	if err := scanner.Err(); err != nil {
+		return n, err
+	}
+	if n > 0 && head.Seq == 0 {
+		return n, fmt.Errorf("the head of the log is missing")
+	}
+	// The log may be ahead if writing the head failed
+	if prev.Seq < head.Seq {
+		return n, fmt.Errorf("entries %d to %d are missing at the end", prev.Seq+1, head.Seq)
+	}
+	return n, nil
+}
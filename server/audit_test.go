@@ -0,0 +1,201 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func readAuditLog(t *testing.T, path string) []AuditEntry {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []AuditEntry{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// Check that storage operations are recorded in a verifiable audit log
+func TestAuditLog(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		path := filepath.Join(t.TempDir(), auditFilename)
+		audit, err := openAuditLog(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer audit.Close()
+		s.auditLog = audit
+		s.settings.Username = "test:tester"
+		s.settings.Password = []byte("$2a$10$opFgX6pZq0t0kRMoOZ4/J.Er7ekZ0pCxcfTinWnrUVThb64g.8Mle")
+
+		req, err := http.NewRequest("GET", "/auth/v1.0", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("X-Auth-User", "test:tester")
+		req.Header.Add("X-Auth-Key", "testing")
+		s.authentication(httptest.NewRecorder(), req)
+
+		createContainer(t, map[string]string{"Test-Container": "test"}, s)
+		createObject(t, s)
+		postToContainer(map[string]string{"Test-Container": "test", "Status": "Complete"}, t, s)
+		storageRequest(t, s, "DELETE", "/v1.0/abc/test/test.txt", nil, nil)
+
+		want := []struct {
+			action string
+			target string
+			keys   []string
+		}{
+			{"authenticated", "", nil},
+			{"container-created", "test", nil},
+			{"metadata-updated", "test", []string{"Test-Container"}},
+			{"object-created", "test/test.txt", nil},
+			{"metadata-updated", "test/test.txt", []string{"Test"}},
+			{"metadata-updated", "test", []string{"Status"}},
+			{"recording-completed", "test", nil},
+			{"deleted", "test/test.txt", nil},
+		}
+		entries := readAuditLog(t, path)
+		if len(entries) != len(want) {
+			t.Fatalf("wrong number of audit entries: got %d want %d: %+v", len(entries), len(want), entries)
+		}
+		for i, w := range want {
+			e := entries[i]
+			if e.Action != w.action || e.Target != w.target || !reflect.DeepEqual(e.Keys, w.keys) {
+				t.Errorf("wrong audit entry %d: got %s %s %v want %s %s %v", i, e.Action, e.Target, e.Keys, w.action, w.target, w.keys)
+			}
+		}
+		if entries[0].User != "test:tester" {
+			t.Errorf("wrong user: got %s want test:tester", entries[0].User)
+		}
+
+		if n, err := VerifyAuditLog(path); err != nil || n != len(entries) {
+			t.Errorf("audit log failed verification: %d entries, %v", n, err)
+		}
+	})
+}
+
+// writeAuditEntries opens the audit log at path, appends an entry for each
+// target and closes it again.
+func writeAuditEntries(t *testing.T, path string, targets ...string) {
+	audit, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+	s := &Server{auditLog: audit}
+	for _, target := range targets {
+		s.audit(AuditEntry{Action: "container-created", Target: target})
+	}
+}
+
+// Check that the chain continues when the log is reopened and that edits,
+// removals, reordering, truncation and recomputed hashes are detected
+func TestVerifyAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), auditFilename)
+	writeAuditEntries(t, path, "a", "b")
+	writeAuditEntries(t, path, "c", "d")
+	if n, err := VerifyAuditLog(path); err != nil || n != 4 {
+		t.Fatalf("audit log failed verification: %d entries, %v", n, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := loadAuditKey(filepath.Join(filepath.Dir(path), auditKeyFilename), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := loadAuditHead(filepath.Join(filepath.Dir(path), auditHeadFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rehashing an edited entry without the key
+	lines := strings.SplitAfter(strings.TrimSuffix(string(data), "\n"), "\n")
+	var e AuditEntry
+	if err := json.Unmarshal([]byte(lines[3]), &e); err != nil {
+		t.Fatal(err)
+	}
+	e.Target = "e"
+	e.Hash = e.hash(nil)
+	rehashed, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"edited":    strings.Replace(string(data), `"Target":"b"`, `"Target":"x"`, 1),
+		"removed":   lines[0] + lines[2] + lines[3],
+		"truncated": lines[1] + lines[2] + lines[3],
+		"reordered": lines[0] + lines[2] + lines[1] + lines[3],
+		"end":       lines[0] + lines[1] + lines[2],
+		"rehashed":  lines[0] + lines[1] + lines[2] + string(rehashed) + "\n",
+	}
+	for name, log := range tests {
+		if _, err := verifyAuditChain(strings.NewReader(log), key, head); err == nil {
+			t.Errorf("%s audit log passed verification", name)
+		}
+	}
+}
+
+// Check that a partial last entry is moved away and entries missing from the
+// end stay detectable after the log is continued
+func TestAuditLogRepair(t *testing.T) {
+	path := filepath.Join(t.TempDir(), auditFilename)
+	writeAuditEntries(t, path, "a", "b")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, append(data, `{"Seq":3,"Ti`...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	writeAuditEntries(t, path, "c")
+	if n, err := VerifyAuditLog(path); err != nil || n != 4 {
+		t.Fatalf("repaired audit log failed verification: %d entries, %v", n, err)
+	}
+	entries := readAuditLog(t, path)
+	if entries[2].Action != "audit-log-repaired" || entries[3].Target != "c" {
+		t.Errorf("wrong entries after repair: %+v", entries[2:])
+	}
+	if partial, err := os.ReadFile(path + ".partial"); err != nil || string(partial) != `{"Seq":3,"Ti` {
+		t.Errorf("partial entry not kept: %q %v", partial, err)
+	}
+
+	// Drop the last two entries
+	data, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	if err := os.WriteFile(path, []byte(strings.Join(lines[:2], "")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyAuditLog(path); err == nil {
+		t.Error("truncated audit log passed verification")
+	}
+	writeAuditEntries(t, path, "d")
+	if _, err := VerifyAuditLog(path); err == nil {
+		t.Error("continued truncated audit log passed verification")
+	}
+	entries = readAuditLog(t, path)
+	if last := entries[len(entries)-2]; last.Action != "audit-log-truncated" || last.Seq != 5 {
+		t.Errorf("truncation not recorded: %+v", last)
+	}
+}
@@ -0,0 +1,351 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Backend is the store used by Server to persist containers, objects and
+// their metadata. Targets are slash separated and relative to the account,
+// either "<container>" or "<container>/<object>".
+//
+// Implementations must return an error satisfying errors.Is(err,
+// os.ErrNotExist) when a target or its container doesn't exist, one
+// satisfying errors.Is(err, syscall.ENOSPC) when out of storage, and one
+// satisfying errors.Is(err, errNameConflict) when an object can't be stored
+// because another object name is a prefix directory of it, or it of another.
+type Backend interface {
+	// CreateContainer creates the container unless it already exists.
+	CreateContainer(container string) (created bool, err error)
+	// PutObject creates or replaces an object in an existing container.
+	// Unless etag is empty it's the hex encoded MD5 body must match. If it
+	// doesn't, the object is neither created nor replaced and an error
+	// satisfying errors.Is(err, errChecksumMismatch) is returned.
+	PutObject(target string, body io.Reader, etag string) error
+	// GetObject opens an object for reading. Seeking must be supported to
+	// serve Range requests.
+	GetObject(target string) (io.ReadSeekCloser, error)
+	// Stat returns information about a container or object.
+	Stat(target string) (ObjectInfo, error)
+	// LoadMetadata returns the stored metadata of a container or object.
+	LoadMetadata(target string) (map[string]string, error)
+	// StoreMetadata replaces the metadata of a container or object.
+	StoreMetadata(target string, metadata map[string]string) error
+	// BackupMetadata keeps a copy of metadata that couldn't be loaded
+	// before it gets replaced.
+	BackupMetadata(target string) error
+	// List returns the containers of the account when container is empty,
+	// otherwise the objects in the container.
+	List(container string) ([]ObjectInfo, error)
+	// Delete removes an object, or an empty container, together with its
+	// metadata.
+	Delete(target string) error
+}
+
+// Names of the storage backends selectable in Settings.
+const (
+	fileBackend  = ""
+	swiftBackend = "swift"
+	s3Backend    = "s3"
+)
+
+// newBackend returns the storage backend selected in settings.
+func newBackend(settings *Settings) (Backend, error) {
+	switch settings.StorageBackend {
+	case fileBackend:
+		return NewFileBackend(settings.StorageLocation), nil
+	case swiftBackend:
+		return NewSwiftBackend(settings.Swift)
+	case s3Backend:
+		return NewS3Backend(settings.S3)
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", settings.StorageBackend)
+}
+
+// ObjectInfo describes a stored container or object. Name is the target when
+// returned by Stat, and the container or object name when returned by List.
+// Hash is the hex encoded MD5 of an object if the backend knows it.
+type ObjectInfo struct {
+	Name      string
+	Size      int64
+	ModTime   time.Time
+	Container bool
+	Hash      string
+}
+
+// splitTarget splits a target into its container and object names. The
+// object name is empty when the target is a container.
+func splitTarget(target string) (container, object string) {
+	container, object, _ = strings.Cut(target, "/")
+	return container, object
+}
+
+// validTarget reports whether target is safe to use as a relative path. Empty,
+// "." and ".." path segments are rejected, as are backslashes which Windows
+// treats as separators.
+func validTarget(target string) bool {
+	if strings.Contains(target, "\\") {
+		return false
+	}
+	for _, segment := range strings.Split(target, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// errNameConflict is returned when an object name like "a" can't be stored
+// next to one like "a/b". Only FileBackend, storing object names with
+// slashes in directories, has this restriction.
+var errNameConflict = errors.New("object name conflicts with another object")
+
+func isNotExist(err error) bool {
+	return errors.Is(err, os.ErrNotExist)
+}
+
+func isNoSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
+
+func isNameConflict(err error) bool {
+	return errors.Is(err, errNameConflict)
+}
+
+// FileBackend stores containers as directories below a root directory. The
+// metadata of a container is kept in a "<container>.metadata.json" file inside
+// the container, and the metadata of an object in a
+// "<container>.<object>.metadata.json" file next to the object.
+type FileBackend struct {
+	root string
+}
+
+// NewFileBackend returns a Backend storing everything below root.
+func NewFileBackend(root string) *FileBackend {
+	return &FileBackend{root: root}
+}
+
+func (b *FileBackend) path(target string) string {
+	return filepath.Join(b.root, filepath.FromSlash(target))
+}
+
+// metadataPath returns the path of the metadata file of target. The metadata
+// of an object is kept next to it, so "<container>/dir/name" has its metadata
+// in "<container>/dir/<container>.name.metadata.json".
+func (b *FileBackend) metadataPath(target string) string {
+	container, object := splitTarget(target)
+	if object == "" {
+		return filepath.Join(b.root, container, container+".metadata.json")
+	}
+	dir, name := path.Split(object)
+	return filepath.Join(b.path(container+"/"+dir), container+"."+name+".metadata.json")
+}
+
+func (b *FileBackend) CreateContainer(container string) (bool, error) {
+	if _, err := os.Stat(b.path(container)); err == nil {
+		return false, nil
+	}
+	if err := os.Mkdir(b.path(container), 0777); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// PutObject creates the directories of a nested object name as needed, but
+// never the container itself.
+func (b *FileBackend) PutObject(target string, body io.Reader, etag string) error {
+	container, _ := splitTarget(target)
+	fi, err := os.Stat(b.path(container))
+	if err != nil {
+		return err
+	}
+	// Files in the storage location, like the connection file, aren't
+	// containers
+	if !fi.IsDir() {
+		return &fs.PathError{Op: "put", Path: b.path(target), Err: fs.ErrNotExist}
+	}
+	// An object can't replace the directory of objects below it, nor be
+	// stored below another object
+	if fi, err := os.Stat(b.path(target)); err == nil && fi.IsDir() {
+		return fmt.Errorf("%s: %w", target, errNameConflict)
+	}
+	if err := os.MkdirAll(filepath.Dir(b.path(target)), 0777); err != nil {
+		if errors.Is(err, syscall.ENOTDIR) {
+			return fmt.Errorf("%s: %w", target, errNameConflict)
+		}
+		return err
+	}
+	return writeFileAtomic(b.path(target), newEtagReader(body, etag))
+}
+
+func (b *FileBackend) GetObject(target string) (io.ReadSeekCloser, error) {
+	return os.Open(b.path(target))
+}
+
+func (b *FileBackend) Stat(target string) (ObjectInfo, error) {
+	fi, err := os.Stat(b.path(target))
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{
+		Name:      target,
+		Size:      fi.Size(),
+		ModTime:   fi.ModTime(),
+		Container: fi.IsDir(),
+	}, nil
+}
+
+func (b *FileBackend) LoadMetadata(target string) (map[string]string, error) {
+	return loadMetadata(b.metadataPath(target))
+}
+
+func (b *FileBackend) StoreMetadata(target string, metadata map[string]string) error {
+	return storeMetadata(b.metadataPath(target), metadata)
+}
+
+func (b *FileBackend) BackupMetadata(target string) error {
+	return backupMetadata(b.metadataPath(target))
+}
+
+func (b *FileBackend) List(container string) ([]ObjectInfo, error) {
+	list := []ObjectInfo{}
+	if container == "" {
+		entries, err := os.ReadDir(b.root)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			// Hidden directories, like the one of partial uploads, aren't
+			// containers
+			if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, ObjectInfo{Name: e.Name(), ModTime: info.ModTime(), Container: true})
+		}
+		return list, nil
+	}
+
+	root := b.path(container)
+	if _, err := os.Stat(root); err != nil {
+		return nil, err
+	}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || isMetadataFile(container, d.Name()) || isTempFile(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		list = append(list, ObjectInfo{Name: filepath.ToSlash(name), Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// Delete removes the directories of a nested object name once they are
+// empty, the metadata backup is removed together with the metadata.
+func (b *FileBackend) Delete(target string) error {
+	container, object := splitTarget(target)
+	if _, err := os.Stat(b.path(target)); err != nil {
+		return err
+	}
+	for _, p := range []string{b.metadataPath(target), b.metadataPath(target) + ".bac"} {
+		if err := os.Remove(p); err != nil && !isNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Remove(b.path(target)); err != nil || object == "" {
+		return err
+	}
+	for dir := path.Dir(object); dir != "."; dir = path.Dir(dir) {
+		if os.Remove(b.path(container+"/"+dir)) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// isMetadataFile reports whether name is a metadata file, or a backup of one,
+// stored by FileBackend in container.
+func isMetadataFile(container, name string) bool {
+	return strings.HasPrefix(name, container+".") &&
+		(strings.HasSuffix(name, ".metadata.json") || strings.HasSuffix(name, ".metadata.json.bac"))
+}
+
+// tempPrefix starts the names of the files uploads and metadata are written to
+// before they are renamed into place.
+const tempPrefix = ".tmp-"
+
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, tempPrefix)
+}
+
+// writeFileAtomic writes body to a temporary file next to name, syncs it and
+// renames it to name, so an interrupted write never leaves a truncated file
+// under the real name.
+func writeFileAtomic(name string, body io.Reader) error {
+	fp, err := os.CreateTemp(filepath.Dir(name), tempPrefix+filepath.Base(name)+"-*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fp, body)
+	if err == nil {
+		err = fp.Sync()
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(fp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(fp.Name())
+	}
+	return err
+}
+
+// RemoveTempFiles removes the temporary files left behind by writes that were
+// interrupted, it must not run while objects are being uploaded. It returns
+// the number of removed files.
+func (b *FileBackend) RemoveTempFiles() (int, error) {
+	removed := 0
+	err := filepath.WalkDir(b.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !isTempFile(d.Name()) {
+			return nil
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// failingReader returns some data and then fails, like an interrupted upload.
+type failingReader struct {
+	data io.Reader
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	n, err := r.data.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+// Check that an interrupted upload, or one not matching its ETag, neither
+// replaces the object nor leaves anything under the real name
+func TestAtomicPutObject(t *testing.T) {
+	root := t.TempDir()
+	b := NewFileBackend(root)
+	if _, err := b.CreateContainer("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.PutObject("test/clip.mkv", &failingReader{strings.NewReader("partial")}, ""); err == nil {
+		t.Fatal("interrupted upload succeeded")
+	}
+	if _, err := b.Stat("test/clip.mkv"); !isNotExist(err) {
+		t.Errorf("interrupted upload left an object: %v", err)
+	}
+
+	if err := b.PutObject("test/clip.mkv", strings.NewReader("complete"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.PutObject("test/clip.mkv", &failingReader{strings.NewReader("partial")}, ""); err == nil {
+		t.Fatal("interrupted upload succeeded")
+	}
+	data, err := os.ReadFile(filepath.Join(root, "test", "clip.mkv"))
+	if err != nil || string(data) != "complete" {
+		t.Errorf("interrupted upload replaced the object: %q %v", data, err)
+	}
+	// The ETag is checked before the rename
+	if err := b.PutObject("test/clip.mkv", strings.NewReader("corrupt!"), md5Hex("complete")); !isChecksumMismatch(err) {
+		t.Fatalf("upload not matching its ETag wasn't rejected: %v", err)
+	}
+	data, err = os.ReadFile(filepath.Join(root, "test", "clip.mkv"))
+	if err != nil || string(data) != "complete" {
+		t.Errorf("upload not matching its ETag replaced the object: %q %v", data, err)
+	}
+	entries, err := os.ReadDir(filepath.Join(root, "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if isTempFile(e.Name()) {
+			t.Errorf("temporary file %s was left behind", e.Name())
+		}
+	}
+}
+
+// Check that abandoned temporary files are removed and never listed
+func TestRemoveTempFiles(t *testing.T) {
+	root := t.TempDir()
+	b := NewFileBackend(root)
+	if _, err := b.CreateContainer("test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.PutObject("test/dir/clip.mkv", strings.NewReader("complete"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.StoreMetadata("test/dir/clip.mkv", map[string]string{"Test": "tempData"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{
+		filepath.Join(root, "test", tempPrefix+"test.metadata.json-1"),
+		filepath.Join(root, "test", "dir", tempPrefix+"clip2.mkv-2"),
+	} {
+		if err := os.WriteFile(name, []byte("abandoned"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list, err := b.List("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Name != "dir/clip.mkv" {
+		t.Errorf("wrong listing: %+v", list)
+	}
+
+	if n, err := b.RemoveTempFiles(); err != nil || n != 2 {
+		t.Errorf("wrong number of removed files: got %d want 2: %v", n, err)
+	}
+	if n, err := b.RemoveTempFiles(); err != nil || n != 0 {
+		t.Errorf("wrong number of removed files: got %d want 0: %v", n, err)
+	}
+	matchMeta(t, &Server{backend: b}, "test/dir/clip.mkv", map[string]string{"Test": "tempData"})
+}
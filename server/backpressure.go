@@ -0,0 +1,156 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Defaults of Backpressure.
+const (
+	defaultCheckSeconds      = 10
+	defaultRetryAfterSeconds = 30
+)
+
+// Backpressure makes the server answer PUT requests with 503 and Retry-After,
+// telling the system controller to try again later, while the disk of their
+// storage location is almost full or too many uploads are in progress.
+type Backpressure struct {
+	// HighWatermark is the percentage of the disk in use above which
+	// uploads are refused, 0 disables the disk check
+	HighWatermark float64 `json:",omitempty"`
+	// LowWatermark is the percentage of the disk in use below which uploads
+	// are accepted again, it defaults to HighWatermark
+	LowWatermark float64 `json:",omitempty"`
+	// MaxUploads is the number of concurrent uploads, 0 is unlimited
+	MaxUploads        int `json:",omitempty"`
+	CheckSeconds      int `json:",omitempty"`
+	RetryAfterSeconds int `json:",omitempty"`
+}
+
+// throttle holds the state of Backpressure. It's shared by all accounts, and
+// full tells which storage locations are refusing uploads.
+type throttle struct {
+	settings Backpressure
+	mu       sync.Mutex
+	full     map[string]bool
+	slots    chan struct{}
+}
+
+func newThrottle(settings Backpressure) *throttle {
+	t := &throttle{settings: settings, full: map[string]bool{}}
+	if t.settings.LowWatermark <= 0 || t.settings.LowWatermark > t.settings.HighWatermark {
+		t.settings.LowWatermark = t.settings.HighWatermark
+	}
+	if t.settings.CheckSeconds <= 0 {
+		t.settings.CheckSeconds = defaultCheckSeconds
+	}
+	if t.settings.RetryAfterSeconds <= 0 {
+		t.settings.RetryAfterSeconds = defaultRetryAfterSeconds
+	}
+	if settings.MaxUploads > 0 {
+		t.slots = make(chan struct{}, settings.MaxUploads)
+	}
+	return t
+}
+
+// update refuses uploads to path once usedPercent of its disk is above the
+// high watermark, until it is below the low watermark.
+func (t *throttle) update(path string, usedPercent float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case usedPercent >= t.settings.HighWatermark && !t.full[path]:
+		logger.Warningf("Disk of %s %.1f%% full, refusing uploads until below %.1f%%", path, usedPercent, t.settings.LowWatermark)
+		t.full[path] = true
+	case usedPercent < t.settings.LowWatermark && t.full[path]:
+		logger.Infof("Disk of %s %.1f%% full, accepting uploads again", path, usedPercent)
+		t.full[path] = false
+	}
+}
+
+// isFull reports whether uploads to path are refused.
+func (t *throttle) isFull(path string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.full[path]
+}
+
+// checkDisk updates the throttle with the disk usage of path.
+func (t *throttle) checkDisk(path string) {
+	total, available, err := diskUsage(path)
+	if err != nil {
+		logger.Errorf("Failed to check free disk space of %s: %v", path, err)
+		return
+	}
+	if total == 0 {
+		return
+	}
+	t.update(path, 100*float64(total-available)/float64(total))
+}
+
+// storageLocations returns every distinct storage location of the accounts
+// using the file backend, the only backend whose disk is known.
+func (s *Server) storageLocations() []string {
+	paths := []string{}
+	seen := map[string]bool{}
+	for _, srv := range s.servers() {
+		path := srv.settings.StorageLocation
+		if srv.settings.StorageBackend == fileBackend && !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// runDiskMonitor checks the disk usage of every storage location until exit
+// is closed.
+func (s *Server) runDiskMonitor(exit chan struct{}) {
+	t := s.throttle
+	paths := s.storageLocations()
+	check := func() {
+		for _, path := range paths {
+			t.checkDisk(path)
+		}
+	}
+	check()
+	ticker := time.NewTicker(time.Duration(t.settings.CheckSeconds) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			check()
+		case <-exit:
+			return
+		}
+	}
+}
+
+// admitUpload returns a function to call when the upload is done, or answers
+// 503 and returns false if the upload must be retried later.
+func (s *Server) admitUpload(w http.ResponseWriter) (func(), bool) {
+	t := s.throttle
+	if t == nil {
+		return func() {}, true
+	}
+	retry := func(reason string) (func(), bool) {
+		logger.Warning("Upload refused, " + reason)
+		w.Header().Set("Retry-After", strconv.Itoa(t.settings.RetryAfterSeconds))
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return nil, false
+	}
+	if t.isFull(s.settings.StorageLocation) {
+		return retry("the disk of " + s.settings.StorageLocation + " is almost full")
+	}
+	if t.slots == nil {
+		return func() {}, true
+	}
+	select {
+	case t.slots <- struct{}{}:
+		return func() { <-t.slots }, true
+	default:
+		return retry("too many uploads in progress")
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Check that uploads are refused above the high watermark until the disk
+// usage is below the low watermark
+func TestDiskWatermark(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		s.throttle = newThrottle(Backpressure{HighWatermark: 90, LowWatermark: 80, RetryAfterSeconds: 60})
+		createContainer(t, map[string]string{"Test-Container": "test"}, s)
+
+		tests := []struct {
+			used float64
+			want int
+		}{
+			{50, http.StatusCreated},
+			{90, http.StatusServiceUnavailable},
+			{85, http.StatusServiceUnavailable},
+			{79, http.StatusCreated},
+			{85, http.StatusCreated},
+		}
+		for _, test := range tests {
+			s.throttle.update(s.settings.StorageLocation, test.used)
+			rr := storageRequest(t, s, "PUT", "/v1.0/abc/test/clip.mkv", strings.NewReader("clip"), nil)
+			if rr.Code != test.want {
+				t.Errorf("%.0f%% used: handler returned wrong status code: got %v want %v", test.used, rr.Code, test.want)
+			}
+			if rr.Code == http.StatusServiceUnavailable && rr.Header().Get("Retry-After") != "60" {
+				t.Errorf("wrong Retry-After: got %s want 60", rr.Header().Get("Retry-After"))
+			}
+		}
+		// Reads aren't throttled
+		s.throttle.update(s.settings.StorageLocation, 95)
+		if rr := storageRequest(t, s, "HEAD", "/v1.0/abc/test/clip.mkv", nil, nil); rr.Code != http.StatusOK {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+	})
+}
+
+func TestMaxUploads(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		s.throttle = newThrottle(Backpressure{MaxUploads: 1})
+		createContainer(t, map[string]string{"Test-Container": "test"}, s)
+
+		done, ok := s.admitUpload(httptest.NewRecorder())
+		if !ok {
+			t.Fatal("first upload refused")
+		}
+		rr := storageRequest(t, s, "PUT", "/v1.0/abc/test/clip.mkv", strings.NewReader("clip"), nil)
+		if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") != "30" {
+			t.Errorf("wrong response to concurrent upload: got %v %s want %v 30", rr.Code, rr.Header().Get("Retry-After"), http.StatusServiceUnavailable)
+		}
+		done()
+		rr = storageRequest(t, s, "PUT", "/v1.0/abc/test/clip.mkv", strings.NewReader("clip"), nil)
+		if rr.Code != http.StatusCreated {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+		}
+	})
+}
+
+func TestDiskUsage(t *testing.T) {
+	total, available, err := diskUsage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total == 0 || available > total {
+		t.Errorf("wrong disk usage: %d of %d bytes available", available, total)
+	}
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults of BruteForceProtection.
+const (
+	defaultMaxAttempts       = 5
+	defaultLockoutSeconds    = 60
+	defaultMaxLockoutSeconds = 3600
+	// Addresses and usernames tracked at most, so failed attempts from many
+	// addresses can't use up the memory
+	defaultMaxGuardEntries = 10000
+)
+
+// BruteForceProtection locks out source addresses and usernames after too
+// many failed authentication attempts. The lockout doubles with every failed
+// attempt after it, up to MaxLockoutSeconds. Zero values are defaults.
+type BruteForceProtection struct {
+	// MaxAttempts is the number of failed attempts before a lockout
+	MaxAttempts       int `json:",omitempty"`
+	LockoutSeconds    int `json:",omitempty"`
+	MaxLockoutSeconds int `json:",omitempty"`
+	// Allowlist holds the addresses or networks, like 10.0.0.0/24, of known
+	// system controllers. They are never locked out, and not by the
+	// lockout of their username either.
+	Allowlist []string `json:",omitempty"`
+	// Disabled turns the protection off
+	Disabled bool `json:",omitempty"`
+}
+
+// attempts counts the failed attempts of an address or username.
+type attempts struct {
+	failed      int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// loginGuard holds the state of BruteForceProtection.
+type loginGuard struct {
+	settings   BruteForceProtection
+	allowlist  []*net.IPNet
+	maxEntries int
+	mu         sync.Mutex
+	attempts   map[string]*attempts
+}
+
+func newLoginGuard(settings BruteForceProtection) (*loginGuard, error) {
+	g := &loginGuard{settings: settings, maxEntries: defaultMaxGuardEntries, attempts: map[string]*attempts{}}
+	if g.settings.MaxAttempts <= 0 {
+		g.settings.MaxAttempts = defaultMaxAttempts
+	}
+	if g.settings.LockoutSeconds <= 0 {
+		g.settings.LockoutSeconds = defaultLockoutSeconds
+	}
+	if g.settings.MaxLockoutSeconds < g.settings.LockoutSeconds {
+		g.settings.MaxLockoutSeconds = defaultMaxLockoutSeconds
+	}
+	for _, entry := range settings.Allowlist {
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid brute force allowlist entry %q: %v", entry, err)
+		}
+		g.allowlist = append(g.allowlist, network)
+	}
+	return g, nil
+}
+
+// remoteIP returns the address of the client of r.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (g *loginGuard) allowed(ip string) bool {
+	addr := net.ParseIP(ip)
+	for _, network := range g.allowlist {
+		if addr != nil && network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// keys returns the keys of the attempts of the address and username.
+func (g *loginGuard) keys(ip, username string) []string {
+	return []string{"address " + ip, "user " + username}
+}
+
+// lockedOut returns how long the address or username is still locked out.
+func (g *loginGuard) lockedOut(ip, username string) time.Duration {
+	if g.allowed(ip) {
+		return 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var wait time.Duration
+	for _, key := range g.keys(ip, username) {
+		if a := g.attempts[key]; a != nil {
+			if left := time.Until(a.lockedUntil); left > wait {
+				wait = left
+			}
+		}
+	}
+	return wait
+}
+
+// fail records a failed attempt. It returns what was locked out by it and
+// for how long, if anything.
+func (g *loginGuard) fail(ip, username string) (locked []string, lockout time.Duration) {
+	if g.allowed(ip) {
+		return nil, 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	maxLockout := time.Duration(g.settings.MaxLockoutSeconds) * time.Second
+	g.forget(now, maxLockout)
+	for _, key := range g.keys(ip, username) {
+		a := g.attempts[key]
+		if a == nil {
+			if len(g.attempts) >= g.maxEntries {
+				g.evict(now)
+			}
+			a = &attempts{}
+			g.attempts[key] = a
+		}
+		a.failed++
+		a.last = now
+		if excess := a.failed - g.settings.MaxAttempts; excess >= 0 {
+			d := time.Duration(g.settings.LockoutSeconds) * time.Second
+			for i := 0; i < excess && d < maxLockout; i++ {
+				d *= 2
+			}
+			if d > maxLockout {
+				d = maxLockout
+			}
+			a.lockedUntil = now.Add(d)
+			locked = append(locked, key)
+			if d > lockout {
+				lockout = d
+			}
+		}
+	}
+	return locked, lockout
+}
+
+// succeed forgets the failed attempts of the address and username.
+func (g *loginGuard) succeed(ip, username string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, key := range g.keys(ip, username) {
+		delete(g.attempts, key)
+	}
+}
+
+// forget removes the attempts of addresses and usernames that haven't failed
+// for the longest lockout, so they start over.
+func (g *loginGuard) forget(now time.Time, maxLockout time.Duration) {
+	for key, a := range g.attempts {
+		if now.Sub(a.last) > maxLockout && now.After(a.lockedUntil) {
+			delete(g.attempts, key)
+		}
+	}
+}
+
+// evict makes room for another entry by removing the one that failed longest
+// ago, preferring those not locked out.
+func (g *loginGuard) evict(now time.Time) {
+	oldest, oldestLocked := "", ""
+	for key, a := range g.attempts {
+		if now.Before(a.lockedUntil) {
+			if oldestLocked == "" || a.last.Before(g.attempts[oldestLocked].last) {
+				oldestLocked = key
+			}
+		} else if oldest == "" || a.last.Before(g.attempts[oldest].last) {
+			oldest = key
+		}
+	}
+	if oldest == "" {
+		oldest = oldestLocked
+	}
+	delete(g.attempts, oldest)
+}
+
+// errLockedOut is returned by login for a locked out address or username.
+type errLockedOut struct {
+	retryAfter time.Duration
+}
+
+func (e errLockedOut) Error() string {
+	return fmt.Sprintf("locked out for %v after too many failed attempts", e.retryAfter.Round(time.Second))
+}
+
+// authenticationFailed records a failed authentication of username, and
+// locks out the user and the address of r after too many.
+func (s *Server) authenticationFailed(r *http.Request, username, detail string) {
+	s.audit(AuditEntry{Action: "authentication-failed", User: username, Remote: r.RemoteAddr, Detail: detail})
+	if s.guard == nil {
+		return
+	}
+	if locked, lockout := s.guard.fail(remoteIP(r), username); len(locked) > 0 {
+		detail := fmt.Sprintf("%s for %v", strings.Join(locked, " and "), lockout)
+		s.audit(AuditEntry{Action: "locked-out", User: username, Remote: r.RemoteAddr, Detail: detail})
+		logger.Warning("Too many failed authentication attempts, locked out " + detail)
+	}
+}
+
+// loginError answers a failed authentication, 429 with Retry-After when
+// locked out, 403 for a client certificate of another account and 401
+// otherwise.
+func loginError(w http.ResponseWriter, err error) {
+	if e, ok := err.(errLockedOut); ok {
+		seconds := int((e.retryAfter + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+	if errors.Is(err, errCertAccount) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
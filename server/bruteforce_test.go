@@ -0,0 +1,132 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func loginFrom(t *testing.T, s *Server, remote, username, password string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", RootAuthEndpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = remote
+	req.Header.Add(UserNameTag, username)
+	req.Header.Add(PasswordTag, password)
+	rr := httptest.NewRecorder()
+	s.authentication(rr, req)
+	return rr
+}
+
+// Check that addresses and usernames are locked out after too many failed
+// attempts, except for allowlisted addresses
+func TestBruteForceProtection(t *testing.T) {
+	s, _, _ := newAccountsServer(t)
+	path := filepath.Join(t.TempDir(), auditFilename)
+	audit, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+	s.auditLog = audit
+	s.guard, err = newLoginGuard(BruteForceProtection{MaxAttempts: 3, Allowlist: []string{"10.0.0.0/24", "2001:db8::1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if rr := loginFrom(t, s, "192.0.2.1:4000", "test:tester", "wrong"); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("failed attempt %d: got %v want %v", i+1, rr.Code, http.StatusUnauthorized)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		remote   string
+		username string
+		want     int
+	}{
+		{"locked out address and user", "192.0.2.1:4001", "test:tester", http.StatusTooManyRequests},
+		{"locked out address", "192.0.2.1:4002", "agency:tester", http.StatusTooManyRequests},
+		{"locked out user", "192.0.2.2:4000", "test:tester", http.StatusTooManyRequests},
+		{"other address and user", "192.0.2.2:4001", "agency:tester", http.StatusOK},
+		{"allowlisted network", "10.0.0.5:4000", "test:tester", http.StatusOK},
+		{"allowlisted address", "[2001:db8::1]:4000", "test:tester", http.StatusOK},
+	}
+	for _, test := range tests {
+		rr := loginFrom(t, s, test.remote, test.username, "testing")
+		if rr.Code != test.want {
+			t.Errorf("%s: got %v want %v", test.name, rr.Code, test.want)
+		}
+		if test.want == http.StatusTooManyRequests && rr.Header().Get("Retry-After") != "60" {
+			t.Errorf("%s: wrong Retry-After: got %q want 60", test.name, rr.Header().Get("Retry-After"))
+		}
+	}
+
+	lockouts := 0
+	for _, e := range readAuditLog(t, path) {
+		if e.Action == "locked-out" {
+			lockouts++
+			if e.User != "test:tester" || e.Remote != "192.0.2.1:4000" {
+				t.Errorf("unexpected lockout entry %+v", e)
+			}
+		}
+	}
+	if lockouts != 1 {
+		t.Errorf("wrong number of lockouts in audit log: got %d want 1", lockouts)
+	}
+}
+
+func TestLockoutBackoff(t *testing.T) {
+	g, err := newLoginGuard(BruteForceProtection{MaxAttempts: 2, LockoutSeconds: 10, MaxLockoutSeconds: 35})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []time.Duration{0, 10 * time.Second, 20 * time.Second, 35 * time.Second, 35 * time.Second}
+	for i, w := range want {
+		if _, lockout := g.fail("192.0.2.1", "user"); lockout != w {
+			t.Errorf("failed attempt %d: got lockout %v want %v", i+1, lockout, w)
+		}
+	}
+	if g.lockedOut("192.0.2.1", "other") == 0 || g.lockedOut("192.0.2.2", "user") == 0 {
+		t.Error("address or user not locked out")
+	}
+	g.succeed("192.0.2.1", "user")
+	if wait := g.lockedOut("192.0.2.1", "user"); wait != 0 {
+		t.Errorf("still locked out after success: %v", wait)
+	}
+
+	if _, err := newLoginGuard(BruteForceProtection{Allowlist: []string{"scu.example.com"}}); err == nil {
+		t.Error("invalid allowlist entry accepted")
+	}
+}
+
+// Check that usernames are locked out without an allowlist too, and that the
+// number of tracked addresses is limited
+func TestLockoutWithoutAllowlist(t *testing.T) {
+	g, err := newLoginGuard(BruteForceProtection{MaxAttempts: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.maxEntries = 3
+	g.fail("192.0.2.1", "user")
+	if g.lockedOut("192.0.2.1", "other") == 0 {
+		t.Error("address not locked out")
+	}
+	if g.lockedOut("192.0.2.2", "user") == 0 {
+		t.Error("user not locked out from another address")
+	}
+
+	for _, ip := range []string{"192.0.2.2", "192.0.2.3", "192.0.2.4", "192.0.2.5"} {
+		g.fail(ip, "other")
+	}
+	if len(g.attempts) != g.maxEntries {
+		t.Errorf("wrong number of entries: got %d want %d", len(g.attempts), g.maxEntries)
+	}
+	if g.lockedOut("192.0.2.5", "user") == 0 {
+		t.Error("latest address not locked out")
+	}
+}
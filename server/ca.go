@@ -0,0 +1,183 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The server certificates are issued by a local CA in the settings folder.
+// Only the CA certificate is published in the connection file, so servers
+// added later are trusted by the system controller without reconfiguring it.
+const (
+	caCertFilename = "ca.crt"
+	caKeyFilename  = "ca.key"
+
+	caOrganization     = "Axis body worn Swift service example"
+	caValidity         = 10 * 365 * 24 * time.Hour
+	serverCertValidity = 360 * 24 * time.Hour
+)
+
+// loadOrCreateCA returns the CA in the PEM files in rootPath, generating it
+// if there is none.
+func loadOrCreateCA(rootPath, certFilename, keyFilename, commonName string) (*x509.Certificate, crypto.Signer, error) {
+	cert, key, err := loadCert(rootPath, certFilename, keyFilename)
+	if err == nil || !isNotExist(err) {
+		return cert, key, err
+	}
+	priv, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{caOrganization},
+			CommonName:   commonName,
+		},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	if err := writeCert(rootPath, certFilename, keyFilename, &template, &template, priv, priv); err != nil {
+		return nil, nil, err
+	}
+	return loadCert(rootPath, certFilename, keyFilename)
+}
+
+// randomSerial returns a random certificate serial number.
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// loadCert reads a certificate and its private key from PEM files.
+func loadCert(rootPath, certFilename, keyFilename string) (*x509.Certificate, crypto.Signer, error) {
+	pair, err := tls.LoadX509KeyPair(filepath.Join(rootPath, certFilename), filepath.Join(rootPath, keyFilename))
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, errors.New("unsupported private key type")
+	}
+	return cert, key, nil
+}
+
+// localCA returns the CA issuing the server certificates.
+func localCA(rootPath string) (*x509.Certificate, crypto.Signer, error) {
+	return loadOrCreateCA(rootPath, caCertFilename, caKeyFilename, "Local CA")
+}
+
+// hasLocalCA reports whether the server certificates in rootPath are issued
+// by the local CA. Installations from before it have self-signed
+// certificates.
+func hasLocalCA(rootPath string) bool {
+	_, err := os.Stat(filepath.Join(rootPath, caCertFilename))
+	return err == nil
+}
+
+// serverSANs returns the addresses and names a server certificate for ip is
+// valid for, the IP itself, the name of the host and the hosts of the
+// endpoints.
+func serverSANs(ip string, hosts []string) ([]net.IP, []string, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil, nil, fmt.Errorf("couldn't parse the ip address: %s", ip)
+	}
+	ips := []net.IP{addr}
+	names := []string{}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		names = append(names, hostname)
+	}
+	for _, host := range hosts {
+		if addr := net.ParseIP(host); addr == nil {
+			names = append(names, host)
+		} else if !addr.Equal(ips[0]) {
+			ips = append(ips, addr)
+		}
+	}
+	return ips, names, nil
+}
+
+// AddIP makes the server listen on ip too, after a restart. With https a
+// certificate for it is issued by the local CA, which the system controller
+// already trusts, or the server certificate is installed again for it. The
+// address is added to the connection file of every account.
+func AddIP(configPath, ip string) error {
+	settingsFile := filepath.Join(configPath, settingsFilename)
+	data, err := os.ReadFile(settingsFile)
+	if err != nil {
+		return err
+	}
+	settings := Settings{}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return err
+	}
+	if net.ParseIP(ip) == nil {
+		return fmt.Errorf("invalid ip address %q", ip)
+	}
+	for _, existing := range settings.IPs {
+		if existing == ip {
+			return fmt.Errorf("the server already listens on %s", ip)
+		}
+	}
+	i := len(settings.IPs)
+	settings.IPs = append(settings.IPs, ip)
+	if err := checkEndpoints(settings); err != nil {
+		return err
+	}
+	switch {
+	case !settings.UseHttps:
+	case settings.ServerCertificate != nil:
+		// It must be valid for the IP too
+		if err := updateServerCertificate(configPath, settings); err != nil {
+			return err
+		}
+	case !hasLocalCA(configPath):
+		return errors.New("the certificates are self-signed, install again to use a local CA")
+	default:
+		if err := generateCert(configPath, ip, endpointHosts(settings), buildCertName(i), buildKeyName(i)); err != nil {
+			return err
+		}
+	}
+	confJson, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(settingsFile, strings.NewReader(string(confJson))); err != nil {
+		return err
+	}
+
+	uris, err := authenticationURIs(settings)
+	if err != nil {
+		return err
+	}
+	_, err = updateConnectionFiles(settings, func(conf *Config) {
+		conf.AuthenticationTokenURI = uris
+	})
+	return err
+}
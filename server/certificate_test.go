@@ -2,6 +2,8 @@ package server
 
 import (
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
 	"encoding/pem"
 	"os"
 	"path"
@@ -14,14 +16,20 @@ func TestGenerateCertificate(t *testing.T) {
 	exePath, cleanUp := getStorageLocation(t)
 	defer cleanUp()
 	name := "127.0.0.1"
-	generateCert(exePath, name, certFilename, keyFilename)
+	if err := generateCert(exePath, name, nil, certFilename, keyFilename); err != nil {
+		t.Fatal(err)
+	}
 	certPem, err := os.ReadFile(path.Join(exePath, certFilename))
 	if err != nil {
 		t.Fatal(err)
 	}
+	caPem, err := os.ReadFile(path.Join(exePath, caCertFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
 	roots := x509.NewCertPool()
-	if !roots.AppendCertsFromPEM(certPem) {
-		t.Fatal("Failed to parse certificate")
+	if !roots.AppendCertsFromPEM(caPem) {
+		t.Fatal("Failed to parse CA certificate")
 	}
 
 	block, _ := pem.Decode(certPem)
@@ -44,3 +52,78 @@ func TestGenerateCertificate(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// Check that certificates are issued by one local CA, which is the only
+// certificate in the connection file, also after adding an IP to the
+// connection file of every account
+func TestLocalCA(t *testing.T) {
+	configPath, storage, agencyStorage := t.TempDir(), t.TempDir(), t.TempDir()
+	ips := generateCerts(configPath, []string{"127.0.0.1", "::1"}, nil)
+	if len(ips) != 2 {
+		t.Fatalf("certificates generated for %v", ips)
+	}
+	settings := Settings{
+		StorageLocation: storage, IPs: ips, Port: "8080", UseHttps: true, Username: "test:tester",
+		Accounts: []Account{{Name: "agency", Username: "agency:tester", StorageLocation: agencyStorage}},
+	}
+	data, err := json.Marshal(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(configPath, settingsFilename), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, location := range []string{storage, agencyStorage} {
+		connection := settings
+		connection.StorageLocation = location
+		if err := generateConnectionFile(configPath, "test", connection); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := AddIP(configPath, "127.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddIP(configPath, "127.0.0.2"); err == nil {
+		t.Error("duplicate IP added")
+	}
+
+	conf := Config{}
+	for _, location := range []string{agencyStorage, storage} {
+		data, err = os.ReadFile(path.Join(location, connectionFilename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(data, &conf); err != nil {
+			t.Fatal(err)
+		}
+		if uri := conf.AuthenticationTokenURI[len(conf.AuthenticationTokenURI)-1]; uri != "https://127.0.0.2:8080/auth/v1.0" {
+			t.Errorf("wrong URI for added IP in %s: got %s", location, uri)
+		}
+	}
+	if len(conf.HTTPSCertificate) != 1 {
+		t.Fatalf("wrong number of certificates in connection file: got %d want 1", len(conf.HTTPSCertificate))
+	}
+	caPem, err := base64.StdEncoding.DecodeString(conf.HTTPSCertificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPem) {
+		t.Fatal("Failed to parse CA certificate")
+	}
+
+	serials := map[string]bool{}
+	for i, ip := range []string{"127.0.0.1", "::1", "127.0.0.2"} {
+		cert, _, err := loadCert(configPath, buildCertName(i), buildKeyName(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, DNSName: ip}); err != nil {
+			t.Errorf("certificate for %s: %v", ip, err)
+		}
+		if cert.IsCA || serials[cert.SerialNumber.String()] {
+			t.Errorf("certificate for %s is a CA or has a duplicate serial number", ip)
+		}
+		serials[cert.SerialNumber.String()] = true
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Object metadata keys holding the checksums computed on upload.
+const (
+	etagKey   = "Etag"
+	sha256Key = "Sha256"
+
+	Sha256Tag = "X-Object-Sha256"
+)
+
+// checksumReader computes the MD5 and SHA-256 of everything read through it.
+type checksumReader struct {
+	r      io.Reader
+	md5    hash.Hash
+	sha256 hash.Hash
+}
+
+func newChecksumReader(r io.Reader) *checksumReader {
+	c := &checksumReader{md5: md5.New(), sha256: sha256.New()}
+	c.r = io.TeeReader(r, io.MultiWriter(c.md5, c.sha256))
+	return c
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// checksums returns the hex encoded checksums as object metadata.
+func (c *checksumReader) checksums() map[string]string {
+	return map[string]string{
+		etagKey:   hex.EncodeToString(c.md5.Sum(nil)),
+		sha256Key: hex.EncodeToString(c.sha256.Sum(nil)),
+	}
+}
+
+// clientEtag returns the ETag sent by the client, the hex encoded MD5 of the
+// body or empty. Like Swift the ETag may be quoted.
+func clientEtag(r *http.Request) string {
+	return strings.ToLower(strings.Trim(r.Header.Get("Etag"), `"`))
+}
+
+// etagMismatch reports whether the client sent an ETag that differs from
+// etag.
+func etagMismatch(r *http.Request, etag string) bool {
+	sent := clientEtag(r)
+	return sent != "" && !strings.EqualFold(sent, etag)
+}
+
+// errChecksumMismatch is returned by Backend.PutObject when the body doesn't
+// match the expected ETag.
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+func isChecksumMismatch(err error) bool {
+	return errors.Is(err, errChecksumMismatch)
+}
+
+// etagReader fails at the end of r instead of returning io.EOF, unless the
+// MD5 of everything read matches etag. A temporary file written from it is
+// thereby never renamed into place when the body doesn't match.
+type etagReader struct {
+	r    io.Reader
+	md5  hash.Hash
+	etag string
+}
+
+// newEtagReader returns r checked against etag, or r if etag is empty.
+func newEtagReader(r io.Reader, etag string) io.Reader {
+	if etag == "" {
+		return r
+	}
+	return &etagReader{r: r, md5: md5.New(), etag: etag}
+}
+
+func (e *etagReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	e.md5.Write(p[:n])
+	if err == io.EOF {
+		if sum := hex.EncodeToString(e.md5.Sum(nil)); !strings.EqualFold(sum, e.etag) {
+			return n, fmt.Errorf("%w: got %s want %s", errChecksumMismatch, sum, e.etag)
+		}
+	}
+	return n, err
+}
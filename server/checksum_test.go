@@ -0,0 +1,84 @@
+package server
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func md5Hex(data string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(data)))
+}
+
+// Check that checksums are computed on upload, stored and returned
+func TestChecksums(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		data := "0123456789"
+		etag := fmt.Sprintf("%x", md5.Sum([]byte(data)))
+		sum := fmt.Sprintf("%x", sha256.Sum256([]byte(data)))
+		createContainer(t, map[string]string{"Test-Container": "test"}, s)
+
+		rr := storageRequest(t, s, "PUT", "/v1.0/abc/test/clip.mkv", strings.NewReader(data), map[string]string{"Etag": `"` + strings.ToUpper(etag) + `"`})
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+		}
+		if got := rr.Header().Get("Etag"); got != etag {
+			t.Errorf("wrong Etag on PUT: got %s want %s", got, etag)
+		}
+		if code := postToObject("clip.mkv", map[string]string{"Test": "checksumData", "Etag": "forged"}, t, s); code != http.StatusAccepted {
+			t.Fatalf("Error expected %v but got %v when posting metadata", http.StatusAccepted, code)
+		}
+
+		rr = storageRequest(t, s, "HEAD", "/v1.0/abc/test/clip.mkv", nil, nil)
+		for header, want := range map[string]string{
+			"Etag":               etag,
+			Sha256Tag:            sum,
+			"X-Object-Meta-Test": "checksumData",
+			"X-Object-Meta-Etag": "",
+		} {
+			if got := rr.Header().Get(header); got != want {
+				t.Errorf("wrong %s on HEAD: got %s want %s", header, got, want)
+			}
+		}
+	})
+}
+
+// Check that an upload not matching the client's ETag is never stored, and
+// doesn't replace a previous object
+func TestChecksumMismatch(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		createContainer(t, map[string]string{"Test-Container": "test"}, s)
+
+		etag := fmt.Sprintf("%x", md5.Sum([]byte("0123456789")))
+		rr := storageRequest(t, s, "PUT", "/v1.0/abc/test/clip.mkv", strings.NewReader("012345678"), map[string]string{"Etag": etag})
+		if rr.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnprocessableEntity)
+		}
+		if _, err := s.backend.Stat("test/clip.mkv"); !isNotExist(err) {
+			t.Errorf("rejected object was stored: %v", err)
+		}
+
+		if rr := storageRequest(t, s, "PUT", "/v1.0/abc/test/clip.mkv", strings.NewReader("0123456789"), map[string]string{"Etag": etag}); rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+		}
+		rr = storageRequest(t, s, "PUT", "/v1.0/abc/test/clip.mkv", strings.NewReader("9876543210"), map[string]string{"Etag": etag})
+		if rr.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnprocessableEntity)
+		}
+		if info, err := s.backend.Stat("test/clip.mkv"); err != nil || info.Size != 10 {
+			t.Fatalf("previous object wasn't kept: %v", err)
+		}
+		fp, err := s.backend.GetObject("test/clip.mkv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fp.Close()
+		if data, _ := io.ReadAll(fp); string(data) != "0123456789" {
+			t.Errorf("previous object was replaced: got %q", data)
+		}
+	})
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Client certificates of system controllers are issued by the client CA in
+// the settings folder, and written to clientCertsDir named by the serial
+// number of the system controller.
+const (
+	clientCACertFilename = "client_ca.crt"
+	clientCAKeyFilename  = "client_ca.key"
+	clientCertsDir       = "clients"
+
+	clientCertValidity = 2 * 365 * 24 * time.Hour
+
+	// clientKey is the object metadata key of the client certificate
+	// identity of the system controller that uploaded the object
+	clientKey            = "Client-Certificate"
+	ClientCertificateTag = "X-Object-Client-Certificate"
+)
+
+// MutualTLS makes the server require a client certificate of every system
+// controller, when https is used. Clients without a certificate issued by the
+// client CA, or one of TrustedCAs, are rejected during the TLS handshake.
+type MutualTLS struct {
+	// TrustedCAs are PEM files of other CAs issuing client certificates,
+	// relative to the settings folder
+	TrustedCAs []string `json:",omitempty"`
+}
+
+// clientCA returns the client CA in rootPath, generating it if there is none.
+func clientCA(rootPath string) (*x509.Certificate, crypto.Signer, error) {
+	return loadOrCreateCA(rootPath, clientCACertFilename, clientCAKeyFilename, "Client CA")
+}
+
+// issueClientCert issues a client certificate for the system controller with
+// serial number scuSerial, and returns the paths of the certificate and key.
+// Unless account is empty the certificate is only accepted with tokens of
+// that account, which is kept as organizational unit.
+func issueClientCert(rootPath, scuSerial, account string) (certPath, keyPath string, err error) {
+	if scuSerial == "" || !validTarget(scuSerial) || filepath.Base(scuSerial) != scuSerial {
+		return "", "", fmt.Errorf("invalid serial number %q", scuSerial)
+	}
+	var units []string
+	if account != "" {
+		units = []string{account}
+	}
+	ca, caKey, err := clientCA(rootPath)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to load client CA: %v", err)
+	}
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return "", "", err
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization:       ca.Subject.Organization,
+			OrganizationalUnit: units,
+			CommonName:         scuSerial,
+			SerialNumber:       scuSerial,
+		},
+		NotBefore:   time.Now(),
+		NotAfter:    time.Now().Add(clientCertValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	dir := filepath.Join(rootPath, clientCertsDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", err
+	}
+	if err := writeCert(dir, scuSerial+".crt", scuSerial+".key", &template, ca, priv, caKey); err != nil {
+		return "", "", err
+	}
+	return filepath.Join(dir, scuSerial+".crt"), filepath.Join(dir, scuSerial+".key"), nil
+}
+
+// IssueClientCertificate issues a client certificate for the system
+// controller with serial number scuSerial, to install on it when MutualTLS is
+// used. Unless account is empty the certificate is only accepted for it.
+func IssueClientCertificate(configPath, scuSerial, account string) error {
+	certPath, keyPath, err := issueClientCert(configPath, scuSerial, account)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Client certificate: " + certPath)
+	fmt.Println("Client key: " + keyPath)
+	return nil
+}
+
+// clientCAPool returns the CAs whose client certificates are accepted.
+func clientCAPool(rootPath string, m *MutualTLS) (*x509.CertPool, error) {
+	ca, _, err := clientCA(rootPath)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	for _, name := range m.TrustedCAs {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(rootPath, name)
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", name)
+		}
+	}
+	return pool, nil
+}
+
+// tlsConfig returns the TLS configuration of the https servers.
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if s.settings.MutualTLS == nil {
+		return config, nil
+	}
+	pool, err := clientCAPool(s.settingsPath, s.settings.MutualTLS)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client CAs: %v", err)
+	}
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	config.ClientCAs = pool
+	config.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+		if s.revoked == nil {
+			return nil
+		}
+		for _, chain := range chains {
+			if err := s.revoked.checkCert(chain[0]); err != nil {
+				logger.Error(err)
+				return err
+			}
+		}
+		return nil
+	}
+	return config, nil
+}
+
+// clientAccount returns the account the verified client certificate of a
+// request is restricted to, or "" if it isn't. Certificates issued without an
+// account, or by TrustedCAs without organizational unit, are accepted with
+// the tokens of every account.
+func clientAccount(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	if units := r.TLS.VerifiedChains[0][0].Subject.OrganizationalUnit; len(units) > 0 {
+		return units[0]
+	}
+	return ""
+}
+
+// errCertAccount is returned for a request of an account other than the one
+// its client certificate is restricted to.
+var errCertAccount = errors.New("client certificate not valid for the account")
+
+// checkClientAccount returns an error wrapping errCertAccount if the client
+// certificate of r is restricted to another account than the one of srv.
+func checkClientAccount(r *http.Request, srv *Server) error {
+	if account := clientAccount(r); account != "" && account != srv.accountName() {
+		return fmt.Errorf("%w: %s of %s used for %s", errCertAccount, clientIdentity(r), account, srv.accountName())
+	}
+	return nil
+}
+
+// clientIdentity returns the identity in the verified client certificate of
+// a request, or "" without one.
+func clientIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	if subject.SerialNumber != "" {
+		return subject.SerialNumber
+	}
+	return subject.CommonName
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// startMutualTLS starts s with the TLS configuration of the service, and
+// returns a function making requests with the client certificate of scuSerial
+// issued in caPath, or without one if scuSerial is empty. The certificate is
+// issued for account on first use.
+func startMutualTLS(t *testing.T, s *Server, caPath string) func(scuSerial, account, method, path string) (*http.Response, error) {
+	config, err := s.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(s.storageHandler))
+	ts.TLS = config
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	token, err := createToken(tokenSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func(scuSerial, account, method, path string) (*http.Response, error) {
+		client := ts.Client()
+		transport := client.Transport.(*http.Transport).Clone()
+		if scuSerial != "" {
+			certPath := filepath.Join(caPath, clientCertsDir, scuSerial+".crt")
+			keyPath := filepath.Join(caPath, clientCertsDir, scuSerial+".key")
+			if _, err := os.Stat(certPath); err != nil {
+				if certPath, keyPath, err = issueClientCert(caPath, scuSerial, account); err != nil {
+					t.Fatal(err)
+				}
+			}
+			pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			transport.TLSClientConfig.Certificates = []tls.Certificate{pair}
+		}
+		client.Transport = transport
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(TokenTag, token)
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+}
+
+// Check that only clients with a trusted certificate are accepted, and that
+// the identity of the certificate is stored with uploads
+func TestMutualTLS(t *testing.T) {
+	settingsPath, otherCA := t.TempDir(), t.TempDir()
+	storage := t.TempDir()
+	s := &Server{
+		settings:     &Settings{StorageLocation: storage, TokenSecret: tokenSecret, MutualTLS: &MutualTLS{}},
+		settingsPath: settingsPath,
+		backend:      NewFileBackend(storage),
+	}
+	request := startMutualTLS(t, s, settingsPath)
+
+	if _, err := request("", "", "PUT", "/v1.0/abc/rec"); err == nil {
+		t.Error("client without certificate accepted")
+	}
+	resp, err := request("ACCC8E000001", "", "PUT", "/v1.0/abc/rec")
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create container: %v %v", resp, err)
+	}
+	resp, err = request("ACCC8E000001", "", "PUT", "/v1.0/abc/rec/clip.mkv")
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create object: %v %v", resp, err)
+	}
+	meta, err := s.backend.LoadMetadata("rec/clip.mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client := metaValue(meta, clientKey); client != "ACCC8E000001" {
+		t.Errorf("wrong client identity: got %q want ACCC8E000001", client)
+	}
+	resp, err = request("ACCC8E000001", "", "HEAD", "/v1.0/abc/rec/clip.mkv")
+	if err != nil || resp.Header.Get(ClientCertificateTag) != "ACCC8E000001" {
+		t.Errorf("client identity not returned: %v %v", resp, err)
+	}
+
+	// Certificates of other CAs are only accepted when trusted
+	otherRequest := startMutualTLS(t, s, otherCA)
+	if _, err := otherRequest("ACCC8E000002", "", "HEAD", "/v1.0/abc/rec"); err == nil {
+		t.Error("client certificate of unknown CA accepted")
+	}
+	s.settings.MutualTLS.TrustedCAs = []string{filepath.Join(otherCA, clientCACertFilename)}
+	trustedRequest := startMutualTLS(t, s, otherCA)
+	resp, err = trustedRequest("ACCC8E000002", "", "HEAD", "/v1.0/abc/rec")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("client certificate of trusted CA: %v %v", resp, err)
+	}
+}
+
+// Check that revoked client certificates are rejected, and that a
+// certificate issued for an account is only accepted for it
+func TestRevokeClientCert(t *testing.T) {
+	settingsPath, storage := t.TempDir(), t.TempDir()
+	s := &Server{
+		settings:     &Settings{StorageLocation: storage, TokenSecret: tokenSecret, MutualTLS: &MutualTLS{}},
+		settingsPath: settingsPath,
+		backend:      NewFileBackend(storage),
+		revoked:      newRevocationList(filepath.Join(settingsPath, revokedFilename)),
+	}
+	data, err := json.Marshal(s.settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(settingsPath, settingsFilename), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	request := startMutualTLS(t, s, settingsPath)
+
+	for _, serial := range []string{"ACCC8E000001", "ACCC8E000002"} {
+		if resp, err := request(serial, "", "HEAD", "/v1.0/abc"); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: %v %v", serial, resp, err)
+		}
+	}
+	if err := RevokeClientCertificate(settingsPath, "ACCC8E000001"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := request("ACCC8E000001", "", "HEAD", "/v1.0/abc"); err == nil {
+		t.Error("revoked client certificate accepted")
+	}
+	if resp, err := request("ACCC8E000002", "", "HEAD", "/v1.0/abc"); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("other client certificate: %v %v", resp, err)
+	}
+	if err := RevokeClientCertificate(settingsPath, "../ACCC8E000002"); err == nil {
+		t.Error("invalid serial number accepted")
+	}
+
+	resp, err := request("ACCC8E000003", "agency", "HEAD", "/v1.0/abc")
+	if err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("client certificate of other account: %v %v", resp, err)
+	}
+	resp, err = request("ACCC8E000004", defaultAccount, "HEAD", "/v1.0/abc")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("client certificate of the account: %v %v", resp, err)
+	}
+}
+
+// Check that revoking a certificate doesn't revoke the one with the same
+// serial number of another issuer
+func TestRevokedCertIssuer(t *testing.T) {
+	revoked := &x509.Certificate{SerialNumber: big.NewInt(42), Issuer: pkix.Name{CommonName: "CA"}}
+	other := &x509.Certificate{SerialNumber: big.NewInt(42), Issuer: pkix.Name{CommonName: "Other CA"}}
+	tokens := revokedTokens{ClientCertificates: map[string]int64{certKey(revoked): 0}}
+	if err := tokens.revokedCert(revoked); err == nil {
+		t.Error("revoked client certificate accepted")
+	}
+	if err := tokens.revokedCert(other); err != nil {
+		t.Errorf("certificate of other issuer: %v", err)
+	}
+}
+
+// Check that a client certificate issued for an account can't be used to get
+// tokens of another account
+func TestClientCertAccountAuth(t *testing.T) {
+	s, _, _ := newAccountsServer(t)
+	cert := &x509.Certificate{Subject: pkix.Name{SerialNumber: "ACCC8E000001", OrganizationalUnit: []string{"agency"}}}
+	request := func(header map[string]string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", RootAuthEndpoint, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "localhost:8080"
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		rr := httptest.NewRecorder()
+		s.authentication(rr, req)
+		return rr
+	}
+
+	if rr := request(map[string]string{UserNameTag: "test:tester", PasswordTag: "testing"}); rr.Code != http.StatusForbidden {
+		t.Errorf("login to other account: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+	rr := request(map[string]string{UserNameTag: "agency:tester", PasswordTag: "testing"})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("login to the account: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := request(map[string]string{TokenTag: rr.Header().Get(TokenTag)}); rr.Code != http.StatusOK {
+		t.Errorf("refresh in the account: got %v want %v", rr.Code, http.StatusOK)
+	}
+	token, _ := login(t, s, "test:tester")
+	if rr := request(map[string]string{TokenTag: token}); rr.Code != http.StatusForbidden {
+		t.Errorf("refresh in other account: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+}
+
+func TestIssueClientCertInvalidSerial(t *testing.T) {
+	for _, serial := range []string{"", "../ACCC8E000001", "a/b"} {
+		if _, _, err := issueClientCert(t.TempDir(), serial, ""); err == nil {
+			t.Errorf("serial number %q accepted", serial)
+		}
+	}
+}
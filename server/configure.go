@@ -16,7 +16,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"math/big"
 	"net"
 	"os"
 	"path/filepath"
@@ -69,8 +68,22 @@ func Configure(configPath, version string) error {
 
 	toggleHttps := yesNoQuestion("Do you want to use https? (Y/N)")
 
+	endpoints := Settings{Port: port, IPs: ips, UseHttps: toggleHttps}
+	endpoints.Endpoints = askEndpoints(scanner, endpoints)
+
+	var mutualTLS *MutualTLS
+	var serverCert *ServerCertificate
 	if toggleHttps {
-		ips = generateCerts(configPath, ips)
+		serverCert = selectServerCertificate(scanner)
+		if serverCert == nil {
+			ips = generateCerts(configPath, ips, endpointHosts(endpoints))
+		}
+		if yesNoQuestion("Do you want to require client certificates of the system controllers? (Y/N)") {
+			if _, _, err := clientCA(configPath); err != nil {
+				return fmt.Errorf("failed to generate client CA: %v", err)
+			}
+			mutualTLS = &MutualTLS{}
+		}
 	}
 	if len(ips) == 0 {
 		return errors.New("failed to generate config, couldn't generate certificates")
@@ -87,6 +100,8 @@ func Configure(configPath, version string) error {
 
 	toggleCapabilities := yesNoQuestion("Do you want to set FullStoreAndReadSupport? (Y/N)")
 
+	allowDownload := yesNoQuestion("Do you want to allow authenticated download of stored objects? (Y/N)")
+
 	// create storage location if it doesn't exist
 	if _, err := os.Stat(storageLocation); os.IsNotExist(err) {
 		err := os.MkdirAll(storageLocation, 0777)
@@ -110,6 +125,7 @@ func Configure(configPath, version string) error {
 	settings := Settings{
 		StorageLocation:         storageLocation,
 		IPs:                     ips,
+		Endpoints:               endpoints.Endpoints,
 		Port:                    port,
 		UseHttps:                toggleHttps,
 		Username:                user,
@@ -119,6 +135,26 @@ func Configure(configPath, version string) error {
 		publicKeyID:             publicKeyID,
 		TokenSecret:             tokenSecret,
 		fullStoreAndReadSupport: toggleCapabilities,
+		AllowDownload:           allowDownload,
+		MutualTLS:               mutualTLS,
+		ServerCertificate:       serverCert,
+	}
+	if serverCert != nil {
+		if err := updateServerCertificate(configPath, settings); err != nil {
+			return err
+		}
+	}
+
+	selectStorageBackend(scanner, &settings)
+	if settings.StorageBackend != fileBackend {
+		backend, err := newBackend(&settings)
+		if err != nil {
+			return err
+		}
+		err = uploadSystemObjects(backend, storageLocation)
+		if err != nil {
+			return fmt.Errorf("failed to upload system objects: %v", err)
+		}
 	}
 
 	confJson, _ := json.Marshal(settings)
@@ -134,15 +170,177 @@ func Configure(configPath, version string) error {
 	return nil
 }
 
-func generateConnectionFile(certPath, version string, s Settings) error {
+// selectStorageBackend asks whether uploads should be stored in the storage
+// location, forwarded to an upstream Swift account or stored in an S3
+// compatible bucket.
+func selectStorageBackend(scanner *bufio.Scanner, settings *Settings) {
+	fmt.Println("Choose where uploads should be stored >")
+	fmt.Println("0: in the storage location.")
+	fmt.Println("1: in an upstream Swift account.")
+	fmt.Println("2: in an S3 compatible bucket.")
+	for {
+		var choice string
+		fmt.Println("Choose 0 - 2")
+		fmt.Scanln(&choice)
+		switch choice {
+		case "0":
+			settings.StorageBackend = fileBackend
+			return
+		case "1":
+			settings.StorageBackend = swiftBackend
+			settings.Swift = &SwiftSettings{
+				AuthURL:  ask(scanner, "Enter the upstream Swift auth URL >"),
+				UserName: ask(scanner, "Enter the upstream Swift username >"),
+				ApiKey:   askSecret("Enter the upstream Swift API key >"),
+			}
+			return
+		case "2":
+			settings.StorageBackend = s3Backend
+			settings.S3 = &S3Settings{
+				Endpoint:  ask(scanner, "Enter the S3 endpoint URL, e.g. https://minio.example.com:9000 >"),
+				Region:    ask(scanner, "Enter the S3 region or leave empty to use us-east-1 >"),
+				Bucket:    ask(scanner, "Enter the name of an existing bucket >"),
+				AccessKey: ask(scanner, "Enter the S3 access key >"),
+				SecretKey: askSecret("Enter the S3 secret key >"),
+			}
+			return
+		}
+	}
+}
+
+func ask(scanner *bufio.Scanner, question string) string {
+	fmt.Println(question)
+	scanner.Scan()
+	return strings.TrimSpace(scanner.Text())
+}
+
+func askSecret(question string) string {
+	fmt.Println(question)
+	secret, _ := term.ReadPassword(int(syscall.Stdin))
+	return string(secret)
+}
+
+// uploadSystemObjects copies the generated System objects to a backend not
+// reading them from the storage location.
+func uploadSystemObjects(b Backend, storageLocation string) error {
+	if _, err := b.CreateContainer("System"); err != nil {
+		return err
+	}
+	for _, name := range []string{"Capabilities.json", "Categories.json"} {
+		f, err := os.Open(filepath.Join(storageLocation, "System", name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = b.PutObject("System/"+name, f, "")
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publishedCertificates returns the certificates to put in HTTPSCertificate,
+// base64 encoded. Only the local CA is published, or the root CAs of a
+// certificate not issued by it, or the self-signed certificate of every IP of
+// installations from before it.
+func publishedCertificates(certPath string, s Settings) ([]string, error) {
+	if s.ServerCertificate != nil {
+		data, err := os.ReadFile(filepath.Join(certPath, rootCAFilename))
+		if err != nil {
+			return nil, err
+		}
+		roots, err := parseCertificates(data)
+		if err != nil {
+			return nil, err
+		}
+		certs := []string{}
+		for _, root := range roots {
+			certs = append(certs, base64.StdEncoding.EncodeToString(encodeCertificates([]*x509.Certificate{root})))
+		}
+		return certs, nil
+	}
+	names := []string{caCertFilename}
+	if !hasLocalCA(certPath) {
+		names = []string{}
+		for i := range s.IPs {
+			names = append(names, buildCertName(i))
+		}
+	}
+	certs := []string{}
+	for _, name := range names {
+		cert, err := os.ReadFile(filepath.Join(certPath, name))
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, base64.StdEncoding.EncodeToString(cert))
+	}
+	return certs, nil
+}
+
+// updateConnectionFile applies update to the connection file in the storage
+// location. The password is only known to the connection file, so it is
+// updated instead of generated again.
+func updateConnectionFile(storageLocation string, update func(conf *Config)) error {
+	connectionFile := filepath.Join(storageLocation, connectionFilename)
+	data, err := os.ReadFile(connectionFile)
+	if err != nil {
+		return err
+	}
+	conf := Config{}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return err
+	}
+	update(&conf)
+	if err := validateConnectionFile(conf); err != nil {
+		return err
+	}
+	data, err = json.MarshalIndent(conf, "", "")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(connectionFile, strings.NewReader(string(data)))
+}
+
+// updateConnectionFiles applies update to the connection file of every
+// account, and returns the updated files. Accounts without one, like those
+// added to the settings by hand, are skipped.
+func updateConnectionFiles(s Settings, update func(conf *Config)) ([]string, error) {
+	if err := updateConnectionFile(s.StorageLocation, update); err != nil {
+		return nil, err
+	}
+	updated := []string{filepath.Join(s.StorageLocation, connectionFilename)}
+	for _, account := range s.Accounts {
+		err := updateConnectionFile(account.StorageLocation, update)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return updated, err
+		}
+		updated = append(updated, filepath.Join(account.StorageLocation, connectionFilename))
+	}
+	return updated, nil
+}
+
+// authenticationURI returns the URI of the auth endpoint on ip, or a host
+// name.
+func authenticationURI(s Settings, ip string) string {
 	scheme := "http://"
 	if s.UseHttps {
 		scheme = "https://"
 	}
-	ips := []string{}
-	for _, ip := range s.IPs {
-		s := scheme + ip + ":" + s.Port + "/auth/v1.0"
-		ips = append(ips, s)
+	// IPv6 addresses are enclosed in brackets
+	return scheme + net.JoinHostPort(ip, s.Port) + RootAuthEndpoint
+}
+
+func generateConnectionFile(certPath, version string, s Settings) error {
+	ips, err := authenticationURIs(s)
+	if err != nil {
+		return err
 	}
 	conf := Config{
 		ConnectionFileVersion:   "1.0",
@@ -160,17 +358,15 @@ func generateConnectionFile(certPath, version string, s Settings) error {
 		FullStoreAndReadSupport: s.fullStoreAndReadSupport,
 	}
 	if s.UseHttps {
-		certs := []string{}
-		for i := range s.IPs {
-			cert, err := os.ReadFile(filepath.Join(certPath, buildCertName(i)))
-			if err != nil {
-				return err
-			}
-			certs = append(certs, base64.StdEncoding.EncodeToString(cert))
-
+		certs, err := publishedCertificates(certPath, s)
+		if err != nil {
+			return err
 		}
 		conf.HTTPSCertificate = certs
 	}
+	if err := validateConnectionFile(conf); err != nil {
+		return err
+	}
 	jsonString, err := json.MarshalIndent(conf, "", "")
 	if err != nil {
 		return err
@@ -204,8 +400,9 @@ func getHostIPs() ([]string, error) {
 		}
 		iprev = i
 		for _, addr := range addrs {
+			// Link-local IPv6 addresses would need a zone in the URI
 			if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-				if ipnet.IP.To4() != nil {
+				if ipnet.IP.To4() != nil || ipnet.IP.IsGlobalUnicast() {
 					ips = append(ips, ipnet.IP.String())
 					i++
 				}
@@ -292,11 +489,11 @@ func buildKeyName(i int) string {
 }
 
 // Return all IPs that successfully got a cert generated.
-func generateCerts(rootPath string, ips []string) []string {
+func generateCerts(rootPath string, ips, hosts []string) []string {
 	i := 0
 	successIPs := []string{}
 	for _, ip := range ips {
-		err := generateCert(rootPath, ip, buildCertName(i), buildKeyName(i))
+		err := generateCert(rootPath, ip, hosts, buildCertName(i), buildKeyName(i))
 		if err != nil {
 			fmt.Printf("Failed to generate certificate for ip %s: %v\n", ip, err)
 			continue
@@ -307,55 +504,71 @@ func generateCerts(rootPath string, ips []string) []string {
 	return successIPs
 }
 
-func generateCert(rootPath, ip, certFilename, keyFilename string) error {
+// generateCert issues a certificate for ip and hosts from the local CA in
+// rootPath, generating the CA if there is none.
+func generateCert(rootPath, ip string, hosts []string, certFilename, keyFilename string) error {
+	ca, caKey, err := localCA(rootPath)
+	if err != nil {
+		return fmt.Errorf("failed to load local CA: %v", err)
+	}
+
 	// priv, err := rsa.GenerateKey(rand.Reader, *rsaBits)
-	priv, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		return err
 	}
 
-	ipnet, _, err := net.ParseCIDR(ip + "/24")
+	ips, names, err := serverSANs(ip, hosts)
 	if err != nil {
-		return fmt.Errorf("couldn't parse the ip address: %v", err)
+		return err
 	}
 
-	ips := []net.IP{ipnet}
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
 
 	template := x509.Certificate{
-		SerialNumber: big.NewInt(1),
+		SerialNumber: serial,
 		Subject: pkix.Name{
-			Organization: []string{"Generated Co"},
+			Organization: ca.Subject.Organization,
+			CommonName:   ip,
 		},
 		NotBefore: time.Now(),
-		NotAfter:  time.Now().Add(time.Hour * 24 * 360),
+		NotAfter:  time.Now().Add(serverCertValidity),
 
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		BasicConstraintsValid: true,
-		IPAddresses:           ips,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses: ips,
+		DNSNames:    names,
 	}
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, priv.Public(), priv)
-	if err != nil {
-		return err
-	}
-	out := &bytes.Buffer{}
-	pem.Encode(out, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
-	err = os.WriteFile(filepath.Join(rootPath, certFilename), out.Bytes(), 0644)
+	return writeCert(rootPath, certFilename, keyFilename, &template, ca, priv, caKey)
+}
+
+// writeCert creates a certificate for the public key of priv from template,
+// signed by parent and parentKey, and writes it and priv as PEM files. A
+// certificate signed by its own key has template as parent. The files are
+// replaced atomically, the key first, so a running server reloading them
+// never sees a new certificate with the old key.
+func writeCert(rootPath, certFilename, keyFilename string, template, parent *x509.Certificate, priv, parentKey crypto.Signer) error {
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, parent, priv.Public(), parentKey)
 	if err != nil {
 		return err
 	}
-	out.Reset()
 	block := pemBlockForKey(priv)
 	if block == nil {
 		return errors.New("error generating a pem block, failed to generate certificate")
 	}
-	pem.Encode(out, pemBlockForKey(priv))
-	err = os.WriteFile(filepath.Join(rootPath, keyFilename), out.Bytes(), 0644)
+	out := &bytes.Buffer{}
+	pem.Encode(out, block)
+	err = writeFileAtomic(filepath.Join(rootPath, keyFilename), out)
 	if err != nil {
 		return err
 	}
-	return nil
+	out.Reset()
+	pem.Encode(out, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+	return writeFileAtomic(filepath.Join(rootPath, certFilename), out)
 }
 
 func selectPassword() (plaintext string, hash []byte) {
@@ -0,0 +1,17 @@
+package server
+
+import "golang.org/x/sys/windows"
+
+// diskUsage returns the size of the volume holding path and the bytes
+// available to the service.
+func diskUsage(path string) (total, available uint64, err error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	var free uint64
+	if err := windows.GetDiskFreeSpaceEx(p, &available, &total, &free); err != nil {
+		return 0, 0, err
+	}
+	return total, available, nil
+}
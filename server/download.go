@@ -0,0 +1,132 @@
+package server
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/ncw/swift/v2"
+)
+
+// contentTypes maps the extensions of objects uploaded by the body worn
+// system to their media types. A .key file holds the JSON encoded encryption
+// key of a clip.
+var contentTypes = map[string]string{
+	".mkv":  "video/x-matroska",
+	".mp4":  "video/mp4",
+	".json": "application/json",
+	".key":  "application/json",
+}
+
+// contentType returns the media type of an object based on its extension.
+func contentType(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if t, ok := contentTypes[ext]; ok {
+		return t
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// isSystemObject reports whether target is one of the System objects the
+// SCU reads to learn about the service.
+func isSystemObject(target string) bool {
+	return target == "System/Capabilities.json" || target == "System/Categories.json"
+}
+
+// canDownload reports whether target may be read. The System objects are
+// always readable, everything else only when downloads are enabled.
+func (s *Server) canDownload(target string) bool {
+	if isSystemObject(target) {
+		return true
+	}
+	return s.settings.AllowDownload
+}
+
+// handleDownload streams an object together with its metadata headers.
+// Range, If-None-Match and If-Modified-Since requests are supported. Large
+// objects are read from their segments, unless multipart-manifest=get asks
+// for the manifest itself.
+func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request, target string) {
+	info, err := s.backend.Stat(target)
+	if err != nil && !isNotExist(err) {
+		logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	// Directories of nested object names on the file backend aren't objects
+	if err != nil || info.Container {
+		logger.Error("Object not found: " + target)
+		e := swift.ObjectNotFound
+		http.Error(w, e.Text, e.StatusCode)
+		return
+	}
+
+	// Metadata is optional, the System objects don't have any
+	meta, err := s.backend.LoadMetadata(target)
+	if err == nil {
+		setObjectMetadataHeaders(w, meta)
+	}
+	hash := metaValue(meta, etagKey)
+
+	var content io.ReadSeekCloser
+	if isLargeObject(meta) && r.URL.Query().Get("multipart-manifest") != "get" {
+		segments, err := s.largeObjectSegments(target, meta)
+		if err != nil {
+			handleLargeObjectError(w, err)
+			return
+		}
+		// A readable manifest must not give access to unreadable segments
+		for _, seg := range segments {
+			if segTarget := strings.TrimPrefix(seg.Name, "/"); !s.canDownload(segTarget) {
+				logger.Errorf("Unauthorized attempt to access segment: %s", segTarget)
+				e := swift.Forbidden
+				http.Error(w, e.Text, e.StatusCode)
+				return
+			}
+		}
+		content = newSegmentReader(s.backend, segments)
+		hash = largeObjectHash(segments)
+	} else {
+		content, err = s.backend.GetObject(target)
+		if err != nil {
+			logger.Error(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+	defer content.Close()
+
+	if hash == "" {
+		hash = info.Hash
+	}
+	// Objects stored without an ETag are sent without one, rather than reading
+	// the whole object to hash it
+	w.Header().Set("Content-Type", contentType(target))
+	if hash != "" {
+		// Swift sends the Etag unquoted, which http.ServeContent doesn't
+		// understand, so If-None-Match is handled here.
+		w.Header().Set("Etag", hash)
+		if etagMatch(r.Header.Get("If-None-Match"), hash) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	http.ServeContent(w, r, "", info.ModTime, content)
+}
+
+// etagMatch reports whether an If-None-Match header matches hash. Both quoted
+// and unquoted entity tags are accepted.
+func etagMatch(header, hash string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.Trim(strings.TrimPrefix(tag, "W/"), `"`) == hash {
+			return true
+		}
+	}
+	return false
+}
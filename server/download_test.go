@@ -0,0 +1,133 @@
+package server
+
+import (
+	"crypto/md5"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func createDownloadObject(t *testing.T, s *Server, name, data string) {
+	rr := storageRequest(t, s, "PUT", "/v1.0/abc/test/"+name, strings.NewReader(data), nil)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Error expected %v but got %v when creating %s", http.StatusCreated, rr.Code, name)
+	}
+}
+
+// Check that objects can only be read when downloads are enabled
+func TestDownloadDisabled(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		createContainer(t, map[string]string{"Test-Container": "test"}, s)
+		createDownloadObject(t, s, "clip.mkv", "0123456789")
+
+		rr := storageRequest(t, s, "GET", "/v1.0/abc/test/clip.mkv", nil, nil)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+		}
+	})
+}
+
+func TestDownload(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		s.settings.AllowDownload = true
+		createContainer(t, map[string]string{"Test-Container": "test"}, s)
+		createDownloadObject(t, s, "clip.mkv", "0123456789")
+		if code := postToObject("clip.mkv", map[string]string{"Test": "downloadData"}, t, s); code != http.StatusAccepted {
+			t.Fatalf("Error expected %v but got %v when posting metadata", http.StatusAccepted, code)
+		}
+		createDownloadObject(t, s, "clip.key", `{"EncryptedKey": "a2V5"}`)
+		createDownloadObject(t, s, "dir/clip.mp4", "nested")
+
+		rr := storageRequest(t, s, "GET", "/v1.0/abc/test/clip.mkv", nil, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		if body := rr.Body.String(); body != "0123456789" {
+			t.Errorf("wrong body: got %q want %q", body, "0123456789")
+		}
+		etag := fmt.Sprintf("%x", md5.Sum([]byte("0123456789")))
+		for header, want := range map[string]string{
+			"Content-Type":       "video/x-matroska",
+			"Content-Length":     "10",
+			"Accept-Ranges":      "bytes",
+			"Etag":               etag,
+			"X-Object-Meta-Test": "downloadData",
+		} {
+			if got := rr.Header().Get(header); got != want {
+				t.Errorf("wrong %s: got %s want %s", header, got, want)
+			}
+		}
+		lastModified := rr.Header().Get("Last-Modified")
+		if lastModified == "" {
+			t.Error("missing Last-Modified")
+		}
+
+		tests := []struct {
+			name   string
+			header string
+			value  string
+			code   int
+			body   string
+		}{
+			{"range", "Range", "bytes=2-5", http.StatusPartialContent, "2345"},
+			{"suffix range", "Range", "bytes=-3", http.StatusPartialContent, "789"},
+			{"unsatisfiable range", "Range", "bytes=20-", http.StatusRequestedRangeNotSatisfiable, ""},
+			{"matching etag", "If-None-Match", `"` + etag + `"`, http.StatusNotModified, ""},
+			{"unquoted etag", "If-None-Match", etag, http.StatusNotModified, ""},
+			{"other etag", "If-None-Match", `"0000"`, http.StatusOK, "0123456789"},
+			{"not modified", "If-Modified-Since", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), http.StatusNotModified, ""},
+			{"modified", "If-Modified-Since", time.Unix(0, 0).UTC().Format(http.TimeFormat), http.StatusOK, "0123456789"},
+		}
+		for _, test := range tests {
+			req, err := http.NewRequest("GET", "/v1.0/abc/test/clip.mkv", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			token, err := createToken(tokenSecret)
+			if err != nil {
+				t.Fatalf("failed generating token while setting up test %v", err)
+			}
+			req.Header.Add("X-Auth-Token", token)
+			req.Header.Add(test.header, test.value)
+			rr := httptest.NewRecorder()
+			s.storageHandler(rr, req)
+			if rr.Code != test.code {
+				t.Errorf("%s: wrong status code: got %v want %v", test.name, rr.Code, test.code)
+			}
+			if test.body != "" && rr.Body.String() != test.body {
+				t.Errorf("%s: wrong body: got %q want %q", test.name, rr.Body.String(), test.body)
+			}
+		}
+
+		rr = storageRequest(t, s, "GET", "/v1.0/abc/test/clip.key", nil, nil)
+		if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("wrong Content-Type for a key file: got %s want application/json", ct)
+		}
+		rr = storageRequest(t, s, "GET", "/v1.0/abc/test/dir/clip.mp4", nil, nil)
+		if rr.Code != http.StatusOK || rr.Body.String() != "nested" || rr.Header().Get("Content-Type") != "video/mp4" {
+			t.Errorf("wrong nested download: got %v %q %s", rr.Code, rr.Body.String(), rr.Header().Get("Content-Type"))
+		}
+		// An object stored without an ETag on the file backend is sent without
+		// one, other backends know the hash of every object
+		if err := s.backend.PutObject("test/legacy.mkv", strings.NewReader("legacy"), ""); err != nil {
+			t.Fatal(err)
+		}
+		rr = storageRequest(t, s, "GET", "/v1.0/abc/test/legacy.mkv", nil, nil)
+		want := md5Hex("legacy")
+		if _, ok := s.backend.(*FileBackend); ok {
+			want = ""
+		}
+		if rr.Code != http.StatusOK || rr.Body.String() != "legacy" || rr.Header().Get("Etag") != want {
+			t.Errorf("wrong download without a stored ETag: got %v %q %s", rr.Code, rr.Body.String(), rr.Header().Get("Etag"))
+		}
+		for _, name := range []string{"missing.mkv", "dir"} {
+			rr = storageRequest(t, s, "GET", "/v1.0/abc/test/"+name, nil, nil)
+			if rr.Code != http.StatusNotFound {
+				t.Errorf("handler returned wrong status code for %s: got %v want %v", name, rr.Code, http.StatusNotFound)
+			}
+		}
+	})
+}
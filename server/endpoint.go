@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Limits of the connection file, see the README
+const (
+	maxAuthenticationURIs     = 10
+	maxAuthenticationURILen   = 512
+	maxHTTPSCertificateLength = 16 * 1024
+)
+
+// endpointURI returns the authentication URI of endpoint, a host name or IP
+// address the system controllers reach the server by on its port, or the URL
+// of a NAT or load balancer forwarding to it, and the host to put in the
+// certificates.
+func endpointURI(s Settings, endpoint string) (uri, host string, err error) {
+	if !strings.Contains(endpoint, "://") {
+		host = strings.TrimSuffix(strings.TrimPrefix(endpoint, "["), "]")
+		if net.ParseIP(host) == nil && !validHostname(host) {
+			return "", "", fmt.Errorf("invalid host name %q", endpoint)
+		}
+		return authenticationURI(s, host), host, nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", "", err
+	}
+	scheme := "http"
+	if s.UseHttps {
+		scheme = "https"
+	}
+	if u.Scheme != scheme {
+		return "", "", fmt.Errorf("%s must use %s like the server", endpoint, scheme)
+	}
+	host = u.Hostname()
+	if net.ParseIP(host) == nil && !validHostname(host) {
+		return "", "", fmt.Errorf("invalid host in %s", endpoint)
+	}
+	// The storage URL is on the same host, without a path prefix
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" ||
+		(u.Path != "" && u.Path != "/" && u.Path != RootAuthEndpoint) {
+		return "", "", fmt.Errorf("%s must have no path other than %s", endpoint, RootAuthEndpoint)
+	}
+	u.Path = RootAuthEndpoint
+	return u.String(), host, nil
+}
+
+// validHostname reports whether name is a DNS name.
+func validHostname(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// endpointHosts returns the hosts of the endpoints, for the certificates.
+func endpointHosts(s Settings) []string {
+	hosts := []string{}
+	for _, endpoint := range s.Endpoints {
+		if _, host, err := endpointURI(s, endpoint); err == nil {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// serverHosts returns the IPs and endpoint hosts the server certificates
+// must be valid for.
+func serverHosts(s Settings) []string {
+	return append(append([]string{}, s.IPs...), endpointHosts(s)...)
+}
+
+// authenticationURIs returns the AuthenticationTokenURI of the connection
+// file, the endpoints first and then the IPs.
+func authenticationURIs(s Settings) ([]string, error) {
+	uris := []string{}
+	for _, endpoint := range s.Endpoints {
+		uri, _, err := endpointURI(s, endpoint)
+		if err != nil {
+			return nil, err
+		}
+		uris = append(uris, uri)
+	}
+	for _, ip := range s.IPs {
+		uris = append(uris, authenticationURI(s, ip))
+	}
+	return uris, nil
+}
+
+// validateConnectionFile checks conf against the limits of the system
+// controller.
+func validateConnectionFile(conf Config) error {
+	if len(conf.AuthenticationTokenURI) > maxAuthenticationURIs {
+		return fmt.Errorf("%d authentication URIs, at most %d are allowed", len(conf.AuthenticationTokenURI), maxAuthenticationURIs)
+	}
+	for _, uri := range conf.AuthenticationTokenURI {
+		if len(uri) > maxAuthenticationURILen {
+			return fmt.Errorf("authentication URI %s is longer than %d characters", uri, maxAuthenticationURILen)
+		}
+		if u, err := url.Parse(uri); err != nil || !u.IsAbs() || u.Host == "" {
+			return fmt.Errorf("invalid authentication URI %s", uri)
+		}
+	}
+	if len(conf.HTTPSCertificate) > maxPublishedCertificates {
+		return fmt.Errorf("%d certificates, at most %d are allowed", len(conf.HTTPSCertificate), maxPublishedCertificates)
+	}
+	for _, cert := range conf.HTTPSCertificate {
+		if len(cert) > maxHTTPSCertificateLength {
+			return fmt.Errorf("certificate longer than %d characters", maxHTTPSCertificateLength)
+		}
+	}
+	return nil
+}
+
+// askEndpoints asks for the host names and URLs the system controllers reach
+// the server by, besides its IPs.
+func askEndpoints(scanner *bufio.Scanner, s Settings) []string {
+	for {
+		endpoints := strings.Fields(ask(scanner, "Enter host names or URLs the system controllers reach the server by, separated by spaces, or leave empty to only use the IPs >"))
+		s.Endpoints = endpoints
+		if err := checkEndpoints(s); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		return endpoints
+	}
+}
+
+// checkEndpoints checks that every endpoint is valid and the connection file
+// has room for them.
+func checkEndpoints(s Settings) error {
+	uris, err := authenticationURIs(s)
+	if err != nil {
+		return err
+	}
+	return validateConnectionFile(Config{AuthenticationTokenURI: uris})
+}
+
+// AddEndpoint publishes the host name or URL endpoint in the connection file
+// of every account.
+// Certificates issued by the local CA are issued again to be valid for it,
+// and other server certificates must already be.
+func AddEndpoint(configPath, endpoint string) error {
+	settingsFile := filepath.Join(configPath, settingsFilename)
+	data, err := os.ReadFile(settingsFile)
+	if err != nil {
+		return err
+	}
+	settings := Settings{}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return err
+	}
+	for _, existing := range settings.Endpoints {
+		if existing == endpoint {
+			return fmt.Errorf("%s is already an endpoint", endpoint)
+		}
+	}
+	settings.Endpoints = append(settings.Endpoints, endpoint)
+	if err := checkEndpoints(settings); err != nil {
+		return err
+	}
+	switch {
+	case !settings.UseHttps:
+	case settings.ServerCertificate != nil:
+		if err := updateServerCertificate(configPath, settings); err != nil {
+			return err
+		}
+	case !hasLocalCA(configPath):
+		return errors.New("the certificates are self-signed, install again to use a local CA")
+	default:
+		if err := generateCertsFor(configPath, settings); err != nil {
+			return err
+		}
+	}
+	confJson, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(settingsFile, strings.NewReader(string(confJson))); err != nil {
+		return err
+	}
+	uris, err := authenticationURIs(settings)
+	if err != nil {
+		return err
+	}
+	_, err = updateConnectionFiles(settings, func(conf *Config) {
+		conf.AuthenticationTokenURI = uris
+	})
+	return err
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEndpointURI(t *testing.T) {
+	settings := Settings{Port: "8080", UseHttps: true}
+	for _, test := range []struct {
+		endpoint, uri, host string
+	}{
+		{"bwc.example.com", "https://bwc.example.com:8080/auth/v1.0", "bwc.example.com"},
+		{"2001:db8::10", "https://[2001:db8::10]:8080/auth/v1.0", "2001:db8::10"},
+		{"[2001:db8::10]", "https://[2001:db8::10]:8080/auth/v1.0", "2001:db8::10"},
+		{"https://lb.example.com", "https://lb.example.com/auth/v1.0", "lb.example.com"},
+		{"https://203.0.113.5:443/", "https://203.0.113.5:443/auth/v1.0", "203.0.113.5"},
+		{"https://[2001:db8::1]:9443/auth/v1.0", "https://[2001:db8::1]:9443/auth/v1.0", "2001:db8::1"},
+		{"http://lb.example.com", "", ""},
+		{"https://lb.example.com/bwc", "", ""},
+		{"https://user@lb.example.com", "", ""},
+		{"https://lb.example.com?x=1", "", ""},
+		{"bad_host.example.com", "", ""},
+		{"-bad.example.com", "", ""},
+	} {
+		uri, host, err := endpointURI(settings, test.endpoint)
+		if test.uri == "" {
+			if err == nil {
+				t.Errorf("%s: accepted as %s", test.endpoint, uri)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.endpoint, err)
+			continue
+		}
+		if uri != test.uri || host != test.host {
+			t.Errorf("%s: got %s and %s want %s and %s", test.endpoint, uri, host, test.uri, test.host)
+		}
+	}
+}
+
+// Check that the connection file is limited to 10 URIs of 512 characters
+func TestValidateConnectionFile(t *testing.T) {
+	uris := []string{}
+	for i := 0; i < maxAuthenticationURIs; i++ {
+		uris = append(uris, fmt.Sprintf("https://10.0.0.%d:8080/auth/v1.0", i))
+	}
+	if err := validateConnectionFile(Config{AuthenticationTokenURI: uris}); err != nil {
+		t.Error(err)
+	}
+	if err := validateConnectionFile(Config{AuthenticationTokenURI: append(uris, "https://10.0.0.10:8080/auth/v1.0")}); err == nil {
+		t.Error("more than 10 URIs accepted")
+	}
+	long := "https://" + strings.Repeat("a", 500) + ".example.com/auth/v1.0"
+	if err := validateConnectionFile(Config{AuthenticationTokenURI: []string{long}}); err == nil {
+		t.Error("URI longer than 512 characters accepted")
+	}
+	if err := validateConnectionFile(Config{AuthenticationTokenURI: []string{"10.0.0.1:8080"}}); err == nil {
+		t.Error("URI without scheme accepted")
+	}
+}
+
+// Check that added endpoints are published before the IPs for every account,
+// and the certificates of the local CA are valid for them
+func TestAddEndpoint(t *testing.T) {
+	configPath, storage, agencyStorage := t.TempDir(), t.TempDir(), t.TempDir()
+	ips := generateCerts(configPath, []string{"127.0.0.1", "::1"}, nil)
+	settings := Settings{
+		StorageLocation: storage, IPs: ips, Port: "8080", UseHttps: true, Username: "test:tester",
+		Accounts: []Account{{Name: "agency", Username: "agency:tester", StorageLocation: agencyStorage}},
+	}
+	data, err := json.Marshal(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(configPath, settingsFilename), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, location := range []string{storage, agencyStorage} {
+		connection := settings
+		connection.StorageLocation = location
+		if err := generateConnectionFile(configPath, "test", connection); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if uri := readConnectionFile(t, storage).AuthenticationTokenURI[1]; uri != "https://[::1]:8080/auth/v1.0" {
+		t.Errorf("wrong URI for IPv6 address: got %s", uri)
+	}
+
+	for _, endpoint := range []string{"bwc.example.com", "https://203.0.113.5:443"} {
+		if err := AddEndpoint(configPath, endpoint); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, endpoint := range []string{"bwc.example.com", "http://lb.example.com", "bad host"} {
+		if err := AddEndpoint(configPath, endpoint); err == nil {
+			t.Errorf("endpoint %s added", endpoint)
+		}
+	}
+	want := []string{
+		"https://bwc.example.com:8080/auth/v1.0",
+		"https://203.0.113.5:443/auth/v1.0",
+		"https://127.0.0.1:8080/auth/v1.0",
+		"https://[::1]:8080/auth/v1.0",
+	}
+	for _, location := range []string{storage, agencyStorage} {
+		if uris := readConnectionFile(t, location).AuthenticationTokenURI; strings.Join(uris, " ") != strings.Join(want, " ") {
+			t.Errorf("wrong URIs in %s: got %v want %v", location, uris, want)
+		}
+	}
+
+	ca, _, err := localCA(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	for i := range ips {
+		cert, _, err := loadCert(configPath, buildCertName(i), buildKeyName(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, host := range []string{ips[i], "bwc.example.com", "203.0.113.5"} {
+			if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, DNSName: host}); err != nil {
+				t.Errorf("certificate %d not valid for %s: %v", i, host, err)
+			}
+		}
+	}
+
+	// The connection file has room for 10 URIs
+	for i := 0; i < 6; i++ {
+		if err := AddEndpoint(configPath, fmt.Sprintf("bwc%d.example.com", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := AddEndpoint(configPath, "bwc6.example.com"); err == nil {
+		t.Error("eleventh URI added")
+	}
+	if err := AddIP(configPath, "127.0.0.2"); err == nil {
+		t.Error("eleventh URI added")
+	}
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Keystone v3 password authentication, as used by standard OpenStack
+// clients. The token is returned in X-Subject-Token and is used in
+// X-Auth-Token like the tokens of RootAuthEndpoint.
+const (
+	KeystoneAuthEndpoint = "/v3/auth/tokens"
+	SubjectTokenTag      = "X-Subject-Token"
+
+	keystoneDomain = "Default"
+	keystoneRegion = "RegionOne"
+	// Request bodies are a few hundred bytes
+	maxKeystoneRequestSize = 64 * 1024
+)
+
+type keystoneDomainRef struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+type keystoneAuthRequest struct {
+	Auth struct {
+		Identity struct {
+			Methods  []string `json:"methods"`
+			Password struct {
+				User struct {
+					ID       string             `json:"id"`
+					Name     string             `json:"name"`
+					Domain   *keystoneDomainRef `json:"domain"`
+					Password string             `json:"password"`
+				} `json:"user"`
+			} `json:"password"`
+		} `json:"identity"`
+	} `json:"auth"`
+}
+
+type keystoneEndpoint struct {
+	ID        string `json:"id"`
+	Interface string `json:"interface"`
+	Region    string `json:"region"`
+	RegionID  string `json:"region_id"`
+	URL       string `json:"url"`
+}
+
+type keystoneService struct {
+	ID        string             `json:"id"`
+	Name      string             `json:"name"`
+	Type      string             `json:"type"`
+	Endpoints []keystoneEndpoint `json:"endpoints"`
+}
+
+type keystoneToken struct {
+	Methods   []string `json:"methods"`
+	ExpiresAt string   `json:"expires_at"`
+	IssuedAt  string   `json:"issued_at"`
+	User      struct {
+		ID     string            `json:"id"`
+		Name   string            `json:"name"`
+		Domain keystoneDomainRef `json:"domain"`
+	} `json:"user"`
+	Project struct {
+		ID     string            `json:"id"`
+		Name   string            `json:"name"`
+		Domain keystoneDomainRef `json:"domain"`
+	} `json:"project"`
+	Catalog []keystoneService `json:"catalog"`
+}
+
+// keystoneAuthentication issues a token for the password credentials in the
+// request body, with a service catalog holding the storage URL of the account
+// of the user. The scope of the request is ignored, users have one account.
+func (s *Server) keystoneAuthentication(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	req := keystoneAuthRequest{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxKeystoneRequestSize)).Decode(&req); err != nil {
+		logger.Errorf("Invalid authentication request: %v", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	identity := req.Auth.Identity
+	password := false
+	for _, method := range identity.Methods {
+		password = password || method == "password"
+	}
+	if !password {
+		logger.Error("Call to auth without password credentials")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	user := identity.Password.User
+	username := user.Name
+	if username == "" {
+		// Users have no IDs of their own, the name is used as ID
+		username = user.ID
+	}
+	if user.Domain != nil && (user.Domain.ID != "" && user.Domain.ID != "default" || user.Domain.Name != "" && user.Domain.Name != keystoneDomain) {
+		logger.Errorf("Call to auth with unknown domain %+v", *user.Domain)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	srv, accessToken, err := s.login(r, username, user.Password)
+	if err != nil {
+		loginError(w, err)
+		return
+	}
+	claims, err := s.verifyToken([]string{accessToken})
+	if err != nil {
+		logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	domain := keystoneDomainRef{ID: "default", Name: keystoneDomain}
+	token := keystoneToken{
+		Methods:   []string{"password"},
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0).UTC().Format(time.RFC3339),
+		IssuedAt:  time.Now().UTC().Format(time.RFC3339),
+	}
+	token.User.ID, token.User.Name, token.User.Domain = username, username, domain
+	token.Project.ID, token.Project.Name, token.Project.Domain = srv.accountName(), srv.accountName(), domain
+	token.Catalog = []keystoneService{{
+		ID:   "swift",
+		Name: "swift",
+		Type: "object-store",
+		Endpoints: []keystoneEndpoint{{
+			ID:        "swift-public",
+			Interface: "public",
+			Region:    keystoneRegion,
+			RegionID:  keystoneRegion,
+			URL:       s.storageURL(r, srv.accountName()),
+		}},
+	}}
+
+	w.Header().Set(SubjectTokenTag, accessToken)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(map[string]keystoneToken{"token": token}); err != nil {
+		logger.Error(err)
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func keystoneRequest(t *testing.T, s *Server, method, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, KeystoneAuthEndpoint, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "localhost:8080"
+	rr := httptest.NewRecorder()
+	s.keystoneAuthentication(rr, req)
+	return rr
+}
+
+func keystonePassword(username, password string) string {
+	return `{"auth": {"identity": {"methods": ["password"], "password": {"user": {"name": "` + username +
+		`", "domain": {"name": "Default"}, "password": "` + password + `"}}}}}`
+}
+
+// Check that Keystone v3 tokens work on the storage URL in the service catalog
+func TestKeystoneAuthentication(t *testing.T) {
+	s, _, _ := newAccountsServer(t)
+
+	for username, account := range map[string]string{"test:tester": defaultAccount, "agency:tester": "agency"} {
+		rr := keystoneRequest(t, s, "POST", keystonePassword(username, "testing"))
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", username, rr.Code, http.StatusCreated)
+		}
+		response := map[string]keystoneToken{}
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		catalog := response["token"].Catalog
+		if len(catalog) != 1 || catalog[0].Type != "object-store" || len(catalog[0].Endpoints) != 1 {
+			t.Fatalf("%s: unexpected service catalog %+v", username, catalog)
+		}
+		want := "http://localhost:8080" + RootStoragePrefix + account
+		if url := catalog[0].Endpoints[0].URL; url != want {
+			t.Errorf("%s: wrong storage URL: got %s want %s", username, url, want)
+		}
+		token := rr.Header().Get(SubjectTokenTag)
+		if code := storageRequest(t, s, "HEAD", RootStoragePrefix+account, nil, map[string]string{"X-Auth-Token": token}).Code; code != http.StatusOK {
+			t.Errorf("%s: token not accepted: got %v want %v", username, code, http.StatusOK)
+		}
+	}
+}
+
+func TestKeystoneAuthenticationFailure(t *testing.T) {
+	s, _, _ := newAccountsServer(t)
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		want   int
+	}{
+		{"wrong password", "POST", keystonePassword("test:tester", "wrong"), http.StatusUnauthorized},
+		{"unknown user", "POST", keystonePassword("nobody", "testing"), http.StatusUnauthorized},
+		{"token method", "POST", `{"auth": {"identity": {"methods": ["token"]}}}`, http.StatusUnauthorized},
+		{"other domain", "POST", strings.Replace(keystonePassword("test:tester", "testing"), "Default", "Other", 1), http.StatusUnauthorized},
+		{"invalid body", "POST", `{"auth": `, http.StatusBadRequest},
+		{"wrong method", "GET", "", http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		rr := keystoneRequest(t, s, test.method, test.body)
+		if rr.Code != test.want {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", test.name, rr.Code, test.want)
+		}
+		if rr.Header().Get(SubjectTokenTag) != "" {
+			t.Errorf("%s: token returned", test.name)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/ncw/swift/v2"
+)
+
+// Object metadata keys marking large objects. A dynamic large object (DLO)
+// keeps the "<container>/<prefix>" of its segments in manifestKey, a static
+// large object (SLO) stores its manifest as object content and has sloKey set.
+const (
+	manifestKey = "Manifest"
+	sloKey      = "Static-Large-Object"
+
+	ManifestTag          = "X-Object-Manifest"
+	StaticLargeObjectTag = "X-Static-Large-Object"
+
+	// Same limits as the Swift defaults
+	maxManifestSegments = 1000
+	maxManifestSize     = 8 * 1024 * 1024
+)
+
+// sloPutSegment is a segment as listed in a manifest uploaded with
+// multipart-manifest=put. Etag and SizeBytes are checked when present.
+type sloPutSegment struct {
+	Path      string  `json:"path"`
+	Etag      *string `json:"etag"`
+	SizeBytes *int64  `json:"size_bytes"`
+}
+
+// sloSegment is a segment as stored in the manifest of a static large object,
+// and returned with multipart-manifest=get. Name is "/<container>/<object>".
+type sloSegment struct {
+	Name  string `json:"name"`
+	Hash  string `json:"hash"`
+	Bytes int64  `json:"bytes"`
+}
+
+func isStaticLargeObject(meta map[string]string) bool {
+	return strings.EqualFold(metaValue(meta, sloKey), "True")
+}
+
+func isLargeObject(meta map[string]string) bool {
+	return isStaticLargeObject(meta) || metaValue(meta, manifestKey) != ""
+}
+
+// validManifest reports whether an X-Object-Manifest header names a container
+// and an optional prefix.
+func validManifest(manifest string) bool {
+	container, _ := splitTarget(strings.TrimPrefix(manifest, "/"))
+	return container != "" && validTarget(container)
+}
+
+// largeObjectHash returns the Etag of a large object, the MD5 of the
+// concatenated hashes of its segments.
+func largeObjectHash(segments []sloSegment) string {
+	digest := md5.New()
+	for _, seg := range segments {
+		io.WriteString(digest, seg.Hash)
+	}
+	return fmt.Sprintf("%x", digest.Sum(nil))
+}
+
+// objectHash returns the hex encoded MD5 of an object, from its metadata or
+// the backend. It is empty if neither knows it.
+func (s *Server) objectHash(target string, info ObjectInfo) string {
+	if meta, err := s.backend.LoadMetadata(target); err == nil {
+		if hash := metaValue(meta, etagKey); hash != "" {
+			return hash
+		}
+	}
+	return info.Hash
+}
+
+// handlePutManifest creates a static large object from the manifest in the
+// request body. Every segment must already exist, and match the size and
+// Etag given for it.
+func (s *Server) handlePutManifest(w http.ResponseWriter, r *http.Request, target string) {
+	if isSystemObject(target) {
+		logger.Error("System object can't be a large object: " + target)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	container, _ := splitTarget(target)
+	if err := s.checkRetention(container); err != nil {
+		retentionError(w, err)
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxManifestSize+1))
+	if err != nil {
+		logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxManifestSize {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+	var put []sloPutSegment
+	if err := json.Unmarshal(data, &put); err != nil {
+		logger.Error(err)
+		http.Error(w, "Invalid manifest", http.StatusBadRequest)
+		return
+	}
+	if len(put) == 0 || len(put) > maxManifestSegments {
+		http.Error(w, fmt.Sprintf("Manifest must have 1 to %d segments", maxManifestSegments), http.StatusBadRequest)
+		return
+	}
+
+	segments := make([]sloSegment, 0, len(put))
+	for _, seg := range put {
+		segTarget := strings.TrimPrefix(seg.Path, "/")
+		if _, object := splitTarget(segTarget); object == "" || !validTarget(segTarget) || segTarget == target {
+			http.Error(w, "Invalid segment "+seg.Path, http.StatusBadRequest)
+			return
+		}
+		info, err := s.backend.Stat(segTarget)
+		if err != nil || info.Container {
+			logger.Error("Segment not found: " + segTarget)
+			http.Error(w, "Segment not found "+seg.Path, http.StatusBadRequest)
+			return
+		}
+		hash := s.objectHash(segTarget, info)
+		if seg.SizeBytes != nil && *seg.SizeBytes != info.Size {
+			http.Error(w, "Size mismatch for segment "+seg.Path, http.StatusBadRequest)
+			return
+		}
+		if seg.Etag != nil && *seg.Etag != "" && !strings.EqualFold(strings.Trim(*seg.Etag, `"`), hash) {
+			http.Error(w, "Etag mismatch for segment "+seg.Path, http.StatusBadRequest)
+			return
+		}
+		segments = append(segments, sloSegment{Name: "/" + segTarget, Hash: hash, Bytes: info.Size})
+	}
+	hash := largeObjectHash(segments)
+	if etagMismatch(r, hash) {
+		http.Error(w, http.StatusText(http.StatusUnprocessableEntity), http.StatusUnprocessableEntity)
+		return
+	}
+
+	manifest, err := json.Marshal(segments)
+	if err != nil {
+		logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	replaced, _ := s.backend.LoadMetadata(target)
+	reservation, err := s.reserveQuota(target, int64(len(manifest)))
+	if err != nil {
+		quotaError(w, err)
+		return
+	}
+	defer reservation.release()
+	if err := s.backend.PutObject(target, bytes.NewReader(manifest), ""); err != nil {
+		logger.Error(err)
+		switch {
+		case isNoSpace(err):
+			http.Error(w, http.StatusText(http.StatusInsufficientStorage), http.StatusInsufficientStorage)
+		case isNotExist(err):
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		case isNameConflict(err):
+			http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+		default:
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+	reservation.commit(int64(len(manifest)))
+	s.audit(AuditEntry{Action: "object-created", Target: target, Remote: r.RemoteAddr, Client: clientIdentity(r), Detail: fmt.Sprintf("manifest:%d segments", len(segments))})
+	logger.Info("Created static large object: " + target + "\n")
+	system := map[string]string{etagKey: hash, sloKey: "True"}
+	if client := clientIdentity(r); client != "" {
+		system[clientKey] = client
+	}
+	if e := s.handlePutMetadata(r, target, system, replaced); e != nil {
+		http.Error(w, e.Text, e.StatusCode)
+		return
+	}
+	w.Header().Set("Etag", hash)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// largeObjectSegments returns the segments of the large object target with
+// metadata meta. The segments of a dynamic large object are the objects in
+// the manifest container starting with its prefix, in name order.
+func (s *Server) largeObjectSegments(target string, meta map[string]string) ([]sloSegment, error) {
+	if isStaticLargeObject(meta) {
+		content, err := s.backend.GetObject(target)
+		if err != nil {
+			return nil, err
+		}
+		defer content.Close()
+		segments := []sloSegment{}
+		if err := json.NewDecoder(content).Decode(&segments); err != nil {
+			return nil, fmt.Errorf("corrupt manifest %s: %v", target, err)
+		}
+		return segments, nil
+	}
+
+	container, prefix := splitTarget(strings.TrimPrefix(metaValue(meta, manifestKey), "/"))
+	objects, err := s.backend.List(container)
+	if err != nil {
+		return nil, err
+	}
+	segments := []sloSegment{}
+	for _, o := range objects {
+		segTarget := container + "/" + o.Name
+		if !strings.HasPrefix(o.Name, prefix) || segTarget == target {
+			continue
+		}
+		segments = append(segments, sloSegment{Name: "/" + segTarget, Hash: s.objectHash(segTarget, o), Bytes: o.Size})
+	}
+	return segments, nil
+}
+
+// deleteSegments deletes the segments of a static large object, when
+// requested with multipart-manifest=delete. Missing segments are skipped.
+func (s *Server) deleteSegments(r *http.Request, target string) error {
+	meta, err := s.backend.LoadMetadata(target)
+	if err != nil || !isStaticLargeObject(meta) {
+		return nil
+	}
+	segments, err := s.largeObjectSegments(target, meta)
+	if err != nil {
+		return err
+	}
+	for _, seg := range segments {
+		segTarget := strings.TrimPrefix(seg.Name, "/")
+		container, _ := splitTarget(segTarget)
+		if err := s.checkRetention(container); err != nil {
+			return err
+		}
+	}
+	for _, seg := range segments {
+		segTarget := strings.TrimPrefix(seg.Name, "/")
+		if err := s.deleteTarget(segTarget); err != nil && !isNotExist(err) {
+			return err
+		}
+		s.audit(AuditEntry{Action: "deleted", Target: segTarget, Remote: r.RemoteAddr})
+	}
+	return nil
+}
+
+// segmentReader reads the segments of a large object as one object. Segments
+// are opened when read, so seeking is cheap.
+type segmentReader struct {
+	backend  Backend
+	segments []sloSegment
+	size     int64
+	offset   int64
+	current  io.ReadSeekCloser
+	end      int64 // End offset of the current segment
+}
+
+func newSegmentReader(backend Backend, segments []sloSegment) *segmentReader {
+	r := &segmentReader{backend: backend, segments: segments}
+	for _, seg := range segments {
+		r.size += seg.Bytes
+	}
+	return r
+}
+
+// open opens the segment holding the current offset.
+func (r *segmentReader) open() error {
+	start := int64(0)
+	for _, seg := range r.segments {
+		if r.offset < start+seg.Bytes {
+			content, err := r.backend.GetObject(strings.TrimPrefix(seg.Name, "/"))
+			if err != nil {
+				return err
+			}
+			if _, err := content.Seek(r.offset-start, io.SeekStart); err != nil {
+				content.Close()
+				return err
+			}
+			r.current, r.end = content, start+seg.Bytes
+			return nil
+		}
+		start += seg.Bytes
+	}
+	return io.EOF
+}
+
+func (r *segmentReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.current == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	if left := r.end - r.offset; int64(len(p)) > left {
+		p = p[:left]
+	}
+	n, err := r.current.Read(p)
+	r.offset += int64(n)
+	if r.offset == r.end {
+		r.current.Close()
+		r.current = nil
+		return n, nil
+	}
+	// A segment shorter than listed in the manifest
+	if errors.Is(err, io.EOF) {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *segmentReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset != r.offset && r.current != nil {
+		r.current.Close()
+		r.current = nil
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *segmentReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
+
+// handleLargeObjectError answers a request for a large object whose segments
+// couldn't be found.
+func handleLargeObjectError(w http.ResponseWriter, err error) {
+	logger.Error(err)
+	if isNotExist(err) {
+		e := swift.ContainerNotFound
+		http.Error(w, e.Text, e.StatusCode)
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// checkLargeObject checks that the large object test/big reads as the
+// concatenation of its segments, with and without Range.
+func checkLargeObject(t *testing.T, s *Server, etag string) {
+	rr := storageRequest(t, s, "GET", "/v1.0/abc/test/big", nil, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if body := rr.Body.String(); body != "hello world" {
+		t.Errorf("wrong body: got %q want %q", body, "hello world")
+	}
+	if got := rr.Header().Get("Etag"); got != etag {
+		t.Errorf("wrong Etag: got %s want %s", got, etag)
+	}
+
+	rr = storageRequest(t, s, "GET", "/v1.0/abc/test/big", nil, map[string]string{"Range": "bytes=3-7"})
+	if rr.Code != http.StatusPartialContent {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusPartialContent)
+	}
+	if body := rr.Body.String(); body != "lo wo" {
+		t.Errorf("wrong range: got %q want %q", body, "lo wo")
+	}
+
+	rr = storageRequest(t, s, "HEAD", "/v1.0/abc/test/big", nil, nil)
+	if got := rr.Header().Get("Etag"); got != etag {
+		t.Errorf("wrong Etag on HEAD: got %s want %s", got, etag)
+	}
+}
+
+func TestDynamicLargeObject(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		s.settings.AllowDownload = true
+		createContainer(t, map[string]string{"Test-Container": "test"}, s)
+		// Segments may be uploaded in any order
+		createDownloadObject(t, s, "big_segments/002", "world")
+		createDownloadObject(t, s, "big_segments/001", "hello ")
+
+		rr := storageRequest(t, s, "PUT", "/v1.0/abc/test/big", strings.NewReader(""), map[string]string{ManifestTag: "test/big_segments/"})
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+		}
+		checkLargeObject(t, s, md5Hex(md5Hex("hello ")+md5Hex("world")))
+
+		rr = storageRequest(t, s, "HEAD", "/v1.0/abc/test/big", nil, nil)
+		if got := rr.Header().Get(ManifestTag); got != "test/big_segments/" {
+			t.Errorf("wrong %s: got %s want test/big_segments/", ManifestTag, got)
+		}
+
+		rr = storageRequest(t, s, "PUT", "/v1.0/abc/test/bad", strings.NewReader(""), map[string]string{ManifestTag: "../big_segments/"})
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+		}
+	})
+}
+
+// Check that the System objects, readable without AllowDownload, can't be
+// made large objects reading other containers
+func TestSystemLargeObject(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		createContainer(t, map[string]string{"Test-Container": "test"}, s)
+		createDownloadObject(t, s, "clip.mkv", "secret")
+		if _, err := s.backend.CreateContainer("System"); err != nil {
+			t.Fatal(err)
+		}
+
+		rr := storageRequest(t, s, "PUT", "/v1.0/abc/System/Capabilities.json", strings.NewReader(""), map[string]string{ManifestTag: "test/"})
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+		}
+		manifest := `[{"path": "/test/clip.mkv"}]`
+		rr = storageRequest(t, s, "PUT", "/v1.0/abc/System/Capabilities.json?multipart-manifest=put", strings.NewReader(manifest), nil)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+		}
+
+		// A manifest stored before the check doesn't give access either
+		if err := s.backend.PutObject("System/Categories.json", strings.NewReader(""), ""); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.backend.StoreMetadata("System/Categories.json", map[string]string{manifestKey: "test/"}); err != nil {
+			t.Fatal(err)
+		}
+		rr = storageRequest(t, s, "GET", "/v1.0/abc/System/Categories.json", nil, nil)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+		}
+		if strings.Contains(rr.Body.String(), "secret") {
+			t.Error("segment was read without AllowDownload")
+		}
+	})
+}
+
+func TestStaticLargeObject(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		s.settings.AllowDownload = true
+		createContainer(t, map[string]string{"Test-Container": "test"}, s)
+		createDownloadObject(t, s, "seg1", "hello ")
+		createDownloadObject(t, s, "seg2", "world")
+
+		size := func(n int64) *int64 { return &n }
+		etag := func(data string) *string { e := md5Hex(data); return &e }
+		tests := []struct {
+			name     string
+			segments []sloPutSegment
+			want     int
+		}{
+			{"wrong size", []sloPutSegment{{Path: "/test/seg1", SizeBytes: size(5)}}, http.StatusBadRequest},
+			{"wrong etag", []sloPutSegment{{Path: "/test/seg1", Etag: etag("world")}}, http.StatusBadRequest},
+			{"missing segment", []sloPutSegment{{Path: "/test/seg3"}}, http.StatusBadRequest},
+			{"invalid segment", []sloPutSegment{{Path: "/test/../seg1"}}, http.StatusBadRequest},
+			{"no segments", []sloPutSegment{}, http.StatusBadRequest},
+			{"valid", []sloPutSegment{
+				{Path: "/test/seg1", Etag: etag("hello "), SizeBytes: size(6)},
+				{Path: "/test/seg2"},
+			}, http.StatusCreated},
+		}
+		for _, test := range tests {
+			manifest, err := json.Marshal(test.segments)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := storageRequest(t, s, "PUT", "/v1.0/abc/test/big?multipart-manifest=put", strings.NewReader(string(manifest)), nil)
+			if rr.Code != test.want {
+				t.Errorf("%s: handler returned wrong status code: got %v want %v", test.name, rr.Code, test.want)
+			}
+		}
+		want := md5Hex(md5Hex("hello ") + md5Hex("world"))
+		checkLargeObject(t, s, want)
+
+		rr := storageRequest(t, s, "GET", "/v1.0/abc/test/big?multipart-manifest=get", nil, nil)
+		var segments []sloSegment
+		if err := json.Unmarshal(rr.Body.Bytes(), &segments); err != nil {
+			t.Fatal(err)
+		}
+		if len(segments) != 2 || segments[1].Name != "/test/seg2" || segments[1].Bytes != 5 || segments[1].Hash != md5Hex("world") {
+			t.Errorf("wrong manifest: %+v", segments)
+		}
+		if got := storageRequest(t, s, "HEAD", "/v1.0/abc/test/big", nil, nil).Header().Get(StaticLargeObjectTag); got != "True" {
+			t.Errorf("wrong %s: got %s want True", StaticLargeObjectTag, got)
+		}
+
+		rr = storageRequest(t, s, "DELETE", "/v1.0/abc/test/big?multipart-manifest=delete", nil, nil)
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNoContent)
+		}
+		for _, target := range []string{"test/big", "test/seg1", "test/seg2"} {
+			if _, err := s.backend.Stat(target); !isNotExist(err) {
+				t.Errorf("%s wasn't deleted: %v", target, err)
+			}
+		}
+	})
+}
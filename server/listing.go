@@ -0,0 +1,232 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ncw/swift/v2"
+)
+
+const (
+	listingLimit      = 10000
+	listingTimeFormat = "2006-01-02T15:04:05.000000"
+)
+
+// listItem is an entry of a listing, either a container or object, or a
+// pseudo directory when the listing is collapsed by a delimiter.
+type listItem struct {
+	ObjectInfo
+	subdir bool
+}
+
+type containerEntry struct {
+	Name         string `json:"name"`
+	Count        int64  `json:"count"`
+	Bytes        int64  `json:"bytes"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+type objectEntry struct {
+	Name         string `json:"name"`
+	Bytes        int64  `json:"bytes"`
+	ContentType  string `json:"content_type"`
+	LastModified string `json:"last_modified"`
+}
+
+type subdirEntry struct {
+	Subdir string `json:"subdir"`
+}
+
+// filterListing applies the Swift listing parameters prefix, delimiter, marker,
+// end_marker and limit to list.
+func filterListing(list []ObjectInfo, query url.Values) ([]listItem, error) {
+	limit := listingLimit
+	if l := query.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 || n > listingLimit {
+			return nil, fmt.Errorf("invalid limit %q", l)
+		}
+		limit = n
+	}
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	marker := query.Get("marker")
+	endMarker := query.Get("end_marker")
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	items := []listItem{}
+	for _, info := range list {
+		if len(items) >= limit {
+			break
+		}
+		name := info.Name
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		item := listItem{ObjectInfo: info}
+		if delimiter != "" {
+			if i := strings.Index(name[len(prefix):], delimiter); i >= 0 {
+				name = name[:len(prefix)+i+len(delimiter)]
+				item = listItem{ObjectInfo: ObjectInfo{Name: name}, subdir: true}
+			}
+		}
+		if name <= marker || (endMarker != "" && name >= endMarker) {
+			continue
+		}
+		if n := len(items); item.subdir && n > 0 && items[n-1].subdir && items[n-1].Name == name {
+			continue
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// wantJSON reports whether the client asked for a JSON listing.
+func wantJSON(r *http.Request) bool {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return f == "json"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// writeListing writes a listing as JSON or as plain text, one name per line.
+// As in Swift an empty plain text listing results in 204 No Content.
+func writeListing(w http.ResponseWriter, r *http.Request, items []listItem, entries []interface{}) {
+	if wantJSON(r) {
+		data, err := json.Marshal(entries)
+		if err != nil {
+			logger.Error(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(data)
+		return
+	}
+	if len(items) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, item := range items {
+		fmt.Fprintln(w, item.Name)
+	}
+}
+
+// usage returns the number of objects and the number of bytes they use.
+func usage(objects []ObjectInfo) (count, bytes int64) {
+	for _, o := range objects {
+		bytes += o.Size
+	}
+	return int64(len(objects)), bytes
+}
+
+// containerStats returns the number of objects in container and the number of
+// bytes they use.
+func (s *Server) containerStats(container string) (count, bytes int64, err error) {
+	objects, err := s.backend.List(container)
+	if err != nil {
+		return 0, 0, err
+	}
+	count, bytes = usage(objects)
+	return count, bytes, nil
+}
+
+func setContainerStats(w http.ResponseWriter, count, bytes int64) {
+	w.Header().Set("X-Container-Object-Count", strconv.FormatInt(count, 10))
+	w.Header().Set("X-Container-Bytes-Used", strconv.FormatInt(bytes, 10))
+}
+
+// handleListContainers lists the containers of the account.
+func (s *Server) handleListContainers(w http.ResponseWriter, r *http.Request) {
+	containers, err := s.backend.List("")
+	if err != nil {
+		logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	items, err := filterListing(containers, r.URL.Query())
+	if err != nil {
+		logger.Error(err)
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+
+	_, objectCount, bytesUsed, err := s.accountStats()
+	if err != nil {
+		logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("X-Account-Container-Count", strconv.Itoa(len(containers)))
+	w.Header().Set("X-Account-Object-Count", strconv.FormatInt(objectCount, 10))
+	w.Header().Set("X-Account-Bytes-Used", strconv.FormatInt(bytesUsed, 10))
+	entries := []interface{}{}
+	for _, item := range items {
+		if item.subdir {
+			entries = append(entries, subdirEntry{Subdir: item.Name})
+			continue
+		}
+		if !wantJSON(r) {
+			continue
+		}
+		count, bytes, err := s.containerUsage(item.Name)
+		if err != nil {
+			logger.Error(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		entry := containerEntry{Name: item.Name, Count: count, Bytes: bytes}
+		if !item.ModTime.IsZero() {
+			entry.LastModified = item.ModTime.UTC().Format(listingTimeFormat)
+		}
+		entries = append(entries, entry)
+	}
+	writeListing(w, r, items, entries)
+}
+
+// handleListObjects lists the objects in a container.
+func (s *Server) handleListObjects(w http.ResponseWriter, r *http.Request, container string) {
+	objects, err := s.backend.List(container)
+	if err != nil {
+		logger.Error(err)
+		if isNotExist(err) {
+			e := swift.ContainerNotFound
+			http.Error(w, e.Text, e.StatusCode)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	items, err := filterListing(objects, r.URL.Query())
+	if err != nil {
+		logger.Error(err)
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+	count, bytes := usage(objects)
+	setContainerStats(w, count, bytes)
+	if meta, err := s.backend.LoadMetadata(container); err == nil {
+		setMetadataHeaders(w, ContainerMeta, meta)
+	}
+
+	entries := []interface{}{}
+	for _, item := range items {
+		if item.subdir {
+			entries = append(entries, subdirEntry{Subdir: item.Name})
+			continue
+		}
+		entries = append(entries, objectEntry{
+			Name:         item.Name,
+			Bytes:        item.Size,
+			ContentType:  contentType(item.Name),
+			LastModified: item.ModTime.UTC().Format(listingTimeFormat),
+		})
+	}
+	writeListing(w, r, items, entries)
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func createListingObjects(t *testing.T, s *Server) {
+	if code := createContainer(t, map[string]string{"Test-Container": "test"}, s); code != http.StatusCreated {
+		t.Fatalf("Error expected %v but got %v when creating a container", http.StatusCreated, code)
+	}
+	for _, name := range []string{"a.mkv", "b.json", "dir/c.mp4", "dir/sub/d.mkv"} {
+		rr := storageRequest(t, s, "PUT", "/v1.0/abc/test/"+name, strings.NewReader(name), nil)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("Error expected %v but got %v when creating %s", http.StatusCreated, rr.Code, name)
+		}
+	}
+	// Metadata must never be listed as objects
+	if code := postToObject("a.mkv", map[string]string{"Test": "listing"}, t, s); code != http.StatusAccepted {
+		t.Fatalf("Error expected %v but got %v when posting metadata", http.StatusAccepted, code)
+	}
+}
+
+func TestListObjects(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		createListingObjects(t, s)
+
+		tests := []struct {
+			query string
+			want  string
+		}{
+			{"", "a.mkv\nb.json\ndir/c.mp4\ndir/sub/d.mkv\n"},
+			{"?prefix=dir/", "dir/c.mp4\ndir/sub/d.mkv\n"},
+			{"?delimiter=/", "a.mkv\nb.json\ndir/\n"},
+			{"?prefix=dir/&delimiter=/", "dir/c.mp4\ndir/sub/\n"},
+			{"?marker=b.json", "dir/c.mp4\ndir/sub/d.mkv\n"},
+			{"?end_marker=dir", "a.mkv\nb.json\n"},
+			{"?limit=1", "a.mkv\n"},
+		}
+		for _, test := range tests {
+			rr := storageRequest(t, s, "GET", "/v1.0/abc/test"+test.query, nil, nil)
+			if rr.Code != http.StatusOK {
+				t.Errorf("handler returned wrong status code for %q: got %v want %v", test.query, rr.Code, http.StatusOK)
+			}
+			if got := rr.Body.String(); got != test.want {
+				t.Errorf("wrong listing for %q: got %q want %q", test.query, got, test.want)
+			}
+		}
+
+		rr := storageRequest(t, s, "GET", "/v1.0/abc/test", nil, nil)
+		if count := rr.Header().Get("X-Container-Object-Count"); count != "4" {
+			t.Errorf("wrong object count: got %s want 4", count)
+		}
+		if bytes := rr.Header().Get("X-Container-Bytes-Used"); bytes != "33" {
+			t.Errorf("wrong bytes used: got %s want 33", bytes)
+		}
+		if meta := rr.Header().Get("X-Container-Meta-Test-Container"); meta != "test" {
+			t.Errorf("wrong container metadata: got %s want test", meta)
+		}
+
+		rr = storageRequest(t, s, "GET", "/v1.0/abc/test?prefix=none", nil, nil)
+		if rr.Code != http.StatusNoContent {
+			t.Errorf("handler returned wrong status code for an empty listing: got %v want %v", rr.Code, http.StatusNoContent)
+		}
+		rr = storageRequest(t, s, "GET", "/v1.0/abc/test?limit=x", nil, nil)
+		if rr.Code != http.StatusPreconditionFailed {
+			t.Errorf("handler returned wrong status code for a bad limit: got %v want %v", rr.Code, http.StatusPreconditionFailed)
+		}
+		rr = storageRequest(t, s, "GET", "/v1.0/abc/missing", nil, nil)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("handler returned wrong status code for a missing container: got %v want %v", rr.Code, http.StatusNotFound)
+		}
+	})
+}
+
+func TestListObjectsJSON(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		createListingObjects(t, s)
+
+		rr := storageRequest(t, s, "GET", "/v1.0/abc/test?format=json&delimiter=/", nil, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		var entries []map[string]interface{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &entries); err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 3 {
+			t.Fatalf("wrong number of entries: got %d want 3", len(entries))
+		}
+		if entries[0]["name"] != "a.mkv" || entries[0]["bytes"] != float64(5) || entries[0]["content_type"] != "video/x-matroska" {
+			t.Errorf("wrong entry: %v", entries[0])
+		}
+		if entries[0]["last_modified"] == "" {
+			t.Errorf("missing last_modified: %v", entries[0])
+		}
+		if !reflect.DeepEqual(entries[2], map[string]interface{}{"subdir": "dir/"}) {
+			t.Errorf("wrong subdir entry: %v", entries[2])
+		}
+
+		// An empty JSON listing is an empty array, not 204
+		rr = storageRequest(t, s, "GET", "/v1.0/abc/test?format=json&prefix=none", nil, nil)
+		if rr.Code != http.StatusOK || rr.Body.String() != "[]" {
+			t.Errorf("wrong empty listing: got %v %q", rr.Code, rr.Body.String())
+		}
+	})
+}
+
+func TestListContainers(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		createListingObjects(t, s)
+		rr := storageRequest(t, s, "PUT", "/v1.0/abc/other", nil, nil)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("Error expected %v but got %v when creating a container", http.StatusCreated, rr.Code)
+		}
+
+		rr = storageRequest(t, s, "GET", "/v1.0/abc", nil, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		if got, want := rr.Body.String(), "other\ntest\n"; got != want {
+			t.Errorf("wrong listing: got %q want %q", got, want)
+		}
+		for header, want := range map[string]string{
+			"X-Account-Container-Count": "2",
+			"X-Account-Object-Count":    "4",
+			"X-Account-Bytes-Used":      "33",
+		} {
+			if got := rr.Header().Get(header); got != want {
+				t.Errorf("wrong %s: got %s want %s", header, got, want)
+			}
+		}
+
+		rr = storageRequest(t, s, "GET", "/v1.0/abc?format=json&marker=other", nil, nil)
+		var entries []containerEntry
+		if err := json.Unmarshal(rr.Body.Bytes(), &entries); err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Name != "test" || entries[0].Count != 4 || entries[0].Bytes != 33 {
+			t.Errorf("wrong container stats: %v", entries)
+		}
+
+		req, err := http.NewRequest("GET", "/v1.0/abc/?limit=1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := createToken(tokenSecret)
+		if err != nil {
+			t.Fatalf("failed generating token while setting up test %v", err)
+		}
+		req.Header.Add("X-Auth-Token", token)
+		req.Header.Add("Accept", "application/json")
+		rr = httptest.NewRecorder()
+		s.storageHandler(rr, req)
+		entries = nil
+		if err := json.Unmarshal(rr.Body.Bytes(), &entries); err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Name != "other" || entries[0].Count != 0 {
+			t.Errorf("wrong listing: %v", entries)
+		}
+
+		rr = storageRequest(t, s, "PUT", "/v1.0/abc", nil, nil)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code for PUT on the account: got %v want %v", rr.Code, http.StatusBadRequest)
+		}
+	})
+}
@@ -0,0 +1,325 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Quota limits the storage used by the body worn system, so uploads fail
+// before the disk is full. Zero values are unlimited.
+type Quota struct {
+	// MaxBytes is the number of bytes all containers may use
+	MaxBytes int64 `json:",omitempty"`
+	// UserBytes is the number of bytes the recordings of each user, by the
+	// UserID in their container metadata, may use
+	UserBytes int64 `json:",omitempty"`
+	// MaxObjectSize is the size of the largest object accepted
+	MaxObjectSize int64 `json:",omitempty"`
+}
+
+// QuotaBytesTag returns the account quota on HEAD of the account, like the
+// Swift account quota middleware.
+const QuotaBytesTag = "X-Account-Meta-Quota-Bytes"
+
+var (
+	errObjectTooLarge = errors.New("object exceeds the maximum object size")
+	errQuotaExceeded  = errors.New("upload exceeds the storage quota")
+)
+
+// accountStats returns the number of containers and objects of the account,
+// and the bytes they use, from the usage counter. Partial uploads aren't
+// included.
+func (s *Server) accountStats() (containers, objects, bytes int64, err error) {
+	s.usage.mu.Lock()
+	defer s.usage.mu.Unlock()
+	if err := s.loadUsage(); err != nil {
+		return 0, 0, 0, err
+	}
+	for c, used := range s.usage.bytes {
+		objects += s.usage.objects[c]
+		bytes += used
+	}
+	return int64(len(s.usage.bytes)), objects, bytes, nil
+}
+
+// containerUsage returns the number of objects in container and the bytes
+// they use from the usage counter.
+func (s *Server) containerUsage(container string) (objects, bytes int64, err error) {
+	s.usage.mu.Lock()
+	defer s.usage.mu.Unlock()
+	if err := s.loadUsage(); err != nil {
+		return 0, 0, err
+	}
+	return s.usage.objects[container], s.usage.bytes[container], nil
+}
+
+// usageCounter keeps the objects and bytes of each container of an account,
+// and the UserID of its recording, so the quota is checked and the usage
+// reported without listing every object. It's loaded from the backend on
+// first use and then updated as objects and container metadata are stored
+// and deleted. The size of an upload in progress is reserved until it's
+// stored, so concurrent uploads can't together exceed the quota.
+type usageCounter struct {
+	mu       sync.Mutex
+	bytes    map[string]int64
+	objects  map[string]int64
+	users    map[string]string
+	reserved map[string]int64
+}
+
+// quotaReservation holds the bytes reserved for an upload of target, and the
+// size of the object it replaces if there is one.
+type quotaReservation struct {
+	s         *Server
+	target    string
+	size      int64
+	replacing bool
+	replaced  int64
+	done      bool
+}
+
+// loadUsage fills the usage counter from the backend, s.usage.mu must be
+// held.
+func (s *Server) loadUsage() error {
+	if s.usage.bytes != nil {
+		return nil
+	}
+	list, err := s.backend.List("")
+	if err != nil {
+		return err
+	}
+	bytes, objects, users := map[string]int64{}, map[string]int64{}, map[string]string{}
+	for _, c := range list {
+		count, used, err := s.containerStats(c.Name)
+		if err != nil {
+			return err
+		}
+		bytes[c.Name], objects[c.Name] = used, count
+		if meta, err := s.backend.LoadMetadata(c.Name); err == nil {
+			users[c.Name] = metaValue(meta, "UserID")
+		}
+	}
+	s.usage.bytes, s.usage.objects, s.usage.users = bytes, objects, users
+	s.usage.reserved = map[string]int64{}
+	return nil
+}
+
+// addUsage adds objects and bytes to container, s.usage.mu must be held.
+// Nothing is counted before the counter is loaded.
+func (s *Server) addUsage(container string, objects, bytes int64) {
+	if s.usage.bytes != nil {
+		s.usage.objects[container] += objects
+		s.usage.bytes[container] += bytes
+	}
+}
+
+// storeContainerMetadata stores the metadata of container, and its UserID in
+// the usage counter.
+func (s *Server) storeContainerMetadata(container string, meta map[string]string) error {
+	if err := s.backend.StoreMetadata(container, meta); err != nil {
+		return err
+	}
+	s.usage.mu.Lock()
+	defer s.usage.mu.Unlock()
+	if s.usage.users != nil {
+		s.usage.users[container] = metaValue(meta, "UserID")
+		s.addUsage(container, 0, 0)
+	}
+	return nil
+}
+
+// deleteTarget deletes an object, or an empty container, from the backend
+// and the usage counter.
+func (s *Server) deleteTarget(target string) error {
+	info, err := s.backend.Stat(target)
+	if err != nil {
+		return err
+	}
+	if err := s.backend.Delete(target); err != nil {
+		return err
+	}
+	s.usage.mu.Lock()
+	defer s.usage.mu.Unlock()
+	container, object := splitTarget(target)
+	if object == "" {
+		delete(s.usage.bytes, container)
+		delete(s.usage.objects, container)
+		delete(s.usage.users, container)
+	} else {
+		s.addUsage(container, -1, -info.Size)
+	}
+	return nil
+}
+
+// checkQuota returns errObjectTooLarge or errQuotaExceeded if storing size
+// bytes as target would exceed the quota. A negative size is unknown, then
+// only full quotas are refused.
+func (s *Server) checkQuota(target string, size int64) error {
+	reservation, err := s.reserveQuota(target, size)
+	if err == nil {
+		reservation.release()
+	}
+	return err
+}
+
+// reserveQuota is checkQuota reserving size bytes for target. The
+// reservation must be released once the upload is stored or failed.
+func (s *Server) reserveQuota(target string, size int64) (*quotaReservation, error) {
+	reservation := &quotaReservation{s: s, target: target}
+	// Replacing an object frees its bytes
+	if info, err := s.backend.Stat(target); err == nil && !info.Container {
+		reservation.replacing, reservation.replaced = true, info.Size
+	}
+	quota := s.settings.Quota
+	if quota == nil {
+		return reservation, nil
+	}
+	if quota.MaxObjectSize > 0 && size > quota.MaxObjectSize {
+		return nil, errObjectTooLarge
+	}
+	// An upload of unknown size is refused if nothing is left
+	unknown := size < 0
+	if unknown {
+		size = 0
+	}
+	exceeds := func(used, limit int64) bool {
+		used -= reservation.replaced
+		return used+size > limit || (unknown && used >= limit)
+	}
+
+	s.usage.mu.Lock()
+	defer s.usage.mu.Unlock()
+	if err := s.loadUsage(); err != nil {
+		return nil, err
+	}
+	// Partial uploads will become objects, other than the one of target which
+	// size already includes
+	partial, err := s.partialUploadBytes(target)
+	if err != nil {
+		return nil, err
+	}
+	used := func(container string) int64 {
+		return s.usage.bytes[container] + s.usage.reserved[container] + partial[container]
+	}
+	containers := map[string]bool{}
+	for _, m := range []map[string]int64{s.usage.bytes, s.usage.reserved, partial} {
+		for c := range m {
+			containers[c] = true
+		}
+	}
+
+	if quota.MaxBytes > 0 {
+		var total int64
+		for c := range containers {
+			total += used(c)
+		}
+		if exceeds(total, quota.MaxBytes) {
+			return nil, fmt.Errorf("%w: %d of %d bytes used", errQuotaExceeded, total, quota.MaxBytes)
+		}
+	}
+	container, _ := splitTarget(target)
+	if userID := s.usage.users[container]; quota.UserBytes > 0 && userID != "" {
+		var total int64
+		for c := range containers {
+			if s.usage.users[c] == userID {
+				total += used(c)
+			}
+		}
+		if exceeds(total, quota.UserBytes) {
+			return nil, fmt.Errorf("%w: user %s uses %d of %d bytes", errQuotaExceeded, userID, total, quota.UserBytes)
+		}
+	}
+	reservation.size = size
+	s.usage.reserved[container] += size
+	return reservation, nil
+}
+
+// commit counts the stored size of the object in place of the reservation.
+func (r *quotaReservation) commit(stored int64) {
+	r.s.usage.mu.Lock()
+	defer r.s.usage.mu.Unlock()
+	if r.done {
+		return
+	}
+	container, _ := splitTarget(r.target)
+	if r.replacing {
+		r.s.addUsage(container, 0, stored-r.replaced)
+	} else {
+		r.s.addUsage(container, 1, stored)
+	}
+	r.done = true
+	if r.size > 0 {
+		r.s.usage.reserved[container] -= r.size
+	}
+}
+
+// release gives back the reserved bytes of an upload that wasn't stored.
+func (r *quotaReservation) release() {
+	r.s.usage.mu.Lock()
+	defer r.s.usage.mu.Unlock()
+	if r.done {
+		return
+	}
+	container, _ := splitTarget(r.target)
+	r.done = true
+	if r.size > 0 {
+		r.s.usage.reserved[container] -= r.size
+	}
+}
+
+// quotaError answers a request refused by checkQuota, 413 for a too large
+// object and 507 for an exceeded quota.
+func quotaError(w http.ResponseWriter, err error) {
+	logger.Error(err)
+	switch {
+	case errors.Is(err, errObjectTooLarge):
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errQuotaExceeded):
+		http.Error(w, http.StatusText(http.StatusInsufficientStorage), http.StatusInsufficientStorage)
+	default:
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// maxSizeReader fails with errObjectTooLarge once more than max bytes are
+// read, for uploads without Content-Length, and counts the bytes read.
+// Backends may wrap the error, so exceeded tells whether the upload failed
+// because of the limit.
+type maxSizeReader struct {
+	r        io.Reader
+	max      int64
+	read     int64
+	exceeded bool
+}
+
+func (m *maxSizeReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	m.read += int64(n)
+	m.max -= int64(n)
+	if m.max < 0 {
+		m.exceeded = true
+		return n, errObjectTooLarge
+	}
+	return n, err
+}
+
+// handleAccountMetadata returns the usage of the account, and its quota if
+// there is one.
+func (s *Server) handleAccountMetadata(w http.ResponseWriter, r *http.Request) {
+	containers, objects, bytes, err := s.accountStats()
+	if err != nil {
+		logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("X-Account-Container-Count", strconv.FormatInt(containers, 10))
+	w.Header().Set("X-Account-Object-Count", strconv.FormatInt(objects, 10))
+	w.Header().Set("X-Account-Bytes-Used", strconv.FormatInt(bytes, 10))
+	if quota := s.settings.Quota; quota != nil && quota.MaxBytes > 0 {
+		w.Header().Set(QuotaBytesTag, strconv.FormatInt(quota.MaxBytes, 10))
+	}
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMaxObjectSize(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		s.settings.Quota = &Quota{MaxObjectSize: 5}
+		createContainer(t, map[string]string{"Test-Container": "test"}, s)
+
+		tests := []struct {
+			name          string
+			data          string
+			contentLength int64
+			want          int
+		}{
+			{"too large", "0123456789", 10, http.StatusRequestEntityTooLarge},
+			{"too large without length", "0123456789", -1, http.StatusRequestEntityTooLarge},
+			{"max size", "01234", 5, http.StatusCreated},
+			{"max size without length", "01234", -1, http.StatusCreated},
+		}
+		for _, test := range tests {
+			if code := storageRequest(t, s, "PUT", "/v1.0/abc/test/clip.mkv", strings.NewReader(test.data), map[string]string{"Content-Length": strconv.FormatInt(test.contentLength, 10)}).Code; code != test.want {
+				t.Errorf("%s: handler returned wrong status code: got %v want %v", test.name, code, test.want)
+			}
+		}
+		if info, err := s.backend.Stat("test/clip.mkv"); err != nil || info.Size != 5 {
+			t.Errorf("wrong object stored: %+v %v", info, err)
+		}
+	})
+}
+
+func TestAccountQuota(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		s.settings.Quota = &Quota{MaxBytes: 12}
+		createContainer(t, map[string]string{"Test-Container": "test"}, s)
+
+		tests := []struct {
+			name string
+			path string
+			data string
+			want int
+		}{
+			{"fits", "/v1.0/abc/test/a", "01234", http.StatusCreated},
+			{"exceeds", "/v1.0/abc/test/b", "01234567", http.StatusInsufficientStorage},
+			{"replaces", "/v1.0/abc/test/a", "01234567", http.StatusCreated},
+			{"fills", "/v1.0/abc/test/b", "0123", http.StatusCreated},
+			{"empty", "/v1.0/abc/test/c", "", http.StatusCreated},
+		}
+		for _, test := range tests {
+			if code := storageRequest(t, s, "PUT", test.path, strings.NewReader(test.data), nil).Code; code != test.want {
+				t.Errorf("%s: handler returned wrong status code: got %v want %v", test.name, code, test.want)
+			}
+		}
+		if code := storageRequest(t, s, "PUT", "/v1.0/abc/test/d", strings.NewReader("0"), map[string]string{"Content-Length": "-1"}).Code; code != http.StatusInsufficientStorage {
+			t.Errorf("handler returned wrong status code: got %v want %v", code, http.StatusInsufficientStorage)
+		}
+
+		rr := storageRequest(t, s, "HEAD", "/v1.0/abc", nil, nil)
+		for header, want := range map[string]string{
+			"X-Account-Container-Count": "1",
+			"X-Account-Object-Count":    "3",
+			"X-Account-Bytes-Used":      "12",
+			QuotaBytesTag:               "12",
+		} {
+			if got := rr.Header().Get(header); got != want {
+				t.Errorf("wrong %s: got %s want %s", header, got, want)
+			}
+		}
+	})
+}
+
+// Check that the size of an upload in progress is reserved, and that deleted
+// objects free their bytes
+func TestQuotaReservation(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		s.settings.Quota = &Quota{MaxBytes: 10}
+		createContainer(t, map[string]string{"Test-Container": "test"}, s)
+
+		reservation, err := s.reserveQuota("test/a", 6)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.checkQuota("test/b", 6); !errors.Is(err, errQuotaExceeded) {
+			t.Errorf("concurrent upload wasn't refused: %v", err)
+		}
+		reservation.release()
+		if err := s.checkQuota("test/b", 6); err != nil {
+			t.Errorf("released bytes are still reserved: %v", err)
+		}
+
+		if code := storageRequest(t, s, "PUT", "/v1.0/abc/test/a", strings.NewReader("012345"), nil).Code; code != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v", code, http.StatusCreated)
+		}
+		if err := s.checkQuota("test/b", 6); !errors.Is(err, errQuotaExceeded) {
+			t.Errorf("stored object wasn't counted: %v", err)
+		}
+		if code := storageRequest(t, s, "DELETE", "/v1.0/abc/test/a", nil, nil).Code; code != http.StatusNoContent {
+			t.Fatalf("handler returned wrong status code: got %v want %v", code, http.StatusNoContent)
+		}
+		if code := storageRequest(t, s, "PUT", "/v1.0/abc/test/b", strings.NewReader("01234567"), nil).Code; code != http.StatusCreated {
+			t.Errorf("handler returned wrong status code: got %v want %v", code, http.StatusCreated)
+		}
+	})
+}
+
+func TestUserQuota(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		s.settings.Quota = &Quota{UserBytes: 8}
+		for _, c := range []struct{ container, user string }{
+			{"alice_1", "alice"},
+			{"alice_2", "alice"},
+			{"bob_1", "bob"},
+		} {
+			if _, err := s.backend.CreateContainer(c.container); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.backend.StoreMetadata(c.container, map[string]string{"UserID": c.user}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tests := []struct {
+			name string
+			path string
+			want int
+		}{
+			{"first", "/v1.0/abc/alice_1/clip.mkv", http.StatusCreated},
+			{"second recording", "/v1.0/abc/alice_2/clip.mkv", http.StatusInsufficientStorage},
+			{"other user", "/v1.0/abc/bob_1/clip.mkv", http.StatusCreated},
+		}
+		for _, test := range tests {
+			if code := storageRequest(t, s, "PUT", test.path, strings.NewReader("012345"), nil).Code; code != test.want {
+				t.Errorf("%s: handler returned wrong status code: got %v want %v", test.name, code, test.want)
+			}
+		}
+
+		// The UserID of containers is followed once the usage is counted
+		alice := map[string]string{"X-Container-Meta-Userid": "alice"}
+		if code := storageRequest(t, s, "PUT", "/v1.0/abc/recording", nil, alice).Code; code != http.StatusCreated {
+			t.Fatalf("Error expected %v but got %v when creating a container", http.StatusCreated, code)
+		}
+		if code := storageRequest(t, s, "PUT", "/v1.0/abc/recording/clip.mkv", strings.NewReader("012"), nil).Code; code != http.StatusInsufficientStorage {
+			t.Errorf("handler returned wrong status code for a new recording: got %v want %v", code, http.StatusInsufficientStorage)
+		}
+		carol := map[string]string{"X-Container-Meta-Userid": "carol"}
+		if code := storageRequest(t, s, "POST", "/v1.0/abc/recording", nil, carol).Code; code != http.StatusNoContent {
+			t.Fatalf("Error expected %v but got %v when posting to a container", http.StatusNoContent, code)
+		}
+		if code := storageRequest(t, s, "PUT", "/v1.0/abc/recording/clip.mkv", strings.NewReader("012"), nil).Code; code != http.StatusCreated {
+			t.Errorf("handler returned wrong status code for another user: got %v want %v", code, http.StatusCreated)
+		}
+	})
+}
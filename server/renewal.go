@@ -0,0 +1,263 @@
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	certCheckInterval = 12 * time.Hour
+	// Certificates are renewed this many days before they expire, unless
+	// CertificateRenewDays is set
+	defaultCertRenewDays = 30
+)
+
+// certManager serves the certificate of every https server, loaded again
+// whenever its files change, and renews the certificates issued by the
+// server before they expire.
+type certManager struct {
+	settingsPath string
+	settings     Settings
+	mu           sync.Mutex
+	certs        []*tls.Certificate
+	files        []os.FileInfo // Of the certificates when they were loaded
+}
+
+func newCertManager(settingsPath string, settings Settings) *certManager {
+	return &certManager{
+		settingsPath: settingsPath,
+		settings:     settings,
+		certs:        make([]*tls.Certificate, len(settings.IPs)),
+		files:        make([]os.FileInfo, len(settings.IPs)),
+	}
+}
+
+func (m *certManager) renewBefore() time.Duration {
+	days := m.settings.CertificateRenewDays
+	if days <= 0 {
+		days = defaultCertRenewDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// load returns the certificate of server i, loading it if its file has
+// changed since it was last loaded.
+func (m *certManager) load(i int) (*tls.Certificate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	certFile := filepath.Join(m.settingsPath, buildCertName(i))
+	fi, err := os.Stat(certFile)
+	if err == nil && m.certs[i] != nil && os.SameFile(fi, m.files[i]) && fi.ModTime().Equal(m.files[i].ModTime()) {
+		return m.certs[i], nil
+	}
+	var pair tls.Certificate
+	if err == nil {
+		pair, err = tls.LoadX509KeyPair(certFile, filepath.Join(m.settingsPath, buildKeyName(i)))
+	}
+	if err == nil {
+		pair.Leaf, err = x509.ParseCertificate(pair.Certificate[0])
+	}
+	if err != nil {
+		if m.certs[i] != nil {
+			// The key may not have been replaced yet
+			logger.Errorf("Failed to reload certificate %s, using the previous one: %v", certFile, err)
+			return m.certs[i], nil
+		}
+		return nil, err
+	}
+	if m.certs[i] != nil {
+		logger.Info("Reloaded certificate " + certFile)
+	}
+	m.certs[i], m.files[i] = &pair, fi
+	return &pair, nil
+}
+
+// getCertificate returns the tls.Config.GetCertificate of server i.
+func (m *certManager) getCertificate(i int) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return m.load(i)
+	}
+}
+
+// renewable reports whether cert was issued by the server, by the local CA ca,
+// or self-signed by an installation from before it when ca is nil.
+func renewable(cert, ca *x509.Certificate) bool {
+	if ca == nil {
+		// They aren't CAs, so CheckSignatureFrom can't verify them
+		return bytes.Equal(cert.RawIssuer, cert.RawSubject) &&
+			cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil &&
+			len(cert.Subject.Organization) == 1 && cert.Subject.Organization[0] == "Generated Co"
+	}
+	return cert.CheckSignatureFrom(ca) == nil
+}
+
+// renewCA issues the local CA again with the same key, so the certificates it
+// issued before stay valid.
+func renewCA(rootPath string, ca *x509.Certificate, key crypto.Signer) error {
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+	template := *ca
+	template.SerialNumber = serial
+	template.NotBefore = time.Now()
+	template.NotAfter = time.Now().Add(caValidity)
+	return writeCert(rootPath, caCertFilename, caKeyFilename, &template, &template, key, key)
+}
+
+// check renews the certificates expiring within the renewal period, and
+// warns about the ones it can't renew. The connection file is updated if the
+// published certificates change. Self-signed certificates are all renewed
+// together, since the renewed ones are trusted through the local CA instead.
+func (m *certManager) check(now time.Time) {
+	if m.settings.ServerCertificate != nil {
+		m.checkServerCertificate(now)
+		return
+	}
+	renewed := false
+	var ca *x509.Certificate
+	if hasLocalCA(m.settingsPath) {
+		var key crypto.Signer
+		var err error
+		ca, key, err = localCA(m.settingsPath)
+		if err != nil {
+			logger.Errorf("Failed to load local CA: %v", err)
+			return
+		}
+		if ca.NotAfter.Sub(now) < m.renewBefore() {
+			if err := renewCA(m.settingsPath, ca, key); err != nil {
+				logger.Errorf("Failed to renew local CA, it expires %s: %v", ca.NotAfter.Format(time.RFC3339), err)
+			} else {
+				logger.Info("Renewed local CA")
+				renewed = true
+			}
+		}
+	}
+	certs := make([]*x509.Certificate, len(m.settings.IPs))
+	due := make([]bool, len(m.settings.IPs))
+	renewSelfSigned := false
+	for i, ip := range m.settings.IPs {
+		cert, err := m.load(i)
+		if err != nil {
+			logger.Errorf("Failed to load certificate for %s: %v", ip, err)
+			continue
+		}
+		certs[i] = cert.Leaf
+		if cert.Leaf.NotAfter.Sub(now) >= m.renewBefore() {
+			continue
+		}
+		if !renewable(cert.Leaf, ca) {
+			logger.Warningf("Certificate for %s expires %s, replace it", ip, cert.Leaf.NotAfter.Format(time.RFC3339))
+			continue
+		}
+		due[i] = true
+		renewSelfSigned = ca == nil
+	}
+	for i, ip := range m.settings.IPs {
+		if certs[i] == nil || !(due[i] || renewSelfSigned && renewable(certs[i], nil)) {
+			continue
+		}
+		if err := generateCert(m.settingsPath, ip, endpointHosts(m.settings), buildCertName(i), buildKeyName(i)); err != nil {
+			logger.Errorf("Failed to renew certificate for %s, it expires %s: %v", ip, certs[i].NotAfter.Format(time.RFC3339), err)
+			continue
+		}
+		logger.Info("Renewed certificate for " + ip)
+		renewed = true
+		if _, err := m.load(i); err != nil {
+			logger.Errorf("Failed to load renewed certificate for %s: %v", ip, err)
+		}
+	}
+	if renewed {
+		if err := m.updatePublished(); err != nil {
+			logger.Errorf("Failed to update the connection file: %v", err)
+		}
+	}
+}
+
+// checkServerCertificate installs the server certificate again when its files
+// change, or orders a new one from the ACME server before it expires.
+func (m *certManager) checkServerCertificate(now time.Time) {
+	c := m.settings.ServerCertificate
+	due := serverCertificateChanged(m.settingsPath, c)
+	if !due {
+		cert, err := m.load(0)
+		if err != nil {
+			logger.Errorf("Failed to load server certificate: %v", err)
+			return
+		}
+		if expires := cert.Leaf.NotAfter; expires.Sub(now) < m.renewBefore() {
+			if c.ACME == nil {
+				logger.Warningf("Server certificate expires %s, replace it", expires.Format(time.RFC3339))
+				return
+			}
+			due = true
+		}
+	}
+	if !due {
+		return
+	}
+	if err := updateServerCertificate(m.settingsPath, m.settings); err != nil {
+		logger.Errorf("Failed to update server certificate: %v", err)
+		return
+	}
+	logger.Info("Updated server certificate")
+	for i, ip := range m.settings.IPs {
+		if _, err := m.load(i); err != nil {
+			logger.Errorf("Failed to load server certificate for %s: %v", ip, err)
+		}
+	}
+	if err := m.updatePublished(); err != nil {
+		logger.Errorf("Failed to update the connection file: %v", err)
+	}
+}
+
+// updatePublished updates the certificates in the connection file of every
+// account, and warns if they have changed, since the system controller needs
+// the new ones.
+func (m *certManager) updatePublished() error {
+	certs, err := publishedCertificates(m.settingsPath, m.settings)
+	if err != nil {
+		return err
+	}
+	changed := false
+	updated, err := updateConnectionFiles(m.settings, func(conf *Config) {
+		if len(conf.HTTPSCertificate) != len(certs) {
+			changed = true
+		}
+		for i := 0; !changed && i < len(certs); i++ {
+			changed = conf.HTTPSCertificate[i] != certs[i]
+		}
+		conf.HTTPSCertificate = certs
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return errors.New("no connection file in the storage location")
+	}
+	if err == nil && changed {
+		logger.Warning("The published certificate has changed, upload " +
+			strings.Join(updated, ", ") + " to the system controller again")
+	}
+	return err
+}
+
+// runCertificateMonitor checks the certificates until exit is closed. They
+// are checked once before it starts.
+func (m *certManager) runCertificateMonitor(exit chan struct{}) {
+	ticker := time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.check(time.Now())
+		case <-exit:
+			return
+		}
+	}
+}
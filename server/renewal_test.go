@@ -0,0 +1,230 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newCertManagerTest(t *testing.T) *certManager {
+	configPath, storage := t.TempDir(), t.TempDir()
+	ips := generateCerts(configPath, []string{"127.0.0.1"}, nil)
+	if len(ips) != 1 {
+		t.Fatalf("certificates generated for %v", ips)
+	}
+	settings := Settings{
+		StorageLocation: storage, IPs: ips, Port: "8080", UseHttps: true, Username: "test:tester",
+		Accounts: []Account{{Name: "agency", Username: "agency:tester", StorageLocation: t.TempDir()}},
+	}
+	for _, location := range []string{storage, settings.Accounts[0].StorageLocation} {
+		connection := settings
+		connection.StorageLocation = location
+		if err := generateConnectionFile(configPath, "test", connection); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return newCertManager(configPath, settings)
+}
+
+func readConnectionFile(t *testing.T, storage string) Config {
+	conf := Config{}
+	data, err := os.ReadFile(filepath.Join(storage, connectionFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		t.Fatal(err)
+	}
+	return conf
+}
+
+func loadLeaf(t *testing.T, m *certManager) *x509.Certificate {
+	cert, err := m.load(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Leaf
+}
+
+// Check that certificates are renewed within the renewal period, and the
+// connection file only changes when the local CA is renewed
+func TestCertificateRenewal(t *testing.T) {
+	m := newCertManagerTest(t)
+	published := readConnectionFile(t, m.settings.StorageLocation).HTTPSCertificate
+	leaf := loadLeaf(t, m)
+
+	m.check(time.Now())
+	if loadLeaf(t, m).SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+		t.Fatal("certificate renewed long before it expires")
+	}
+
+	m.check(leaf.NotAfter.Add(-24 * time.Hour))
+	renewed := loadLeaf(t, m)
+	if renewed.SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+		t.Fatal("certificate not renewed before it expires")
+	}
+	ca, _, err := localCA(m.settingsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := renewed.CheckSignatureFrom(ca); err != nil {
+		t.Errorf("renewed certificate not issued by the local CA: %v", err)
+	}
+	conf := readConnectionFile(t, m.settings.StorageLocation)
+	if len(conf.HTTPSCertificate) != 1 || conf.HTTPSCertificate[0] != published[0] {
+		t.Error("connection file changed without renewing the local CA")
+	}
+
+	m.check(ca.NotAfter.Add(-24 * time.Hour))
+	renewedCA, _, err := localCA(m.settingsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewedCA.SerialNumber.Cmp(ca.SerialNumber) == 0 {
+		t.Fatal("local CA not renewed before it expires")
+	}
+	if err := renewed.CheckSignatureFrom(renewedCA); err != nil {
+		t.Errorf("certificate issued before renewing the local CA not valid: %v", err)
+	}
+	conf = readConnectionFile(t, m.settings.StorageLocation)
+	if len(conf.HTTPSCertificate) != 1 || conf.HTTPSCertificate[0] == published[0] {
+		t.Error("renewed local CA not published in the connection file")
+	}
+	agencyConf := readConnectionFile(t, m.settings.Accounts[0].StorageLocation)
+	if len(agencyConf.HTTPSCertificate) != 1 || agencyConf.HTTPSCertificate[0] != conf.HTTPSCertificate[0] {
+		t.Error("renewed local CA not published in the connection file of the account")
+	}
+	if conf.BlobAPIUserName != "test:tester" {
+		t.Errorf("connection file lost its user name: got %q", conf.BlobAPIUserName)
+	}
+}
+
+// Check that certificates not issued by the server are left alone
+func TestCertificateNotRenewable(t *testing.T) {
+	m := newCertManagerTest(t)
+	other, otherKey, err := loadOrCreateCA(m.settingsPath, "other.crt", "other.key", "Other CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	if err := writeCert(m.settingsPath, buildCertName(0), buildKeyName(0), &template, other, priv, otherKey); err != nil {
+		t.Fatal(err)
+	}
+
+	m.check(time.Now())
+	if loadLeaf(t, m).SerialNumber.Cmp(serial) != 0 {
+		t.Error("certificate not issued by the server renewed")
+	}
+}
+
+// Check that a replaced certificate is served without restarting the server
+func TestCertificateReload(t *testing.T) {
+	m := newCertManagerTest(t)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{GetCertificate: m.getCertificate(0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	served := func() *x509.Certificate {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0]
+	}
+
+	first := served()
+	if err := generateCert(m.settingsPath, "127.0.0.1", nil, buildCertName(0), buildKeyName(0)); err != nil {
+		t.Fatal(err)
+	}
+	second := served()
+	if first.SerialNumber.Cmp(second.SerialNumber) == 0 {
+		t.Error("replaced certificate not served")
+	}
+}
+
+// Check that self-signed certificates of installations from before the local
+// CA are renewed together, and the local CA replaces them in the connection
+// file
+func TestSelfSignedCertificateRenewal(t *testing.T) {
+	configPath, storage := t.TempDir(), t.TempDir()
+	ips := []string{"127.0.0.1", "127.0.0.2"}
+	for i, ip := range ips {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serial, err := randomSerial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := x509.Certificate{
+			SerialNumber: serial,
+			Subject:      pkix.Name{Organization: []string{"Generated Co"}, CommonName: ip},
+			NotBefore:    time.Now(),
+			// Only the first is due for renewal
+			NotAfter: time.Now().Add(time.Duration(i+1) * 90 * 24 * time.Hour),
+		}
+		if err := writeCert(configPath, buildCertName(i), buildKeyName(i), &template, &template, priv, priv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	settings := Settings{StorageLocation: storage, IPs: ips, Port: "8080", UseHttps: true, Username: "test:tester"}
+	if err := generateConnectionFile(configPath, "test", settings); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(readConnectionFile(t, storage).HTTPSCertificate); n != 2 {
+		t.Fatalf("wrong number of certificates in connection file: got %d want 2", n)
+	}
+	m := newCertManager(configPath, settings)
+
+	m.check(time.Now().Add(80 * 24 * time.Hour))
+	ca, _, err := loadCert(configPath, caCertFilename, caKeyFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, ip := range ips {
+		cert, err := m.load(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cert.Leaf.CheckSignatureFrom(ca); err != nil {
+			t.Errorf("certificate for %s not issued by the local CA: %v", ip, err)
+		}
+	}
+	if n := len(readConnectionFile(t, storage).HTTPSCertificate); n != 1 {
+		t.Errorf("wrong number of certificates in connection file: got %d want 1", n)
+	}
+}
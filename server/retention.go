@@ -0,0 +1,552 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ncw/swift/v2"
+)
+
+// RootLegalHoldEndpoint is where legal holds are placed on, and released from,
+// recording containers.
+const RootLegalHoldEndpoint = "/legalhold/v1.0"
+
+// Container metadata keys describing a legal hold. A recording is never
+// deleted while legalHoldKey is set to true.
+const (
+	legalHoldKey       = "LegalHold"
+	legalHoldReasonKey = "LegalHoldReason"
+	legalHoldTimeKey   = "LegalHoldTime"
+)
+
+// retentionKeys are the container metadata keys the expiry of a recording
+// depends on, and categoryKey the one of its bookmarks.
+var retentionKeys = []string{"Status", "StopTime", "TriggerOnTime", "UserID", "TriggerOn"}
+
+const categoryKey = "CategoryID"
+
+const defaultSweepMinutes = 60
+
+// errRetained is returned when a recording may not be deleted yet.
+var errRetained = errors.New("recording is retained")
+
+// RetentionPolicy decides how long complete recordings are kept before they
+// are purged. Recordings are matched on the UserID and TriggerOn of their
+// container metadata, and on the CategoryID of their bookmarks, which refers
+// to an Id in Categories.json. The longest matching period applies, and
+// DefaultDays applies when nothing matches. A period of zero days keeps the
+// recording forever. Expired recordings are purged, unless KeepExpired is set
+// and they are only protected from deletion until they expire.
+type RetentionPolicy struct {
+	DefaultDays  int
+	UserDays     map[string]int `json:",omitempty"`
+	TriggerDays  map[string]int `json:",omitempty"`
+	CategoryDays map[string]int `json:",omitempty"`
+	SweepMinutes int            `json:",omitempty"`
+	KeepExpired  bool           `json:",omitempty"`
+}
+
+// metaValue returns the value of key in meta. Keys are compared case
+// insensitively since metadata sent as headers gets its keys canonicalized,
+// "StopTime" is received as "Stoptime".
+func metaValue(meta map[string]string, key string) string {
+	if v, ok := meta[key]; ok {
+		return v
+	}
+	for k, v := range meta {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return ""
+}
+
+// deleteMetaKeys removes keys from meta, compared case insensitively.
+func deleteMetaKeys(meta map[string]string, keys ...string) {
+	for k := range meta {
+		for _, key := range keys {
+			if strings.EqualFold(k, key) {
+				delete(meta, k)
+			}
+		}
+	}
+}
+
+// recordingTime returns when the recording described by meta stopped, or when
+// it was triggered if the stop time is unknown.
+func recordingTime(meta map[string]string) (time.Time, bool) {
+	for _, key := range []string{"StopTime", "TriggerOnTime"} {
+		if epoch, err := strconv.ParseInt(metaValue(meta, key), 10, 64); err == nil {
+			return time.Unix(epoch, 0), true
+		}
+	}
+	return time.Time{}, false
+}
+
+func isLegalHold(meta map[string]string) bool {
+	hold, _ := strconv.ParseBool(metaValue(meta, legalHoldKey))
+	return hold
+}
+
+// isRecording reports whether container holds a recording rather than
+// system, user or device metadata.
+func isRecording(container string) bool {
+	switch container {
+	case "System", "Users", "Devices":
+		return false
+	}
+	return true
+}
+
+// categories returns the CategoryID of every bookmark in container.
+func (s *Server) categories(container string) ([]string, error) {
+	objects, err := s.backend.List(container)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, o := range objects {
+		if !strings.HasPrefix(o.Name, "bookmark_") {
+			continue
+		}
+		meta, err := s.backend.LoadMetadata(container + "/" + o.Name)
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+		if id := metaValue(meta, categoryKey); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// expiry returns when the complete recording in container, described by meta,
+// expires according to the retention policy. The zero time is returned if the
+// recording is kept forever.
+func (s *Server) expiry(container string, meta map[string]string) (time.Time, error) {
+	policy := s.settings.Retention
+	if policy == nil || metaValue(meta, "Status") != "Complete" {
+		return time.Time{}, nil
+	}
+	recorded, ok := recordingTime(meta)
+	if !ok {
+		return time.Time{}, nil
+	}
+
+	periods := []int{}
+	if days, ok := policy.UserDays[metaValue(meta, "UserID")]; ok {
+		periods = append(periods, days)
+	}
+	if days, ok := policy.TriggerDays[metaValue(meta, "TriggerOn")]; ok {
+		periods = append(periods, days)
+	}
+	if len(policy.CategoryDays) > 0 {
+		ids, err := s.categories(container)
+		if err != nil {
+			return time.Time{}, err
+		}
+		for _, id := range ids {
+			if days, ok := policy.CategoryDays[id]; ok {
+				periods = append(periods, days)
+			}
+		}
+	}
+	if len(periods) == 0 {
+		periods = append(periods, policy.DefaultDays)
+	}
+
+	longest := 0
+	for _, days := range periods {
+		if days <= 0 {
+			return time.Time{}, nil
+		}
+		if days > longest {
+			longest = days
+		}
+	}
+	return recorded.AddDate(0, 0, longest), nil
+}
+
+// checkRetention returns an error wrapping errRetained if the recording in
+// container, or any object in it, may not be deleted. Complete recordings are
+// kept until they expire according to the retention policy, and for as long
+// as they are under legal hold.
+func (s *Server) checkRetention(container string) error {
+	meta, err := s.backend.LoadMetadata(container)
+	if isNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if isLegalHold(meta) {
+		return fmt.Errorf("%w: %s is under legal hold", errRetained, container)
+	}
+	if metaValue(meta, "Status") != "Complete" || s.settings.Retention == nil {
+		return nil
+	}
+	if _, ok := recordingTime(meta); !ok {
+		return fmt.Errorf("%w: %s has no recording time", errRetained, container)
+	}
+	expires, err := s.expiry(container, meta)
+	if err != nil {
+		return err
+	}
+	if expires.IsZero() {
+		return fmt.Errorf("%w: %s is kept forever", errRetained, container)
+	}
+	if time.Now().Before(expires) {
+		return fmt.Errorf("%w: %s is retained until %s", errRetained, container, expires.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// retentionError answers a request refused by checkRetention, 403 for a
+// retained recording.
+func retentionError(w http.ResponseWriter, err error) {
+	logger.Error(err)
+	if errors.Is(err, errRetained) {
+		e := swift.Forbidden
+		http.Error(w, e.Text, e.StatusCode)
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+// keepRetentionKeys drops changes to the keys the expiry of a complete
+// recording depends on from newMeta, the metadata replacing or updating
+// oldMeta of target. Otherwise a recording could be made to expire early.
+func (s *Server) keepRetentionKeys(target string, oldMeta, newMeta map[string]string) {
+	container, object := splitTarget(target)
+	if object == "" {
+		if metaValue(oldMeta, "Status") == "Complete" {
+			deleteMetaKeys(newMeta, retentionKeys...)
+		}
+		return
+	}
+	meta, err := s.backend.LoadMetadata(container)
+	if err != nil || metaValue(meta, "Status") != "Complete" {
+		return
+	}
+	deleteMetaKeys(newMeta, categoryKey)
+	for k, v := range oldMeta {
+		if strings.EqualFold(k, categoryKey) {
+			newMeta[k] = v
+		}
+	}
+}
+
+// recordRetention records an action taken on a recording by the retention
+// policy or by user through the legal hold API, in the log and in the audit
+// log.
+func (s *Server) recordRetention(action, container, user, remote, detail string) {
+	logger.Infof("Retention: %s %s %s %s %s", action, container, user, remote, detail)
+	s.audit(AuditEntry{Action: action, Target: container, User: user, Remote: remote, Detail: detail})
+}
+
+// sweep purges every complete recording that has expired and isn't under
+// legal hold. It returns the number of purged recordings.
+func (s *Server) sweep() int {
+	containers, err := s.backend.List("")
+	if err != nil {
+		logger.Error(err)
+		return 0
+	}
+	purged := 0
+	for _, c := range containers {
+		if !isRecording(c.Name) {
+			continue
+		}
+		meta, err := s.backend.LoadMetadata(c.Name)
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+		if isLegalHold(meta) {
+			continue
+		}
+		expires, err := s.expiry(c.Name, meta)
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+		if expires.IsZero() || time.Now().Before(expires) {
+			continue
+		}
+		if err := s.purge(c.Name); err != nil {
+			logger.Error(err)
+			continue
+		}
+		s.recordRetention("purged", c.Name, "", "", "expired "+expires.UTC().Format(time.RFC3339))
+		purged++
+	}
+	return purged
+}
+
+// purge deletes every object in container and then the container itself.
+func (s *Server) purge(container string) error {
+	objects, err := s.backend.List(container)
+	if err != nil {
+		return err
+	}
+	for _, o := range objects {
+		if err := s.deleteTarget(container + "/" + o.Name); err != nil {
+			return err
+		}
+	}
+	return s.deleteTarget(container)
+}
+
+// runSweeper purges expired recordings every Retention.SweepMinutes until
+// exit is closed.
+func (s *Server) runSweeper(exit chan struct{}) {
+	minutes := s.settings.Retention.SweepMinutes
+	if minutes <= 0 {
+		minutes = defaultSweepMinutes
+	}
+	s.checkCategories()
+	ticker := time.NewTicker(time.Duration(minutes) * time.Minute)
+	defer ticker.Stop()
+	for {
+		if n := s.sweep(); n > 0 {
+			logger.Infof("Retention: purged %d expired recordings", n)
+		}
+		select {
+		case <-ticker.C:
+		case <-exit:
+			return
+		}
+	}
+}
+
+// checkCategories warns about retention periods for categories that aren't
+// listed in Categories.json.
+func (s *Server) checkCategories() {
+	if len(s.settings.Retention.CategoryDays) == 0 {
+		return
+	}
+	data, err := s.readObject("System/Categories.json")
+	if err != nil {
+		logger.Warning("Retention: failed to read categories: ", err)
+		return
+	}
+	var categories []struct{ Id string }
+	if err := json.Unmarshal(data, &categories); err != nil {
+		logger.Warning("Retention: failed to parse categories: ", err)
+		return
+	}
+	known := map[string]bool{}
+	for _, c := range categories {
+		known[c.Id] = true
+	}
+	for id := range s.settings.Retention.CategoryDays {
+		if !known[id] {
+			logger.Warningf("Retention: category %s isn't listed in Categories.json", id)
+		}
+	}
+}
+
+// legalHoldStatus is returned by GET on the legal hold endpoint.
+type legalHoldStatus struct {
+	Container string
+	LegalHold bool
+	Reason    string `json:",omitempty"`
+	Since     string `json:",omitempty"`
+	Expires   string `json:",omitempty"`
+}
+
+// LegalHoldAdmin is the only user allowed to release legal holds. The system
+// controllers place holds with their tokens, but can't release them and then
+// delete the recordings.
+type LegalHoldAdmin struct {
+	Username string
+	Password []byte
+}
+
+// legalHoldHandler places a legal hold on a recording with PUT, releases it
+// with DELETE and returns its retention status with GET. The reason for a
+// hold is given in the X-Legal-Hold-Reason header.
+func (s *Server) legalHoldHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		s.releaseLegalHold(w, r)
+		return
+	}
+	srv, err := s.tokenServer(r)
+	if err != nil {
+		logger.Errorf("Token verification error: %v", err)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	srv.handleLegalHold(w, r, srv.settings.Username)
+}
+
+// releaseLegalHold authenticates a release with the credentials of the legal
+// hold admin, given in the same headers as to the authentication endpoint,
+// and releases the hold on the recording of the account in the account query
+// parameter, the default account unless given. Tokens aren't accepted.
+func (s *Server) releaseLegalHold(w http.ResponseWriter, r *http.Request) {
+	admin := s.settings.LegalHoldAdmin
+	if admin == nil {
+		logger.Error("Legal hold release refused, no LegalHoldAdmin is set")
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	username, password := r.Header.Get(UserNameTag), r.Header.Get(PasswordTag)
+	ip := remoteIP(r)
+	if s.guard != nil {
+		if wait := s.guard.lockedOut(ip, username); wait > 0 {
+			err := errLockedOut{retryAfter: wait}
+			logger.Errorf("Legal hold release by %s from %s refused: %v", username, ip, err)
+			loginError(w, err)
+			return
+		}
+	}
+	if err := auth(username, password, admin.Username, admin.Password); err != nil {
+		logger.Errorf("Legal hold release: %v", err)
+		s.authenticationFailed(r, username, "legal hold admin")
+		loginError(w, err)
+		return
+	}
+	if s.guard != nil {
+		s.guard.succeed(ip, username)
+	}
+	account := r.URL.Query().Get("account")
+	if account == "" {
+		account = defaultAccount
+	}
+	srv := s.accountServer(account)
+	if srv == nil {
+		logger.Error("Legal hold release for unknown account " + account)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	srv.handleLegalHold(w, r, username)
+}
+
+// handleLegalHold serves a legal hold request by user for a recording of the
+// account of s.
+func (s *Server) handleLegalHold(w http.ResponseWriter, r *http.Request, user string) {
+	if err := checkClientAccount(r, s); err != nil {
+		logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	container := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, RootLegalHoldEndpoint), "/")
+	if !validTarget(container) || strings.Contains(container, "/") || !isRecording(container) {
+		logger.Error("Invalid recording for legal hold: " + container)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	meta, err := s.backend.LoadMetadata(container)
+	if err != nil {
+		logger.Error(err)
+		if isNotExist(err) {
+			e := swift.ContainerNotFound
+			http.Error(w, e.Text, e.StatusCode)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		status := legalHoldStatus{
+			Container: container,
+			LegalHold: isLegalHold(meta),
+			Reason:    metaValue(meta, legalHoldReasonKey),
+			Since:     metaValue(meta, legalHoldTimeKey),
+		}
+		expires, err := s.expiry(container, meta)
+		if err != nil {
+			logger.Error(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if !expires.IsZero() {
+			status.Expires = expires.UTC().Format(time.RFC3339)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+		return
+
+	case http.MethodPut:
+		reason := r.Header.Get("X-Legal-Hold-Reason")
+		deleteMetaKeys(meta, legalHoldKey, legalHoldReasonKey, legalHoldTimeKey)
+		meta[legalHoldKey] = "true"
+		meta[legalHoldTimeKey] = time.Now().UTC().Format(time.RFC3339)
+		if reason != "" {
+			meta[legalHoldReasonKey] = reason
+		}
+		if err := s.backend.StoreMetadata(container, meta); err != nil {
+			logger.Error(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		s.recordRetention("legal-hold-placed", container, user, r.RemoteAddr, reason)
+
+	case http.MethodDelete:
+		if !isLegalHold(meta) {
+			http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+			return
+		}
+		deleteMetaKeys(meta, legalHoldKey, legalHoldReasonKey, legalHoldTimeKey)
+		if err := s.backend.StoreMetadata(container, meta); err != nil {
+			logger.Error(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		s.recordRetention("legal-hold-released", container, user, r.RemoteAddr, "")
+
+	default:
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetLegalHoldAdmin asks for the user allowed to release legal holds and
+// stores it in the settings in configPath. The service must be restarted to
+// use it.
+func SetLegalHoldAdmin(configPath string) error {
+	settingsFile := filepath.Join(configPath, settingsFilename)
+	data, err := os.ReadFile(settingsFile)
+	if err != nil {
+		return err
+	}
+	settings := Settings{}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	username := ask(scanner, "Enter the user name of the legal hold admin >")
+	if username == "" {
+		return errors.New("the user name can not be empty")
+	}
+	// The system controllers must not be able to release holds
+	if username == settings.Username {
+		return fmt.Errorf("%s is the user of the system controller", username)
+	}
+	for _, a := range settings.Accounts {
+		if username == a.Username {
+			return fmt.Errorf("%s is the user of account %s", username, a.Name)
+		}
+	}
+	_, hash := selectPassword()
+	settings.LegalHoldAdmin = &LegalHoldAdmin{Username: username, Password: hash}
+	confJson, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(settingsFile, bytes.NewReader(confJson))
+}
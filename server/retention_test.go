@@ -0,0 +1,351 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestDeleteObject(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		createContainer(t, map[string]string{"Test-Container": "test"}, s)
+		createDownloadObject(t, s, "dir/sub/clip.mkv", "clip")
+		if code := postToObject("dir/sub/clip.mkv", map[string]string{"Test": "deleteData"}, t, s); code != http.StatusAccepted {
+			t.Fatalf("Error expected %v but got %v when posting metadata", http.StatusAccepted, code)
+		}
+
+		rr := storageRequest(t, s, "DELETE", "/v1.0/abc/test/dir/sub/clip.mkv", nil, nil)
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNoContent)
+		}
+		if _, err := s.backend.Stat("test/dir/sub/clip.mkv"); !isNotExist(err) {
+			t.Errorf("object still exists after delete: %v", err)
+		}
+		if _, err := s.backend.LoadMetadata("test/dir/sub/clip.mkv"); !isNotExist(err) {
+			t.Errorf("object metadata still exists after delete: %v", err)
+		}
+
+		rr = storageRequest(t, s, "DELETE", "/v1.0/abc/test/dir/sub/clip.mkv", nil, nil)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("handler returned wrong status code for a missing object: got %v want %v", rr.Code, http.StatusNotFound)
+		}
+	})
+}
+
+func TestDeleteContainer(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		createContainer(t, map[string]string{"Test-Container": "test"}, s)
+		createDownloadObject(t, s, "clip.mkv", "clip")
+
+		rr := storageRequest(t, s, "DELETE", "/v1.0/abc/test", nil, nil)
+		if rr.Code != http.StatusConflict {
+			t.Errorf("handler returned wrong status code for a container that isn't empty: got %v want %v", rr.Code, http.StatusConflict)
+		}
+
+		storageRequest(t, s, "DELETE", "/v1.0/abc/test/clip.mkv", nil, nil)
+		rr = storageRequest(t, s, "DELETE", "/v1.0/abc/test", nil, nil)
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNoContent)
+		}
+		if _, err := s.backend.Stat("test"); !isNotExist(err) {
+			t.Errorf("container still exists after delete: %v", err)
+		}
+
+		rr = storageRequest(t, s, "DELETE", "/v1.0/abc/test", nil, nil)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("handler returned wrong status code for a missing container: got %v want %v", rr.Code, http.StatusNotFound)
+		}
+	})
+}
+
+// Check that complete recordings are only deleted after the retention period
+// and never while under legal hold
+func TestDeleteRetention(t *testing.T) {
+	day := 24 * time.Hour
+	tests := []struct {
+		name      string
+		retention int
+		meta      map[string]string
+		code      int
+	}{
+		{"transferring", 30, map[string]string{"Status": "Transferring", "StopTime": epoch(time.Now())}, http.StatusNoContent},
+		{"retained", 30, map[string]string{"Status": "Complete", "StopTime": epoch(time.Now().Add(-29 * day))}, http.StatusForbidden},
+		{"expired", 30, map[string]string{"Status": "Complete", "StopTime": epoch(time.Now().Add(-31 * day))}, http.StatusNoContent},
+		{"trigger time", 30, map[string]string{"Status": "Complete", "TriggerOnTime": epoch(time.Now().Add(-31 * day))}, http.StatusNoContent},
+		{"unknown age", 30, map[string]string{"Status": "Complete"}, http.StatusForbidden},
+		{"no retention", 0, map[string]string{"Status": "Complete", "StopTime": epoch(time.Now())}, http.StatusNoContent},
+		{"legal hold", 0, map[string]string{"Status": "Transferring", legalHoldKey: "true"}, http.StatusForbidden},
+		{"released hold", 0, map[string]string{"Status": "Complete", legalHoldKey: "false"}, http.StatusNoContent},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, s *Server) {
+				if test.retention > 0 {
+					s.settings.Retention = &RetentionPolicy{DefaultDays: test.retention, KeepExpired: true}
+				}
+				createContainer(t, nil, s)
+				createDownloadObject(t, s, "clip.mkv", "clip")
+				if err := s.backend.StoreMetadata("test", test.meta); err != nil {
+					t.Fatal(err)
+				}
+
+				rr := storageRequest(t, s, "DELETE", "/v1.0/abc/test/clip.mkv", nil, nil)
+				if rr.Code != test.code {
+					t.Errorf("handler returned wrong status code for an object: got %v want %v", rr.Code, test.code)
+				}
+				if test.code == http.StatusNoContent {
+					return
+				}
+				// The container is guarded too, even when empty
+				s.backend.Delete("test/clip.mkv")
+				rr = storageRequest(t, s, "DELETE", "/v1.0/abc/test", nil, nil)
+				if rr.Code != test.code {
+					t.Errorf("handler returned wrong status code for the container: got %v want %v", rr.Code, test.code)
+				}
+			})
+		})
+	}
+}
+
+func epoch(t time.Time) string {
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+// createPolicyRecording creates a complete recording in container that stopped
+// daysAgo with a bookmark in each category.
+func createPolicyRecording(t *testing.T, s *Server, container string, daysAgo int, meta map[string]string, categories ...string) {
+	if _, err := s.backend.CreateContainer(container); err != nil {
+		t.Fatal(err)
+	}
+	meta["Status"] = "Complete"
+	meta["StopTime"] = epoch(time.Now().AddDate(0, 0, -daysAgo))
+	if err := s.backend.StoreMetadata(container, meta); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.backend.PutObject(container+"/clip.mkv", strings.NewReader("clip"), ""); err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range categories {
+		bookmark := container + "/bookmark_" + strconv.Itoa(i)
+		if err := s.backend.PutObject(bookmark, http.NoBody, ""); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.backend.StoreMetadata(bookmark, map[string]string{categoryKey: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRetentionPolicy(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		s.settings.Retention = &RetentionPolicy{
+			DefaultDays:  30,
+			UserDays:     map[string]int{"keeper": 0},
+			TriggerDays:  map[string]int{"Button": 60},
+			CategoryDays: map[string]int{"4": 3650},
+		}
+		createPolicyRecording(t, s, "default", 31, map[string]string{"UserID": "user"})
+		createPolicyRecording(t, s, "recent", 29, map[string]string{"UserID": "user"})
+		createPolicyRecording(t, s, "trigger", 31, map[string]string{"TriggerOn": "Button"})
+		createPolicyRecording(t, s, "category", 100, map[string]string{"UserID": "user"}, "1", "4")
+		createPolicyRecording(t, s, "forever", 100, map[string]string{"UserID": "keeper", "TriggerOn": "Button"})
+		createPolicyRecording(t, s, "held", 100, map[string]string{"UserID": "user", legalHoldKey: "true"})
+		createPolicyRecording(t, s, "expired", 100, map[string]string{"TriggerOn": "Button"}, "1")
+		// Canonicalized keys as received from the BWS
+		createPolicyRecording(t, s, "canonical", 100, map[string]string{"Userid": "user"})
+
+		if n := s.sweep(); n != 3 {
+			t.Errorf("wrong number of purged recordings: got %d want 3", n)
+		}
+		for container, kept := range map[string]bool{
+			"default":   false,
+			"recent":    true,
+			"trigger":   true,
+			"category":  true,
+			"forever":   true,
+			"held":      true,
+			"expired":   false,
+			"canonical": false,
+		} {
+			_, err := s.backend.Stat(container)
+			if kept && err != nil {
+				t.Errorf("%s was purged: %v", container, err)
+			}
+			if !kept && !isNotExist(err) {
+				t.Errorf("%s wasn't purged: %v", container, err)
+			}
+		}
+
+		// Manual deletion honors the policy as well
+		rr := storageRequest(t, s, "DELETE", "/v1.0/abc/trigger/clip.mkv", nil, nil)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+		}
+	})
+}
+
+// Check that the metadata the expiry depends on can't be changed once a
+// recording is complete
+func TestRetentionKeys(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		s.settings.Retention = &RetentionPolicy{DefaultDays: 30, UserDays: map[string]int{"user": 60}, CategoryDays: map[string]int{"4": 3650}}
+		createPolicyRecording(t, s, "recording", 40, map[string]string{"UserID": "user", "TriggerOnTime": epoch(time.Now())}, "4")
+
+		code := storageRequest(t, s, "POST", "/v1.0/abc/recording", nil, map[string]string{
+			"X-Container-Meta-Status":        "Transferring",
+			"X-Container-Meta-Stoptime":      epoch(time.Now().AddDate(-1, 0, 0)),
+			"X-Container-Meta-Triggerontime": "",
+			"X-Container-Meta-Userid":        "other",
+			"X-Container-Meta-Test":          "changed",
+		}).Code
+		if code != http.StatusNoContent {
+			t.Errorf("Error expected %v but got %v when posting to a container", http.StatusNoContent, code)
+		}
+		code = storageRequest(t, s, "POST", "/v1.0/abc/recording/bookmark_0", nil, map[string]string{"X-Object-Meta-Test": "changed"}).Code
+		if code != http.StatusAccepted {
+			t.Errorf("Error expected %v but got %v when posting to a bookmark", http.StatusAccepted, code)
+		}
+		meta, err := s.backend.LoadMetadata("recording")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if metaValue(meta, "Status") != "Complete" || metaValue(meta, "UserID") != "user" || metaValue(meta, "TriggerOnTime") == "" || metaValue(meta, "Test") != "changed" {
+			t.Errorf("wrong recording metadata: %v", meta)
+		}
+		if meta, err := s.backend.LoadMetadata("recording/bookmark_0"); err != nil || metaValue(meta, categoryKey) != "4" || metaValue(meta, "Test") != "changed" {
+			t.Errorf("wrong bookmark metadata: %v %v", meta, err)
+		}
+		if rr := storageRequest(t, s, "DELETE", "/v1.0/abc/recording/clip.mkv", nil, nil); rr.Code != http.StatusForbidden {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+		}
+
+		// Objects of a retained recording can't be replaced or added
+		bookmark := map[string]string{"X-Object-Meta-Categoryid": "1"}
+		for _, object := range []string{"bookmark_0", "clip.mkv", "new.mkv"} {
+			rr := storageRequest(t, s, "PUT", "/v1.0/abc/recording/"+object, strings.NewReader("new"), bookmark)
+			if rr.Code != http.StatusForbidden {
+				t.Errorf("handler returned wrong status code for PUT of %s: got %v want %v", object, rr.Code, http.StatusForbidden)
+			}
+		}
+		if data, err := s.readObject("recording/clip.mkv"); err != nil || string(data) != "clip" {
+			t.Errorf("retained clip was replaced: %q %v", data, err)
+		}
+
+		// Without a retention policy a bookmark can be replaced, but not its
+		// category
+		s.settings.Retention = nil
+		rr := storageRequest(t, s, "PUT", "/v1.0/abc/recording/bookmark_0", http.NoBody, bookmark)
+		if rr.Code != http.StatusCreated {
+			t.Errorf("handler returned wrong status code for PUT of a bookmark: got %v want %v", rr.Code, http.StatusCreated)
+		}
+		if meta, err := s.backend.LoadMetadata("recording/bookmark_0"); err != nil || metaValue(meta, categoryKey) != "4" {
+			t.Errorf("bookmark category changed by PUT: %v %v", meta, err)
+		}
+	})
+}
+
+func TestLegalHold(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		s.settings.Retention = &RetentionPolicy{DefaultDays: 1}
+		createPolicyRecording(t, s, "recording", 2, map[string]string{"UserID": "user"})
+
+		rr := storageRequest(t, s, "PUT", RootLegalHoldEndpoint+"/recording", nil, map[string]string{"X-Legal-Hold-Reason": "Case 42"})
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNoContent)
+		}
+		rr = storageRequest(t, s, "GET", RootLegalHoldEndpoint+"/recording", nil, nil)
+		var status legalHoldStatus
+		if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		if !status.LegalHold || status.Reason != "Case 42" || status.Since == "" || status.Expires == "" {
+			t.Errorf("wrong legal hold status: %+v", status)
+		}
+
+		// Neither the BWS nor the sweeper can remove a held recording
+		if code := storageRequest(t, s, "POST", "/v1.0/abc/recording", nil, map[string]string{"X-Container-Meta-" + legalHoldKey: "false"}).Code; code != http.StatusNoContent {
+			t.Errorf("Error expected %v but got %v when posting to a container", http.StatusNoContent, code)
+		}
+		if n := s.sweep(); n != 0 {
+			t.Errorf("held recording was purged")
+		}
+		rr = storageRequest(t, s, "DELETE", "/v1.0/abc/recording/clip.mkv", nil, nil)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusForbidden)
+		}
+		manifest := `[{"path": "/recording/clip.mkv"}]`
+		for _, put := range []struct {
+			name   string
+			path   string
+			body   string
+			header map[string]string
+		}{
+			{"PUT", "/v1.0/abc/recording/clip.mkv", "replaced", nil},
+			{"resumable PUT", "/v1.0/abc/recording/clip.mkv", "replaced", map[string]string{UploadLengthTag: "8"}},
+			{"manifest PUT", "/v1.0/abc/recording/clip.mkv?multipart-manifest=put", manifest, nil},
+		} {
+			rr = storageRequest(t, s, "PUT", put.path, strings.NewReader(put.body), put.header)
+			if rr.Code != http.StatusForbidden {
+				t.Errorf("handler returned wrong status code for %s: got %v want %v", put.name, rr.Code, http.StatusForbidden)
+			}
+		}
+		if data, err := s.readObject("recording/clip.mkv"); err != nil || string(data) != "clip" {
+			t.Errorf("held clip was replaced: %q %v", data, err)
+		}
+
+		// Only the legal hold admin releases holds, the token isn't enough
+		rr = storageRequest(t, s, "DELETE", RootLegalHoldEndpoint+"/recording", nil, nil)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("handler returned wrong status code without admin: got %v want %v", rr.Code, http.StatusForbidden)
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.settings.LegalHoldAdmin = &LegalHoldAdmin{Username: "officer", Password: hash}
+		for _, credentials := range []map[string]string{
+			nil,
+			{UserNameTag: "officer", PasswordTag: "wrong"},
+			{UserNameTag: "test:tester", PasswordTag: "secret"},
+		} {
+			rr = storageRequest(t, s, "DELETE", RootLegalHoldEndpoint+"/recording", nil, credentials)
+			if rr.Code != http.StatusUnauthorized {
+				t.Errorf("handler returned wrong status code for %v: got %v want %v", credentials, rr.Code, http.StatusUnauthorized)
+			}
+		}
+		admin := map[string]string{UserNameTag: "officer", PasswordTag: "secret"}
+		rr = storageRequest(t, s, "DELETE", RootLegalHoldEndpoint+"/recording?account=other", nil, admin)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("handler returned wrong status code for an unknown account: got %v want %v", rr.Code, http.StatusNotFound)
+		}
+		rr = storageRequest(t, s, "DELETE", RootLegalHoldEndpoint+"/recording", nil, admin)
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNoContent)
+		}
+		meta, err := s.backend.LoadMetadata("recording")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if metaValue(meta, legalHoldKey) != "" || metaValue(meta, legalHoldReasonKey) != "" || metaValue(meta, "UserID") != "user" {
+			t.Errorf("wrong metadata after release: %v", meta)
+		}
+		rr = storageRequest(t, s, "DELETE", RootLegalHoldEndpoint+"/recording", nil, admin)
+		if rr.Code != http.StatusConflict {
+			t.Errorf("handler returned wrong status code for a recording without hold: got %v want %v", rr.Code, http.StatusConflict)
+		}
+		if n := s.sweep(); n != 1 {
+			t.Errorf("released recording wasn't purged")
+		}
+
+		for container, code := range map[string]int{"missing": http.StatusNotFound, "System": http.StatusBadRequest, "a/b": http.StatusBadRequest} {
+			if rr := storageRequest(t, s, "PUT", RootLegalHoldEndpoint+"/"+container, nil, nil); rr.Code != code {
+				t.Errorf("handler returned wrong status code for %s: got %v want %v", container, rr.Code, code)
+			}
+		}
+	})
+}
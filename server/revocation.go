@@ -0,0 +1,229 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// revokedFilename is the revocation list in the settings folder. It is
+// written by the revoke-token, revoke-user and revoke-client-cert commands,
+// and read by the service whenever it changes.
+const revokedFilename = "revoked-tokens.json"
+
+// revokedTokens is the content of the revocation list.
+type revokedTokens struct {
+	// IDs maps the ID of a revoked token to when it expires
+	IDs map[string]int64 `json:",omitempty"`
+	// Users maps a username to when its tokens were revoked in nanoseconds,
+	// tokens issued to the user until then are revoked
+	Users map[string]int64 `json:",omitempty"`
+	// ClientCertificates maps the issuer and hex encoded serial number of a
+	// revoked client certificate, see certKey, to when it expires
+	ClientCertificates map[string]int64 `json:",omitempty"`
+}
+
+// revoked returns an error if the token with claims is revoked.
+func (t revokedTokens) revoked(claims *tokenClaims) error {
+	if _, ok := t.IDs[claims.Id]; ok && claims.Id != "" {
+		return fmt.Errorf("token %s is revoked", claims.Id)
+	}
+	if revokedAt, ok := t.Users[claims.Subject]; ok && claims.issuedAt() <= revokedAt {
+		return fmt.Errorf("tokens of %s are revoked", claims.Subject)
+	}
+	return nil
+}
+
+// certKey returns the key of cert in the revoked client certificates. Serial
+// numbers are only unique per issuer, so the issuer is part of it.
+func certKey(cert *x509.Certificate) string {
+	return cert.Issuer.String() + "/" + cert.SerialNumber.Text(16)
+}
+
+// revokedCert returns an error if the client certificate cert is revoked.
+func (t revokedTokens) revokedCert(cert *x509.Certificate) error {
+	if _, ok := t.ClientCertificates[certKey(cert)]; ok {
+		return fmt.Errorf("client certificate %s of %s is revoked", cert.SerialNumber.Text(16), cert.Subject.CommonName)
+	}
+	return nil
+}
+
+// prune removes the entries of tokens and certificates that have expired
+// anyway.
+func (t revokedTokens) prune(now time.Time, lifetime time.Duration) {
+	for id, expires := range t.IDs {
+		if expires < now.Unix() {
+			delete(t.IDs, id)
+		}
+	}
+	for user, revokedAt := range t.Users {
+		if revokedAt+int64(lifetime) < now.UnixNano() {
+			delete(t.Users, user)
+		}
+	}
+	for serial, expires := range t.ClientCertificates {
+		if expires < now.Unix() {
+			delete(t.ClientCertificates, serial)
+		}
+	}
+}
+
+func loadRevokedTokens(path string) (revokedTokens, error) {
+	t := revokedTokens{IDs: map[string]int64{}, Users: map[string]int64{}, ClientCertificates: map[string]int64{}}
+	data, err := os.ReadFile(path)
+	if isNotExist(err) {
+		return t, nil
+	} else if err != nil {
+		return t, err
+	}
+	if err := json.Unmarshal(data, &t); err != nil {
+		return t, err
+	}
+	if t.IDs == nil {
+		t.IDs = map[string]int64{}
+	}
+	if t.Users == nil {
+		t.Users = map[string]int64{}
+	}
+	if t.ClientCertificates == nil {
+		t.ClientCertificates = map[string]int64{}
+	}
+	return t, nil
+}
+
+// revocationList keeps the revocation list of the running service up to date
+// with the file.
+type revocationList struct {
+	path   string
+	mu     sync.Mutex
+	loaded os.FileInfo // Of the file when it was loaded, nil without file
+	tokens revokedTokens
+}
+
+func newRevocationList(path string) *revocationList {
+	return &revocationList{path: path}
+}
+
+// check returns an error if the token with claims is revoked.
+func (l *revocationList) check(claims *tokenClaims) error {
+	return l.current().revoked(claims)
+}
+
+// checkCert returns an error if the client certificate cert is revoked.
+func (l *revocationList) checkCert(cert *x509.Certificate) error {
+	return l.current().revokedCert(cert)
+}
+
+// current returns the revocation list, loaded again if the file has changed
+// since it was last loaded. The file is always replaced, so a changed file is
+// another file, and a loaded list is never modified.
+func (l *revocationList) current() revokedTokens {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fi, err := os.Stat(l.path)
+	if err != nil && !isNotExist(err) {
+		logger.Errorf("Failed to check revoked tokens: %v", err)
+		return l.tokens
+	}
+	changed := (fi == nil) != (l.loaded == nil) ||
+		fi != nil && (!os.SameFile(fi, l.loaded) || !fi.ModTime().Equal(l.loaded.ModTime()))
+	if changed {
+		tokens, err := loadRevokedTokens(l.path)
+		if err != nil {
+			// Keeps the tokens revoked before
+			logger.Errorf("Failed to load revoked tokens: %v", err)
+		} else {
+			l.tokens, l.loaded = tokens, fi
+		}
+	}
+	return l.tokens
+}
+
+// updateRevokedTokens applies update to the revocation list in configPath.
+func updateRevokedTokens(configPath string, update func(settings *Settings, t revokedTokens) error) error {
+	data, err := os.ReadFile(filepath.Join(configPath, settingsFilename))
+	if err != nil {
+		return err
+	}
+	settings := Settings{}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return err
+	}
+	path := filepath.Join(configPath, revokedFilename)
+	t, err := loadRevokedTokens(path)
+	if err != nil {
+		return err
+	}
+	if err := update(&settings, t); err != nil {
+		return err
+	}
+	s := &Server{settings: &settings}
+	t.prune(time.Now(), s.tokenLifetime())
+	data, err = json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, strings.NewReader(string(data)))
+}
+
+// RevokeToken revokes a token issued by the service with the settings in
+// configPath. The running service rejects the token from now on.
+func RevokeToken(configPath, token string) error {
+	return updateRevokedTokens(configPath, func(settings *Settings, t revokedTokens) error {
+		claims, err := parseToken([]string{token}, settings.TokenSecret)
+		if err != nil && settings.Previous.valid() {
+			claims, err = parseToken([]string{token}, settings.Previous.TokenSecret)
+		}
+		if err != nil {
+			return err
+		}
+		if claims.Id == "" {
+			return errors.New("token has no ID, revoke the tokens of the user instead")
+		}
+		t.IDs[claims.Id] = claims.ExpiresAt
+		return nil
+	})
+}
+
+// RevokeUser revokes every token issued to username so far, for instance
+// after its password has been changed. New tokens can still be requested.
+func RevokeUser(configPath, username string) error {
+	return updateRevokedTokens(configPath, func(settings *Settings, t revokedTokens) error {
+		t.Users[username] = time.Now().UnixNano()
+		return nil
+	})
+}
+
+// RevokeClientCertificate revokes the client certificate issued for the
+// system controller with serial number scuSerial, or the one in the PEM file
+// scuSerial. The running service rejects it from now on.
+func RevokeClientCertificate(configPath, scuSerial string) error {
+	path := scuSerial
+	if _, err := os.Stat(path); err != nil {
+		if !validTarget(scuSerial) || filepath.Base(scuSerial) != scuSerial {
+			return fmt.Errorf("invalid serial number %q", scuSerial)
+		}
+		path = filepath.Join(configPath, clientCertsDir, scuSerial+".crt")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	certs, err := parseCertificates(data)
+	if err != nil {
+		return err
+	}
+	if len(certs) == 0 {
+		return fmt.Errorf("no certificate found in %s", path)
+	}
+	return updateRevokedTokens(configPath, func(settings *Settings, t revokedTokens) error {
+		t.ClientCertificates[certKey(certs[0])] = certs[0].NotAfter.Unix()
+		return nil
+	})
+}
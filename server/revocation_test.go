@@ -0,0 +1,151 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// newRevocationServer returns a server with its settings in a folder, like
+// an installed service, and a token of its user.
+func newRevocationServer(t *testing.T) (*Server, string) {
+	s, _, _ := newAccountsServer(t)
+	s.settingsPath = t.TempDir()
+	s.settings.TokenLifetimeMinutes = 60
+	s.revoked = newRevocationList(filepath.Join(s.settingsPath, revokedFilename))
+	data, err := json.Marshal(s.settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(s.settingsPath, settingsFilename), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	token, _ := login(t, s, "test:tester")
+	return s, token
+}
+
+func refresh(t *testing.T, s *Server, token string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", RootAuthEndpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "localhost:8080"
+	req.Header.Add(TokenTag, token)
+	rr := httptest.NewRecorder()
+	s.authentication(rr, req)
+	return rr
+}
+
+// Check the claims of issued tokens
+func TestTokenClaims(t *testing.T) {
+	s, token := newRevocationServer(t)
+	agencyToken, _ := login(t, s, "agency:tester")
+
+	claims, err := s.verifyToken([]string{token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Issuer != tokenIssuer || claims.Subject != "test:tester" || claims.Audience != "" || claims.Id == "" {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+	if lifetime := time.Duration(claims.ExpiresAt-claims.IssuedAt) * time.Second; lifetime != time.Hour {
+		t.Errorf("wrong token lifetime: got %v want %v", lifetime, time.Hour)
+	}
+	agencyClaims, err := s.verifyToken([]string{agencyToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agencyClaims.Subject != "agency:tester" || agencyClaims.Audience != "agency" || agencyClaims.Id == claims.Id {
+		t.Errorf("unexpected claims %+v", agencyClaims)
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+	s, token := newRevocationServer(t)
+	other, _ := login(t, s, "test:tester")
+
+	if err := RevokeToken(s.settingsPath, token); err != nil {
+		t.Fatal(err)
+	}
+	if code := storageRequest(t, s, "HEAD", RootStorageEndpoint, nil, map[string]string{"X-Auth-Token": token}).Code; code != http.StatusUnauthorized {
+		t.Errorf("revoked token: got %v want %v", code, http.StatusUnauthorized)
+	}
+	if rr := refresh(t, s, token); rr.Code != http.StatusUnauthorized {
+		t.Errorf("revoked token refreshed: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+	if code := storageRequest(t, s, "HEAD", RootStorageEndpoint, nil, map[string]string{"X-Auth-Token": other}).Code; code != http.StatusOK {
+		t.Errorf("other token: got %v want %v", code, http.StatusOK)
+	}
+}
+
+func TestRevokeUser(t *testing.T) {
+	s, token := newRevocationServer(t)
+	agencyToken, _ := login(t, s, "agency:tester")
+
+	if err := RevokeUser(s.settingsPath, "test:tester"); err != nil {
+		t.Fatal(err)
+	}
+	if code := storageRequest(t, s, "HEAD", RootStorageEndpoint, nil, map[string]string{"X-Auth-Token": token}).Code; code != http.StatusUnauthorized {
+		t.Errorf("revoked user: got %v want %v", code, http.StatusUnauthorized)
+	}
+	if code := storageRequest(t, s, "HEAD", "/v1.0/agency", nil, map[string]string{"X-Auth-Token": agencyToken}).Code; code != http.StatusOK {
+		t.Errorf("other user: got %v want %v", code, http.StatusOK)
+	}
+
+	// Tokens issued after the revocation are valid, even within the same
+	// second
+	revoked, err := loadRevokedTokens(filepath.Join(s.settingsPath, revokedFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokedAt := revoked.Users["test:tester"]
+	for _, test := range []struct {
+		name   string
+		claims tokenClaims
+		want   bool
+	}{
+		{"issued at revocation", tokenClaims{IssuedAtNano: revokedAt}, true},
+		{"issued after revocation", tokenClaims{IssuedAtNano: revokedAt + 1}, false},
+		{"seconds only, same second", tokenClaims{StandardClaims: jwt.StandardClaims{IssuedAt: revokedAt / int64(time.Second)}}, true},
+		{"seconds only, next second", tokenClaims{StandardClaims: jwt.StandardClaims{IssuedAt: revokedAt/int64(time.Second) + 1}}, false},
+	} {
+		test.claims.Subject = "test:tester"
+		if err := revoked.revoked(&test.claims); (err != nil) != test.want {
+			t.Errorf("%s: got %v want revoked %v", test.name, err, test.want)
+		}
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	s, token := newRevocationServer(t)
+
+	rr := refresh(t, s, token)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	refreshed := rr.Header().Get(TokenTag)
+	if refreshed == "" || refreshed == token {
+		t.Fatal("no new token returned")
+	}
+	if url := rr.Header().Get(StorageUrlTag); url != "http://localhost:8080"+RootStorageEndpoint {
+		t.Errorf("wrong storage URL: got %s want http://localhost:8080%s", url, RootStorageEndpoint)
+	}
+	if code := storageRequest(t, s, "HEAD", RootStorageEndpoint, nil, map[string]string{"X-Auth-Token": refreshed}).Code; code != http.StatusOK {
+		t.Errorf("refreshed token: got %v want %v", code, http.StatusOK)
+	}
+
+	// Tokens without a user can't be refreshed
+	anonymous, err := createToken(tokenSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr := refresh(t, s, anonymous); rr.Code != http.StatusUnauthorized {
+		t.Errorf("token without user refreshed: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+}
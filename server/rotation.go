@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultRotationOverlap is how long replaced credentials stay valid unless
+// RotationOverlapMinutes is set.
+const defaultRotationOverlap = time.Hour
+
+// PreviousCredentials are the password hash and token secret replaced by the
+// rotate-credentials command. They stay valid until Until, so the system
+// controller can be given the new connection file without interruption.
+type PreviousCredentials struct {
+	Password    []byte
+	TokenSecret []byte
+	Until       time.Time
+}
+
+func (p *PreviousCredentials) valid() bool {
+	return p != nil && time.Now().Before(p.Until)
+}
+
+// credentials returns the password hash and token secret of the default
+// account, and the previous ones if still valid. Credentials rotated while the
+// service runs are picked up from the settings file.
+func (s *Server) credentials() (password, tokenSecret []byte, previous *PreviousCredentials) {
+	s.reloadCredentials()
+	s.credentialsMu.RLock()
+	defer s.credentialsMu.RUnlock()
+	if s.settings.Previous.valid() {
+		previous = s.settings.Previous
+	}
+	return s.settings.Password, s.settings.TokenSecret, previous
+}
+
+// reloadCredentials loads the credentials from the settings file if it has
+// been replaced since they were last loaded. The other settings are only
+// read at startup.
+func (s *Server) reloadCredentials() {
+	if s.settingsPath == "" {
+		return
+	}
+	path := filepath.Join(s.settingsPath, settingsFilename)
+	fi, err := os.Stat(path)
+	if err != nil {
+		logger.Errorf("Failed to check settings: %v", err)
+		return
+	}
+	s.credentialsMu.Lock()
+	defer s.credentialsMu.Unlock()
+	if s.settingsFile != nil && os.SameFile(fi, s.settingsFile) && fi.ModTime().Equal(s.settingsFile.ModTime()) {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		logger.Errorf("Failed to reload settings: %v", err)
+		return
+	}
+	conf := Settings{}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		logger.Errorf("Failed to reload settings: %v", err)
+		return
+	}
+	rotated := s.settingsFile != nil && string(conf.TokenSecret) != string(s.settings.TokenSecret)
+	s.settings.Password, s.settings.TokenSecret, s.settings.Previous = conf.Password, conf.TokenSecret, conf.Previous
+	s.settingsFile = fi
+	if rotated {
+		logger.Info("Credentials rotated")
+		s.audit(AuditEntry{Action: "credentials-rotated", User: s.settings.Username})
+	}
+}
+
+// rotateCredentials replaces the password hash and token secret in the
+// settings in configPath, keeping the old ones as PreviousCredentials.
+func rotateCredentials(configPath string, hash []byte) (Settings, error) {
+	settingsFile := filepath.Join(configPath, settingsFilename)
+	settings := Settings{}
+	data, err := os.ReadFile(settingsFile)
+	if err != nil {
+		return settings, err
+	}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return settings, err
+	}
+	tokenSecret, err := generateTokenSecret(16)
+	if err != nil {
+		return settings, err
+	}
+	overlap := defaultRotationOverlap
+	if settings.RotationOverlapMinutes > 0 {
+		overlap = time.Duration(settings.RotationOverlapMinutes) * time.Minute
+	}
+	settings.Previous = &PreviousCredentials{
+		Password:    settings.Password,
+		TokenSecret: settings.TokenSecret,
+		Until:       time.Now().Add(overlap).UTC(),
+	}
+	settings.Password, settings.TokenSecret = hash, tokenSecret
+
+	confJson, err := json.Marshal(settings)
+	if err != nil {
+		return settings, err
+	}
+	// Replaced in one step, the running service reloads it
+	return settings, writeFileAtomic(settingsFile, strings.NewReader(string(confJson)))
+}
+
+// RotateCredentials asks for a new password for the user of the settings in
+// configPath and replaces it and the token secret while the service runs.
+// The old password and tokens stay valid for RotationOverlapMinutes. A new
+// connection file is written to the storage location.
+func RotateCredentials(configPath, version string) error {
+	plaintext, hash := selectPassword()
+	settings, err := rotateCredentials(configPath, hash)
+	if err != nil {
+		return err
+	}
+	settings.plainPassword = plaintext
+	// Keeps the encryption and capabilities of the current connection file
+	if data, err := os.ReadFile(filepath.Join(settings.StorageLocation, connectionFilename)); err == nil {
+		old := Config{}
+		if err := json.Unmarshal(data, &old); err == nil {
+			settings.publicKey, settings.publicKeyID = old.PublicKey, old.PublicKeyId
+			settings.fullStoreAndReadSupport = old.FullStoreAndReadSupport
+		}
+	}
+	if err := generateConnectionFile(configPath, version, settings); err != nil {
+		return errors.New("failed to generate a connection file: " + err.Error())
+	}
+	return nil
+}
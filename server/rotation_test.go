@@ -0,0 +1,92 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func loginStatus(t *testing.T, s *Server, username, password string) (int, string) {
+	req, err := http.NewRequest("GET", RootAuthEndpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add(UserNameTag, username)
+	req.Header.Add(PasswordTag, password)
+	rr := httptest.NewRecorder()
+	s.authentication(rr, req)
+	return rr.Code, rr.Header().Get(TokenTag)
+}
+
+// Check that rotated credentials are used by the running server, and that
+// the previous ones stay valid during the overlap
+func TestRotateCredentials(t *testing.T) {
+	s, oldToken := newRevocationServer(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("rotated"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := rotateCredentials(s.settingsPath, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if until := time.Until(settings.Previous.Until); until < 59*time.Minute || until > time.Hour {
+		t.Errorf("wrong overlap: got %v want %v", until, time.Hour)
+	}
+
+	code, newToken := loginStatus(t, s, "test:tester", "rotated")
+	if code != http.StatusOK {
+		t.Fatalf("new password: got %v want %v", code, http.StatusOK)
+	}
+	for name, token := range map[string]string{"old token": oldToken, "new token": newToken} {
+		if code := storageRequest(t, s, "HEAD", RootStorageEndpoint, nil, map[string]string{"X-Auth-Token": token}).Code; code != http.StatusOK {
+			t.Errorf("%s: got %v want %v", name, code, http.StatusOK)
+		}
+	}
+	if code, _ := loginStatus(t, s, "test:tester", "testing"); code != http.StatusOK {
+		t.Errorf("old password during overlap: got %v want %v", code, http.StatusOK)
+	}
+	// Old tokens can't be refreshed to outlive the overlap
+	if rr := refresh(t, s, oldToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("refresh of old token: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+	if rr := refresh(t, s, newToken); rr.Code != http.StatusOK {
+		t.Errorf("refresh of new token: got %v want %v", rr.Code, http.StatusOK)
+	}
+	// Accounts have passwords of their own
+	if code, _ := loginStatus(t, s, "agency:tester", "rotated"); code != http.StatusUnauthorized {
+		t.Errorf("new password of other account: got %v want %v", code, http.StatusUnauthorized)
+	}
+
+	// After the overlap only the new credentials are valid
+	settings.Previous.Until = time.Now().Add(-time.Second)
+	data, err := json.Marshal(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(filepath.Join(s.settingsPath, settingsFilename), strings.NewReader(string(data))); err != nil {
+		t.Fatal(err)
+	}
+	if code := storageRequest(t, s, "HEAD", RootStorageEndpoint, nil, map[string]string{"X-Auth-Token": oldToken}).Code; code != http.StatusUnauthorized {
+		t.Errorf("old token after overlap: got %v want %v", code, http.StatusUnauthorized)
+	}
+	if code, _ := loginStatus(t, s, "test:tester", "testing"); code != http.StatusUnauthorized {
+		t.Errorf("old password after overlap: got %v want %v", code, http.StatusUnauthorized)
+	}
+	if code := storageRequest(t, s, "HEAD", RootStorageEndpoint, nil, map[string]string{"X-Auth-Token": newToken}).Code; code != http.StatusOK {
+		t.Errorf("new token after overlap: got %v want %v", code, http.StatusOK)
+	}
+}
+
+func TestRotateCredentialsWithoutSettings(t *testing.T) {
+	if _, err := rotateCredentials(t.TempDir(), []byte("hash")); !os.IsNotExist(err) {
+		t.Errorf("expected missing settings, got %v", err)
+	}
+}
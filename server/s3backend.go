@@ -0,0 +1,662 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3MetaPrefix      = "X-Amz-Meta-"
+	s3EmptyPayloadSHA = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	// Objects larger than s3PartSize are uploaded in parts of that size, which
+	// is the most memory an upload holds at once. S3 allows at most 10000
+	// parts, so objects can be up to 160 GB.
+	s3PartSize = 16 << 20
+	// s3MaxCopySize is the largest object S3 copies in a single request,
+	// larger objects are copied in parts of s3CopyPartSize.
+	s3MaxCopySize  = 5 << 30
+	s3CopyPartSize = 1 << 30
+)
+
+// S3Settings holds the location and credentials of a bucket in an S3
+// compatible object store, such as MinIO.
+type S3Settings struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+}
+
+// S3Backend stores every container as a prefix in a bucket. A container is
+// represented by an empty "<container>/" marker object, and the metadata of
+// containers and objects is kept as S3 user metadata instead of in
+// .metadata.json files.
+type S3Backend struct {
+	settings S3Settings
+	endpoint *url.URL
+	client   *http.Client
+
+	partSize     int64
+	maxCopySize  int64
+	copyPartSize int64
+}
+
+// NewS3Backend returns a Backend storing everything in the bucket described by
+// settings.
+func NewS3Backend(settings *S3Settings) (*S3Backend, error) {
+	if settings == nil || settings.Endpoint == "" || settings.Bucket == "" {
+		return nil, errors.New("no S3 endpoint or bucket configured")
+	}
+	endpoint, err := url.Parse(settings.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint: %v", err)
+	}
+	s := *settings
+	if s.Region == "" {
+		s.Region = "us-east-1"
+	}
+	return &S3Backend{
+		settings:     s,
+		endpoint:     endpoint,
+		client:       &http.Client{},
+		partSize:     s3PartSize,
+		maxCopySize:  s3MaxCopySize,
+		copyPartSize: s3CopyPartSize,
+	}, nil
+}
+
+// s3Error is the error document returned by S3 for failed requests.
+type s3Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("s3: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// key returns the object key used for target. Containers are addressed by
+// their marker object.
+func (b *S3Backend) key(target string) string {
+	container, object := splitTarget(target)
+	return container + "/" + object
+}
+
+// do sends a signed request for key, or for the bucket if key is empty.
+// payloadHash is the hex encoded SHA-256 of body. Errors are translated to the
+// errors expected from a Backend.
+func (b *S3Backend) do(method, key string, query url.Values, header http.Header, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	u := *b.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + b.settings.Bucket
+	u.RawPath = strings.TrimSuffix(b.endpoint.EscapedPath(), "/") + "/" + s3Escape(b.settings.Bucket)
+	if key != "" {
+		u.Path += "/" + key
+		u.RawPath += "/" + s3Escape(key)
+	}
+	u.RawQuery = s3Query(query)
+	if size == 0 {
+		body = nil
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	signS3Request(req, b.settings, payloadHash, time.Now())
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	e := &s3Error{StatusCode: resp.StatusCode}
+	if method != http.MethodHead {
+		data, _ := io.ReadAll(resp.Body)
+		xml.Unmarshal(data, e)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &fs.PathError{Op: "s3", Path: key, Err: os.ErrNotExist}
+	}
+	return nil, e
+}
+
+func (b *S3Backend) head(target string) (*http.Response, error) {
+	resp, err := b.do(http.MethodHead, b.key(target), nil, nil, nil, 0, s3EmptyPayloadSHA)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// put uploads body, which must be seekable so that it can be hashed before
+// it's sent.
+func (b *S3Backend) put(key string, header http.Header, body io.ReadSeeker) error {
+	digest := sha256.New()
+	size, err := io.Copy(digest, body)
+	if err != nil {
+		return err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	resp, err := b.do(http.MethodPut, key, nil, header, body, size, hex.EncodeToString(digest.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func metadataHeader(metadata map[string]string) http.Header {
+	header := http.Header{}
+	for k, v := range metadata {
+		header.Set(s3MetaPrefix+k, url.PathEscape(v))
+	}
+	return header
+}
+
+func (b *S3Backend) CreateContainer(container string) (bool, error) {
+	_, err := b.head(container)
+	if err == nil {
+		return false, nil
+	}
+	if !isNotExist(err) {
+		return false, err
+	}
+	if err := b.put(b.key(container), nil, bytes.NewReader(nil)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// PutObject uploads objects up to the part size in a single request, with the
+// ETag sent as Content-MD5 so that S3 checks it. Larger objects are streamed in
+// parts, and the upload is aborted if the ETag doesn't match at the end.
+func (b *S3Backend) PutObject(target string, body io.Reader, etag string) error {
+	container, _ := splitTarget(target)
+	if _, err := b.head(container); err != nil {
+		return err
+	}
+	var header http.Header
+	if etag != "" {
+		digest, err := hex.DecodeString(etag)
+		if err != nil || len(digest) != md5.Size {
+			return fmt.Errorf("%w: invalid ETag %s", errChecksumMismatch, etag)
+		}
+		header = http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(digest)}}
+	}
+	body = newEtagReader(body, etag)
+	part := make([]byte, b.partSize)
+	n, err := io.ReadFull(body, part)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = b.put(b.key(target), header, bytes.NewReader(part[:n]))
+		var e *s3Error
+		if errors.As(err, &e) && e.Code == "BadDigest" {
+			return fmt.Errorf("%w: %v", errChecksumMismatch, err)
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	return b.putMultipart(b.key(target), body, part)
+}
+
+// s3CompletedPart is a part listed in a CompleteMultipartUpload request.
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// createMultipart starts a multipart upload of key, header holds the
+// metadata of the object.
+func (b *S3Backend) createMultipart(key string, header http.Header) (string, error) {
+	resp, err := b.do(http.MethodPost, key, url.Values{"uploads": {""}}, header, nil, 0, s3EmptyPayloadSHA)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	return result.UploadID, nil
+}
+
+// putMultipart uploads first and the rest of body in parts of the same size
+// as first.
+func (b *S3Backend) putMultipart(key string, body io.Reader, first []byte) error {
+	uploadID, err := b.createMultipart(key, nil)
+	if err != nil {
+		return err
+	}
+	parts := []s3CompletedPart{}
+	buf, n := first, len(first)
+	for number := 1; n > 0; number++ {
+		data := buf[:n]
+		digest := sha256.Sum256(data)
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+		resp, err := b.do(http.MethodPut, key, query, nil, bytes.NewReader(data), int64(n), hex.EncodeToString(digest[:]))
+		if err != nil {
+			b.abortMultipart(key, uploadID)
+			return err
+		}
+		resp.Body.Close()
+		parts = append(parts, s3CompletedPart{PartNumber: number, ETag: resp.Header.Get("Etag")})
+
+		n, err = io.ReadFull(body, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			b.abortMultipart(key, uploadID)
+			return err
+		}
+	}
+	return b.completeMultipart(key, uploadID, parts)
+}
+
+// copyMultipart copies key onto itself in parts with the metadata in header,
+// for objects too large for a single copy request.
+func (b *S3Backend) copyMultipart(key string, header http.Header, size int64) error {
+	uploadID, err := b.createMultipart(key, header)
+	if err != nil {
+		return err
+	}
+	parts := []s3CompletedPart{}
+	for number, start := 1, int64(0); start < size; number, start = number+1, start+b.copyPartSize {
+		end := start + b.copyPartSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+		partHeader := http.Header{}
+		partHeader.Set("X-Amz-Copy-Source", "/"+s3Escape(b.settings.Bucket)+"/"+s3Escape(key))
+		partHeader.Set("X-Amz-Copy-Source-Range", fmt.Sprintf("bytes=%d-%d", start, end))
+		resp, err := b.do(http.MethodPut, key, query, partHeader, nil, 0, s3EmptyPayloadSHA)
+		if err != nil {
+			b.abortMultipart(key, uploadID)
+			return err
+		}
+		var result struct {
+			ETag string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			b.abortMultipart(key, uploadID)
+			return err
+		}
+		parts = append(parts, s3CompletedPart{PartNumber: number, ETag: result.ETag})
+	}
+	return b.completeMultipart(key, uploadID, parts)
+}
+
+// completeMultipart assembles the uploaded parts. S3 can report a failure in
+// the body of a successful response, so the body is checked for an error.
+func (b *S3Backend) completeMultipart(key, uploadID string, parts []s3CompletedPart) error {
+	data, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(data)
+	query := url.Values{"uploadId": {uploadID}}
+	resp, err := b.do(http.MethodPost, key, query, nil, bytes.NewReader(data), int64(len(data)), hex.EncodeToString(digest[:]))
+	if err != nil {
+		b.abortMultipart(key, uploadID)
+		return err
+	}
+	defer resp.Body.Close()
+	result, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	e := &s3Error{StatusCode: resp.StatusCode}
+	if xml.Unmarshal(result, e) == nil && e.Code != "" {
+		b.abortMultipart(key, uploadID)
+		return e
+	}
+	return nil
+}
+
+// abortMultipart discards the parts of a failed upload.
+func (b *S3Backend) abortMultipart(key, uploadID string) {
+	resp, err := b.do(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil, 0, s3EmptyPayloadSHA)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+func (b *S3Backend) GetObject(target string) (io.ReadSeekCloser, error) {
+	resp, err := b.do(http.MethodGet, b.key(target), nil, nil, nil, 0, s3EmptyPayloadSHA)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Object{b: b, key: b.key(target), size: resp.ContentLength, body: resp.Body}, nil
+}
+
+// s3Object reads an object. Moving the read position closes the response and
+// the next Read reopens the object with a Range request.
+type s3Object struct {
+	b    *S3Backend
+	key  string
+	size int64
+	pos  int64
+	body io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.pos >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		header := http.Header{}
+		header.Set("Range", fmt.Sprintf("bytes=%d-", o.pos))
+		resp, err := o.b.do(http.MethodGet, o.key, nil, header, nil, 0, s3EmptyPayloadSHA)
+		if err != nil {
+			return 0, err
+		}
+		o.body = resp.Body
+	}
+	n, err := o.body.Read(p)
+	o.pos += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	pos := offset
+	switch whence {
+	case io.SeekCurrent:
+		pos += o.pos
+	case io.SeekEnd:
+		pos += o.size
+	}
+	if pos < 0 {
+		return o.pos, errors.New("s3: seek before start of object")
+	}
+	if pos != o.pos && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.pos = pos
+	return pos, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	return o.body.Close()
+}
+
+func (b *S3Backend) Stat(target string) (ObjectInfo, error) {
+	resp, err := b.head(target)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	_, object := splitTarget(target)
+	info := ObjectInfo{Name: target, Container: object == ""}
+	if !info.Container {
+		info.Size = resp.ContentLength
+		info.Hash = strings.Trim(resp.Header.Get("Etag"), `"`)
+	}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = t
+	}
+	return info, nil
+}
+
+func (b *S3Backend) LoadMetadata(target string) (map[string]string, error) {
+	resp, err := b.head(target)
+	if err != nil {
+		return nil, err
+	}
+	metadata := map[string]string{}
+	for k, v := range resp.Header {
+		if len(k) > len(s3MetaPrefix) && strings.HasPrefix(k, s3MetaPrefix) {
+			metadata[strings.TrimPrefix(k, s3MetaPrefix)] = URLDecode(v[0])
+		}
+	}
+	return metadata, nil
+}
+
+// StoreMetadata rewrites the empty container marker, or copies an object onto
+// itself as S3 can't change the metadata of an object in place.
+func (b *S3Backend) StoreMetadata(target string, metadata map[string]string) error {
+	resp, err := b.head(target)
+	if err != nil {
+		return err
+	}
+	header := metadataHeader(metadata)
+	key := b.key(target)
+	if _, object := splitTarget(target); object == "" {
+		return b.put(key, header, bytes.NewReader(nil))
+	}
+	if resp.ContentLength > b.maxCopySize {
+		return b.copyMultipart(key, header, resp.ContentLength)
+	}
+	header.Set("X-Amz-Copy-Source", "/"+s3Escape(b.settings.Bucket)+"/"+s3Escape(key))
+	header.Set("X-Amz-Metadata-Directive", "REPLACE")
+	resp, err = b.do(http.MethodPut, key, nil, header, nil, 0, s3EmptyPayloadSHA)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// BackupMetadata is a no-op, metadata kept as S3 user metadata can't be
+// corrupt.
+func (b *S3Backend) BackupMetadata(target string) error {
+	return nil
+}
+
+// s3ListResult is the result of a ListObjectsV2 request.
+type s3ListResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+}
+
+// listBucket returns every key and common prefix below prefix.
+func (b *S3Backend) listBucket(prefix, delimiter string) ([]s3ListResult, error) {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	pages := []s3ListResult{}
+	for {
+		resp, err := b.do(http.MethodGet, "", query, nil, nil, 0, s3EmptyPayloadSHA)
+		if err != nil {
+			return nil, err
+		}
+		var page s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, page)
+		if !page.IsTruncated {
+			return pages, nil
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+}
+
+// List finds containers by the common prefixes of the bucket, and objects by
+// the keys with the container prefix.
+func (b *S3Backend) List(container string) ([]ObjectInfo, error) {
+	list := []ObjectInfo{}
+	if container == "" {
+		pages, err := b.listBucket("", "/")
+		if err != nil {
+			return nil, err
+		}
+		for _, page := range pages {
+			for _, p := range page.CommonPrefixes {
+				list = append(list, ObjectInfo{Name: strings.TrimSuffix(p.Prefix, "/"), Container: true})
+			}
+		}
+		return list, nil
+	}
+	if _, err := b.head(container); err != nil {
+		return nil, err
+	}
+	pages, err := b.listBucket(container+"/", "")
+	if err != nil {
+		return nil, err
+	}
+	for _, page := range pages {
+		for _, c := range page.Contents {
+			name := strings.TrimPrefix(c.Key, container+"/")
+			if name == "" {
+				continue
+			}
+			list = append(list, ObjectInfo{Name: name, Size: c.Size, ModTime: c.LastModified})
+		}
+	}
+	return list, nil
+}
+
+// Delete checks that target exists first, as S3 reports success when deleting
+// missing keys. A container is deleted by deleting its marker object.
+func (b *S3Backend) Delete(target string) error {
+	if _, err := b.head(target); err != nil {
+		return err
+	}
+	resp, err := b.do(http.MethodDelete, b.key(target), nil, nil, nil, 0, s3EmptyPayloadSHA)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// s3Escape escapes a key the way AWS Signature Version 4 expects it, every
+// byte except unreserved characters and slashes is percent encoded.
+func s3Escape(key string) string {
+	var sb strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+// s3Query encodes query sorted by key, with keys and values escaped the way
+// AWS Signature Version 4 expects them.
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, k := range keys {
+		values := append([]string{}, query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, s3QueryEscape(k)+"="+s3QueryEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func s3QueryEscape(s string) string {
+	return strings.ReplaceAll(s3Escape(s), "/", "%2F")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signS3Request signs req using AWS Signature Version 4. All headers already
+// set on req are signed, together with the host.
+func signS3Request(req *http.Request, settings S3Settings, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3Query(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	digest := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + settings.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+
+	key := hmacSHA256([]byte("AWS4"+settings.SecretKey), date)
+	key = hmacSHA256(key, settings.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+settings.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
@@ -1,18 +1,23 @@
 package server
 
 import (
-	"crypto/md5"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
-	"path"
 	"path/filepath"
+	"sort"
 	"strings"
-	"syscall"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
@@ -33,10 +38,20 @@ const (
 	ObjectMeta    = "X-Object-Meta-"
 )
 
+// Tokens are issued by tokenIssuer, and valid for TokenLifetimeMinutes of the
+// settings or defaultTokenLifetime.
+const (
+	tokenIssuer          = "AxisBodyWornSwiftServiceExample"
+	defaultTokenLifetime = 15 * time.Minute
+)
+
 type Settings struct {
-	StorageLocation         string
-	Port                    string
-	IPs                     []string
+	StorageLocation string
+	Port            string
+	IPs             []string
+	// Endpoints are host names and URLs published in the connection file
+	// besides the IPs
+	Endpoints               []string `json:",omitempty"`
 	UseHttps                bool
 	Username                string
 	Password                []byte
@@ -45,6 +60,22 @@ type Settings struct {
 	publicKeyID             string
 	TokenSecret             []byte
 	fullStoreAndReadSupport bool
+	AllowDownload           bool                  `json:",omitempty"`
+	Retention               *RetentionPolicy      `json:",omitempty"`
+	LegalHoldAdmin          *LegalHoldAdmin       `json:",omitempty"`
+	Quota                   *Quota                `json:",omitempty"`
+	Backpressure            *Backpressure         `json:",omitempty"`
+	Accounts                []Account             `json:",omitempty"`
+	TokenLifetimeMinutes    int                   `json:",omitempty"`
+	RotationOverlapMinutes  int                   `json:",omitempty"`
+	Previous                *PreviousCredentials  `json:",omitempty"`
+	BruteForce              *BruteForceProtection `json:",omitempty"`
+	MutualTLS               *MutualTLS            `json:",omitempty"`
+	CertificateRenewDays    int                   `json:",omitempty"`
+	ServerCertificate       *ServerCertificate    `json:",omitempty"`
+	StorageBackend          string                `json:",omitempty"`
+	Swift                   *SwiftSettings        `json:",omitempty"`
+	S3                      *S3Settings           `json:",omitempty"`
 }
 
 // Config represents the contents of the connection file used to configure the SCU
@@ -82,6 +113,23 @@ type Server struct {
 	scheme       string
 	settings     *Settings
 	settingsPath string
+	backend      Backend
+	auditLog     *auditLog
+	throttle     *throttle
+	revoked      *revocationList
+	guard        *loginGuard
+	// The credentials of settings are replaced when settingsFile changes
+	credentialsMu sync.RWMutex
+	settingsFile  os.FileInfo
+	// account is empty for the default account, which also serves the
+	// other accounts
+	account  string
+	accounts map[string]*Server
+
+	uploadsMu sync.Mutex
+	uploading map[string]bool
+
+	usage usageCounter
 }
 
 func New(settingsPath string) (*Server, error) {
@@ -93,6 +141,10 @@ func New(settingsPath string) (*Server, error) {
 		return nil, err
 	}
 	defer confFile.Close()
+	settingsFile, err := confFile.Stat()
+	if err != nil {
+		return nil, err
+	}
 	confBytes, err := io.ReadAll(confFile)
 	if err != nil {
 		return nil, err
@@ -101,8 +153,46 @@ func New(settingsPath string) (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
+	backend, err := newBackend(&conf)
+	if err != nil {
+		return nil, err
+	}
+	audit, err := openAuditLog(filepath.Join(settingsPath, auditFilename))
+	if err != nil {
+		return nil, err
+	}
 
-	return &Server{settings: &conf, settingsPath: settingsPath}, nil
+	s := &Server{
+		settings:     &conf,
+		settingsPath: settingsPath,
+		backend:      backend,
+		auditLog:     audit,
+		revoked:      newRevocationList(filepath.Join(settingsPath, revokedFilename)),
+		settingsFile: settingsFile,
+	}
+	if conf.Backpressure != nil {
+		s.throttle = newThrottle(*conf.Backpressure)
+	}
+	// Brute force protection is on unless disabled
+	if conf.BruteForce == nil || !conf.BruteForce.Disabled {
+		protection := BruteForceProtection{}
+		if conf.BruteForce != nil {
+			protection = *conf.BruteForce
+		}
+		if s.guard, err = newLoginGuard(protection); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.addAccounts(conf.Accounts); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SetBackend replaces the storage backend, by default containers and objects
+// are stored as files below the configured storage location.
+func (s *Server) SetBackend(b Backend) {
+	s.backend = b
 }
 
 func newError(StatusCode int, Text string) *swift.Error {
@@ -122,38 +212,181 @@ func (s *Server) authentication(w http.ResponseWriter, r *http.Request) {
 	if len(r.Header[UserNameTag]) > 0 && len(r.Header[PasswordTag]) > 0 {
 		username = r.Header[UserNameTag][0]
 		password = r.Header[PasswordTag][0]
+	} else if len(r.Header[TokenTag]) > 0 {
+		s.refreshToken(w, r)
+		return
 	} else {
 		logger.Error("Call to auth without credentials")
 		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return
 	}
-	AccessToken, err := auth(username, password, s.settings.Username, s.settings.Password, s.settings.TokenSecret)
+	srv, AccessToken, err := s.login(r, username, password)
 	if err != nil {
-		logger.Errorf("Authentication error: %v", err)
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		loginError(w, err)
 		return
 	}
 	w.Header().Set(TokenTag, AccessToken)
-	logger.Info(r.Host + RootStorageEndpoint)
-	w.Header().Set(StorageUrlTag, fmt.Sprintf(s.scheme+"%s%s", r.Host, RootStorageEndpoint))
+	logger.Info(s.storageURL(r, srv.accountName()))
+	w.Header().Set(StorageUrlTag, s.storageURL(r, srv.accountName()))
+}
+
+// refreshToken answers a request to the auth endpoint with a valid token
+// instead of credentials with a new token for the same user. Tokens of users
+// that no longer exist or have been revoked can't be refreshed.
+func (s *Server) refreshToken(w http.ResponseWriter, r *http.Request) {
+	_, tokenSecret, _ := s.credentials()
+	claims, err := s.verifyToken(r.Header[TokenTag])
+	var srv *Server
+	if err == nil {
+		srv = s.userServer(claims.Subject)
+		if srv == nil || claims.Subject == "" || srv.account != claims.Audience {
+			err = errors.New("token of unknown user " + claims.Subject)
+		}
+	}
+	// Tokens of the previous secret stay valid until the overlap ends, but
+	// aren't turned into tokens of the new secret outliving it
+	if err == nil {
+		if _, err2 := parseToken(r.Header[TokenTag], tokenSecret); err2 != nil {
+			err = errors.New("token of the previous secret of " + claims.Subject)
+		}
+	}
+	if err == nil {
+		err = checkClientAccount(r, srv)
+	}
+	if err != nil {
+		logger.Errorf("Token refresh error: %v", err)
+		loginError(w, err)
+		return
+	}
+	token, err := createAccountToken(tokenSecret, s.tokenLifetime(), claims.Subject, srv.account)
+	if err != nil {
+		logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	srv.audit(AuditEntry{Action: "token-refreshed", User: claims.Subject, Remote: r.RemoteAddr})
+	w.Header().Set(TokenTag, token)
+	w.Header().Set(StorageUrlTag, s.storageURL(r, srv.accountName()))
+}
+
+// login checks the credentials of a user and returns the server of the
+// account of the user with a new token for it.
+func (s *Server) login(r *http.Request, username, password string) (*Server, string, error) {
+	srv := s.userServer(username)
+	if srv == nil {
+		srv = s
+	}
+	// A client certificate restricted to an account only gets its tokens
+	if err := checkClientAccount(r, srv); err != nil {
+		logger.Errorf("Authentication of %s refused: %v", username, err)
+		return nil, "", err
+	}
+	ip := remoteIP(r)
+	if s.guard != nil {
+		if wait := s.guard.lockedOut(ip, username); wait > 0 {
+			err := errLockedOut{retryAfter: wait}
+			logger.Errorf("Authentication of %s from %s refused: %v", username, ip, err)
+			return nil, "", err
+		}
+	}
+	storedPassword, tokenSecret, previous := s.credentials()
+	if srv != s {
+		storedPassword, previous = srv.settings.Password, nil
+	}
+	detail := ""
+	err := auth(username, password, srv.settings.Username, storedPassword)
+	if err != nil && previous != nil && auth(username, password, srv.settings.Username, previous.Password) == nil {
+		// Until the system controller has the new connection file
+		err, detail = nil, "previous password"
+	}
+	if err != nil {
+		logger.Errorf("Authentication error: %v", err)
+		s.authenticationFailed(r, username, "")
+		return nil, "", err
+	}
+	if s.guard != nil {
+		s.guard.succeed(ip, username)
+	}
+	token, err := createAccountToken(tokenSecret, s.tokenLifetime(), username, srv.account)
+	if err != nil {
+		logger.Error(err)
+		return nil, "", err
+	}
+	srv.audit(AuditEntry{Action: "authenticated", User: username, Remote: r.RemoteAddr, Detail: detail})
 	logger.Info("User " + username + " was successfully authenticated")
+	return srv, token, nil
 }
 
+// storageURL returns the URL of account on the host of r.
+func (s *Server) storageURL(r *http.Request, account string) string {
+	return fmt.Sprintf(s.scheme+"%s%s", r.Host, RootStoragePrefix+account)
+}
+
+// storageHandler serves the storage requests of every account, with the
+// server of the account the token was issued for.
 func (s *Server) storageHandler(w http.ResponseWriter, r *http.Request) {
-	if err := verifyToken(r.Header[TokenTag], s.settings.TokenSecret); err != nil {
+	srv, err := s.tokenServer(r)
+	if err != nil {
 		logger.Errorf("Token verification error: %v", err)
 		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return
 	}
+	if account := accountFromPath(r); account != srv.accountName() {
+		logger.Error("Token not valid for account " + account)
+		e := swift.Forbidden
+		http.Error(w, e.Text, e.StatusCode)
+		return
+	}
+	if err := checkClientAccount(r, srv); err != nil {
+		logger.Error(err)
+		e := swift.Forbidden
+		http.Error(w, e.Text, e.StatusCode)
+		return
+	}
+	srv.handleStorage(w, r)
+}
+
+func (s *Server) handleStorage(w http.ResponseWriter, r *http.Request) {
+	if getTarget(r) == "" {
+		s.handleAccount(w, r)
+		return
+	}
+	// Like in Swift, container names starting with a dot are reserved, the
+	// partial uploads are kept in one
+	if !validTarget(getTarget(r)) || strings.HasPrefix(getTarget(r), ".") {
+		logger.Error("Invalid container or object name: " + getTarget(r))
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
 	switch r.Method {
 	case http.MethodHead:
 		s.handleGetMetadata(w, r)
 	case http.MethodPut:
+		done, ok := s.admitUpload(w)
+		if !ok {
+			return
+		}
+		defer done()
 		s.handleCreation(w, r)
 	case http.MethodPost:
 		s.handlePostMetadata(w, r)
 	case http.MethodGet:
 		s.handleGet(w, r)
+	case http.MethodDelete:
+		s.handleDelete(w, r)
+	default:
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	}
+}
+
+// handleAccount handles requests on the account itself, only listing its
+// containers is supported.
+func (s *Server) handleAccount(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.handleListContainers(w, r)
+	case http.MethodHead:
+		s.handleAccountMetadata(w, r)
 	default:
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 	}
@@ -161,53 +394,58 @@ func (s *Server) storageHandler(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
 	target := getTarget(r)
-	if target != "System/Capabilities.json" && target != "System/Categories.json" {
-		logger.Error("Unauthorized attempt to access object: %s", target)
-		e := swift.Forbidden
-		http.Error(w, e.Text, e.StatusCode)
+	if container, object := splitTarget(target); object == "" {
+		s.handleListObjects(w, r, container)
 		return
 	}
-	data, err := os.ReadFile(filepath.Join(s.settings.StorageLocation, target))
-	if err != nil {
-		logger.Error(err)
-		if os.IsNotExist(err) {
-			e := swift.ObjectNotFound
-			http.Error(w, e.Text, e.StatusCode)
-			return
-		}
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	if !s.canDownload(target) {
+		logger.Errorf("Unauthorized attempt to access object: %s", target)
+		e := swift.Forbidden
+		http.Error(w, e.Text, e.StatusCode)
 		return
 	}
-	digest := md5.New()
-	digest.Write(data)
-	hash := digest.Sum(nil)
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Accept-Ranges", "bytes")
-	w.Header().Set("Etag", fmt.Sprintf("%x", hash))
-	_, err = w.Write(data)
+	s.handleDownload(w, r, target)
+}
+
+func (s *Server) readObject(target string) ([]byte, error) {
+	rc, err := s.backend.GetObject(target)
 	if err != nil {
-		logger.Error(err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil, err
 	}
+	defer rc.Close()
+	return io.ReadAll(rc)
 }
 
 func (s *Server) handleGetMetadata(w http.ResponseWriter, r *http.Request) {
 	target := getTarget(r)
+	_, object := splitTarget(target)
+	container := object == ""
+	if _, ok := r.URL.Query()["upload"]; ok && !container {
+		s.handleUploadStatus(w, r, target)
+		return
+	}
 
-	metaPath, container, err := s.getMetadataFilePath(target)
-	var meta map[string]string
+	meta, err := s.backend.LoadMetadata(target)
+	if err == nil && container {
+		var count, bytes int64
+		count, bytes, err = s.containerStats(target)
+		setContainerStats(w, count, bytes)
+	}
 	if err == nil {
-		meta, err = loadMetadata(metaPath)
-		if err == nil {
-			prefix := ObjectMeta
-			if container {
-				prefix = ContainerMeta
-			}
-			for k, v := range meta {
-				w.Header().Set(prefix+k, url.PathEscape(v))
-			}
+		if container {
+			setMetadataHeaders(w, ContainerMeta, meta)
 			return
 		}
+		setObjectMetadataHeaders(w, meta)
+		if isLargeObject(meta) {
+			segments, err := s.largeObjectSegments(target, meta)
+			if err != nil {
+				handleLargeObjectError(w, err)
+				return
+			}
+			w.Header().Set("Etag", largeObjectHash(segments))
+		}
+		return
 	}
 
 	logger.Error(err)
@@ -218,70 +456,76 @@ func (s *Server) handleGetMetadata(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, e.Text, e.StatusCode)
 }
 
-func (s *Server) getMetadataFilePath(carrier string) (string, bool, error) {
-	str := strings.Split(carrier, "/")
-	container := true
-	if len(str) > 2 {
-		return "", container, errors.New("subdirectories aren't supported")
+// setMetadataHeaders returns metadata as headers with the given prefix.
+func setMetadataHeaders(w http.ResponseWriter, prefix string, meta map[string]string) {
+	for k, v := range meta {
+		w.Header().Set(prefix+k, url.PathEscape(v))
+	}
+}
+
+// systemKeys are the object metadata keys set by the server itself. They are
+// returned in headers of their own instead of as X-Object-Meta- headers, and
+// can't be changed by clients.
+var systemKeys = []string{etagKey, sha256Key, manifestKey, sloKey, clientKey}
+
+// userMetadata returns a copy of meta without the system keys.
+func userMetadata(meta map[string]string) map[string]string {
+	user := map[string]string{}
+	for k, v := range meta {
+		user[k] = v
+	}
+	deleteMetaKeys(user, systemKeys...)
+	return user
+}
+
+// setObjectMetadataHeaders returns the metadata of an object as headers, with
+// the system keys in headers of their own.
+func setObjectMetadataHeaders(w http.ResponseWriter, meta map[string]string) {
+	if etag := metaValue(meta, etagKey); etag != "" {
+		w.Header().Set("Etag", etag)
 	}
-	name := filepath.Join(str[0], str[0])
-	if len(str) > 1 {
-		name = name + "." + str[1]
-		container = false
+	if sum := metaValue(meta, sha256Key); sum != "" {
+		w.Header().Set(Sha256Tag, sum)
 	}
-	name = name + ".metadata.json"
-	return filepath.Join(s.settings.StorageLocation, name), container, nil
+	if manifest := metaValue(meta, manifestKey); manifest != "" {
+		w.Header().Set(ManifestTag, manifest)
+	}
+	if isStaticLargeObject(meta) {
+		w.Header().Set(StaticLargeObjectTag, "True")
+	}
+	if client := metaValue(meta, clientKey); client != "" {
+		w.Header().Set(ClientCertificateTag, client)
+	}
+	setMetadataHeaders(w, ObjectMeta, userMetadata(meta))
 }
 
 func (s *Server) handleCreation(w http.ResponseWriter, r *http.Request) {
 	target := getTarget(r)
+	container, object := splitTarget(target)
 
-	created := true
-	switch len(strings.Split(target, "/")) {
-	case 1:
-
-		logger.Info("Creating Container " + target)
-		if _, err := os.Stat(filepath.Join(s.settings.StorageLocation, target)); os.IsNotExist(err) {
-			if err := os.Mkdir(filepath.Join(s.settings.StorageLocation, target), 0777); err != nil {
-				logger.Error(err)
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-				return
-			}
-			created = true
-		} else {
-			created = false
-		}
-
-	case 2:
-		fp, err := os.Create(filepath.Join(s.settings.StorageLocation, target))
-		if err != nil {
-			logger.Error(err)
-			if e, ok := err.(*os.PathError); ok && e.Err == syscall.ENOSPC {
-				http.Error(w, http.StatusText(http.StatusInsufficientStorage), http.StatusInsufficientStorage)
-			} else {
-				//The container doesn't exist.
-				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
-			}
-			return
-		}
-		defer fp.Close()
-		if _, err := io.Copy(fp, r.Body); err != nil {
-			logger.Error(err)
-			if e, ok := err.(*os.PathError); ok && e.Err == syscall.ENOSPC {
-				http.Error(w, http.StatusText(http.StatusInsufficientStorage), http.StatusInsufficientStorage)
-			} else {
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			}
-			return
+	if object != "" {
+		switch {
+		case r.URL.Query().Get("multipart-manifest") == "put":
+			s.handlePutManifest(w, r, target)
+		case r.Header.Get(UploadLengthTag) != "":
+			s.handleResumableUpload(w, r, target)
+		default:
+			s.putObject(w, r, target, r.Body, r.ContentLength)
 		}
-		created = true
-		logger.Info("Created: " + target + "\n")
+		return
+	}
 
-	default:
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	logger.Info("Creating Container " + target)
+	created, err := s.backend.CreateContainer(container)
+	if err != nil {
+		logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
-	if e := s.handlePutMetadata(r, target); e != nil {
+	if created {
+		s.audit(AuditEntry{Action: "container-created", Target: target, Remote: r.RemoteAddr, Client: clientIdentity(r)})
+	}
+	if e := s.handlePutMetadata(r, target, nil, nil); e != nil {
 		http.Error(w, e.Text, e.StatusCode)
 		return
 	}
@@ -292,56 +536,156 @@ func (s *Server) handleCreation(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *Server) handlePutMetadata(r *http.Request, carrier string) *swift.Error {
-	metaPath, container, err := s.getMetadataFilePath(carrier)
+// putObject stores body as the object target, together with the metadata of
+// the request and the checksums of body. The size of body is checked against
+// the quota before anything is stored, a negative size is unknown.
+func (s *Server) putObject(w http.ResponseWriter, r *http.Request, target string, body io.Reader, size int64) {
+	manifest := r.Header.Get(ManifestTag)
+	if manifest != "" && !validManifest(manifest) {
+		logger.Error("Invalid manifest: " + manifest)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	// The System objects are readable without AllowDownload, so they can't
+	// be large objects reading other containers
+	if manifest != "" && isSystemObject(target) {
+		logger.Error("System object can't be a large object: " + target)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	container, _ := splitTarget(target)
+	info, err := s.backend.Stat(container)
+	if err != nil && !isNotExist(err) {
+		logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if err != nil || !info.Container {
+		logger.Error("Container not found: " + container)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	// Nothing in a retained recording may be replaced, nor added to it
+	if err := s.checkRetention(container); err != nil {
+		retentionError(w, err)
+		return
+	}
+	// Storing the object replaces the metadata of the previous one, which
+	// the retention keys are kept from
+	replaced, _ := s.backend.LoadMetadata(target)
+	reservation, err := s.reserveQuota(target, size)
 	if err != nil {
+		quotaError(w, err)
+		return
+	}
+	defer reservation.release()
+	limited := &maxSizeReader{r: body, max: math.MaxInt64}
+	if quota := s.settings.Quota; quota != nil && quota.MaxObjectSize > 0 {
+		limited.max = quota.MaxObjectSize
+	}
+	checksum := newChecksumReader(limited)
+	if err := s.backend.PutObject(target, checksum, clientEtag(r)); err != nil {
 		logger.Error(err)
-		return swift.ContainerNotFound
+		switch {
+		case limited.exceeded:
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		case isNoSpace(err):
+			http.Error(w, http.StatusText(http.StatusInsufficientStorage), http.StatusInsufficientStorage)
+		case isNotExist(err):
+			//The container doesn't exist.
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		case isNameConflict(err):
+			http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+		case isChecksumMismatch(err):
+			// Nothing was stored, a previous object is left as it was
+			s.audit(AuditEntry{Action: "object-rejected", Target: target, Remote: r.RemoteAddr, Client: clientIdentity(r), Detail: "Etag mismatch"})
+			http.Error(w, http.StatusText(http.StatusUnprocessableEntity), http.StatusUnprocessableEntity)
+		default:
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+	reservation.commit(limited.read)
+	system := checksum.checksums()
+	s.audit(AuditEntry{Action: "object-created", Target: target, Remote: r.RemoteAddr, Client: clientIdentity(r), Detail: "sha256:" + system[sha256Key]})
+	logger.Info("Created: " + target + "\n")
+	w.Header().Set("Etag", system[etagKey])
+	if manifest != "" {
+		system[manifestKey] = manifest
 	}
+	if client := clientIdentity(r); client != "" {
+		system[clientKey] = client
+	}
+	if e := s.handlePutMetadata(r, target, system, replaced); e != nil {
+		http.Error(w, e.Text, e.StatusCode)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handlePutMetadata stores the metadata of a created container or object,
+// together with the system keys of an object. replaced is the metadata of
+// the object it replaced, if any.
+func (s *Server) handlePutMetadata(r *http.Request, carrier string, system, replaced map[string]string) *swift.Error {
+	container, object := splitTarget(carrier)
 	newMeta := parseMetadata(r)
-	if container {
-		oldMeta, err := loadMetadata(metaPath)
+	if object == "" {
+		// Legal holds are only changed through RootLegalHoldEndpoint
+		deleteMetaKeys(newMeta, legalHoldKey, legalHoldReasonKey, legalHoldTimeKey)
+		oldMeta, err := s.backend.LoadMetadata(carrier)
 		switch {
-		case errors.Is(err, os.ErrNotExist):
-			err2 := storeMetadata(metaPath, newMeta)
+		case isNotExist(err):
+			err2 := s.storeContainerMetadata(carrier, newMeta)
 			if err2 != nil {
 				logger.Error(err2)
 				return swift.ContainerNotFound
 			}
+			s.auditMetadata(r, carrier, changedKeys(nil, newMeta))
 			return nil
 		case err != nil:
+			// The unreadable metadata may hold a legal hold or the retention
+			// keys, so it's kept and backed up rather than replaced
 			logger.Error(err)
-			err = backupMetadata(metaPath)
+			err = s.backend.BackupMetadata(carrier)
 			if err != nil {
 				logger.Error("Failed to backup old meta data")
 				logger.Error(err)
 			}
-			storeMetadata(metaPath, newMeta)
-			return nil
+			return newError(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
 		}
-		updateMetadata(oldMeta, newMeta)
-		storeMetadata(metaPath, oldMeta)
+		s.keepRetentionKeys(carrier, oldMeta, newMeta)
+		keys := updateMetadata(oldMeta, newMeta)
+		s.storeContainerMetadata(carrier, oldMeta)
+		s.auditMetadata(r, carrier, keys)
 		return nil
 	} else {
-		if _, err := os.Stat(path.Dir(filepath.Join(s.settings.StorageLocation, carrier))); os.IsNotExist(err) {
+		if _, err := s.backend.Stat(container); isNotExist(err) {
 			logger.Error(err)
 			return swift.ObjectNotFound
 		}
-		if err := storeMetadata(metaPath, newMeta); err != nil {
+		deleteMetaKeys(newMeta, systemKeys...)
+		s.keepRetentionKeys(carrier, replaced, newMeta)
+		keys := changedKeys(nil, newMeta)
+		for k, v := range system {
+			newMeta[k] = v
+		}
+		if err := s.backend.StoreMetadata(carrier, newMeta); err != nil {
 			logger.Error(err)
-			if e, ok := err.(*os.PathError); ok && e.Err == syscall.ENOSPC {
+			if isNoSpace(err) {
 				return newError(507, "Insufficient Storage")
 			}
 			return swift.ObjectCorrupted
 
 		}
+		s.auditMetadata(r, carrier, keys)
 		return nil
 	}
 }
 
 // getTarget returns the relative filepath of the request's target file
 func getTarget(r *http.Request) string {
-	target := r.URL.Path[len(RootStorageEndpoint)+1:]
+	_, target, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, RootStoragePrefix), "/")
+	target = strings.TrimPrefix(target, "/")
 
 	// Windows doesn't accept ":" in filepaths, it needs to be escaped
 	target = strings.ReplaceAll(target, ":", "_")
@@ -351,82 +695,148 @@ func getTarget(r *http.Request) string {
 func (s *Server) handlePostMetadata(w http.ResponseWriter, r *http.Request) {
 	logger.Info("Got MetadataUpdate.")
 	target := getTarget(r)
+	_, object := splitTarget(target)
 
-	metafilename, container, err := s.getMetadataFilePath(target)
-
-	if err != nil {
-		logger.Error(err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
-
-	}
 	newMeta := parseMetadata(r)
-	if container {
-		oldMeta, err := loadMetadata(metafilename)
-		switch err {
-		case nil:
-			updateMetadata(oldMeta, newMeta)
-			storeMetadata(metafilename, oldMeta)
+	if object == "" {
+		// Legal holds are only changed through RootLegalHoldEndpoint
+		deleteMetaKeys(newMeta, legalHoldKey, legalHoldReasonKey, legalHoldTimeKey)
+		oldMeta, err := s.backend.LoadMetadata(target)
+		switch {
+		case err == nil:
+			s.keepRetentionKeys(target, oldMeta, newMeta)
+			keys := updateMetadata(oldMeta, newMeta)
+			s.storeContainerMetadata(target, oldMeta)
+			s.auditMetadata(r, target, keys)
+		case isNotExist(err):
+			err2 := s.storeContainerMetadata(target, newMeta)
+			if err2 != nil {
+				logger.Error(err2)
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			logger.Error(err)
+			s.auditMetadata(r, target, changedKeys(nil, newMeta))
 		default:
-			switch err.(type) {
-			case *os.PathError:
-				err2 := storeMetadata(metafilename, newMeta)
-				if err2 != nil {
-					logger.Error(err2)
-					http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
-					return
-				}
-				logger.Error(err)
-			default:
+			logger.Error(err)
+			err = s.backend.BackupMetadata(target)
+			if err != nil {
+				logger.Error("Failed to backup metadata")
 				logger.Error(err)
-				err = backupMetadata(metafilename)
-				if err != nil {
-					logger.Error("Failed to backup metadata")
-					logger.Error(err)
-				}
-				storeMetadata(metafilename, newMeta)
 			}
+			s.storeContainerMetadata(target, newMeta)
+			s.auditMetadata(r, target, changedKeys(nil, newMeta))
 		}
 		if newMeta["Status"] == "Complete" {
-			_, err = os.Create(filepath.Join(s.settings.StorageLocation, target, "complete"))
+			s.audit(AuditEntry{Action: "recording-completed", Target: target, Remote: r.RemoteAddr})
+			_, statErr := s.backend.Stat(target + "/complete")
+			err = s.backend.PutObject(target+"/complete", http.NoBody, "")
 			if err != nil {
 				logger.Error("Failed to create a complete file")
 				logger.Error(err)
+			} else if isNotExist(statErr) {
+				s.usage.mu.Lock()
+				s.addUsage(target, 1, 0)
+				s.usage.mu.Unlock()
 			}
 
 		}
 		w.WriteHeader(http.StatusNoContent)
 	} else {
-		if _, err := os.Stat(filepath.Join(s.settings.StorageLocation, target)); os.IsNotExist(err) {
+		if _, err := s.backend.Stat(target); isNotExist(err) {
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 			logger.Error(err)
 			return
 		}
-		if err := storeMetadata(metafilename, newMeta); err != nil {
+		// The system keys set on upload survive metadata updates
+		oldMeta, _ := s.backend.LoadMetadata(target)
+		deleteMetaKeys(newMeta, systemKeys...)
+		s.keepRetentionKeys(target, oldMeta, newMeta)
+		keys := changedKeys(userMetadata(oldMeta), newMeta)
+		for _, k := range systemKeys {
+			if v := metaValue(oldMeta, k); v != "" {
+				newMeta[k] = v
+			}
+		}
+		if err := s.backend.StoreMetadata(target, newMeta); err != nil {
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		} else {
+			s.auditMetadata(r, target, keys)
 			w.WriteHeader(http.StatusAccepted)
 		}
 	}
 }
 
+// handleDelete deletes an object or an empty container, unless the recording
+// is retained.
+func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
+	target := getTarget(r)
+	container, object := splitTarget(target)
+	if _, ok := r.URL.Query()["upload"]; ok && object != "" {
+		s.handleUploadAbort(w, r, target)
+		return
+	}
+
+	info, err := s.backend.Stat(target)
+	if err != nil && !isNotExist(err) {
+		logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	// Directories of nested object names on the file backend aren't objects
+	if err != nil || (object != "" && info.Container) {
+		logger.Error("Nothing to delete: " + target)
+		e := swift.ObjectNotFound
+		if object == "" {
+			e = swift.ContainerNotFound
+		}
+		http.Error(w, e.Text, e.StatusCode)
+		return
+	}
+
+	if err := s.checkRetention(container); err != nil {
+		retentionError(w, err)
+		return
+	}
+	if object != "" && r.URL.Query().Get("multipart-manifest") == "delete" {
+		if err := s.deleteSegments(r, target); err != nil {
+			retentionError(w, err)
+			return
+		}
+	}
+	if object == "" {
+		objects, err := s.backend.List(container)
+		if err != nil {
+			logger.Error(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if len(objects) > 0 {
+			logger.Error("Container not empty: " + container)
+			e := swift.ContainerNotEmpty
+			http.Error(w, e.Text, e.StatusCode)
+			return
+		}
+	}
+
+	logger.Info("Deleting " + target)
+	if err := s.deleteTarget(target); err != nil {
+		logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	s.audit(AuditEntry{Action: "deleted", Target: target, Remote: r.RemoteAddr})
+	w.WriteHeader(http.StatusNoContent)
+}
+
 // TODO maybe make sure that there can be multiple backupfiles
 func backupMetadata(metadatapath string) error {
-	fp, err := os.Create(metadatapath + ".bac")
-	if err != nil {
-		return err
-	}
-	defer fp.Close()
 	f, err := os.Open(metadatapath)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	if _, err := io.Copy(fp, f); err != nil {
-		return err
-	}
-	return nil
-
+	return writeFileAtomic(metadatapath+".bac", f)
 }
 
 func URLDecode(s string) string {
@@ -465,14 +875,34 @@ func loadMetadata(filename string) (map[string]string, error) {
 	return result, err
 }
 
-func updateMetadata(oldMeta, newMeta map[string]string) {
+// updateMetadata merges newMeta into oldMeta, where empty values delete keys.
+// It returns the sorted keys that changed.
+func updateMetadata(oldMeta, newMeta map[string]string) []string {
+	changed := []string{}
 	for k, v := range newMeta {
+		old, ok := oldMeta[k]
 		if v != "" {
+			if !ok || old != v {
+				changed = append(changed, k)
+			}
 			oldMeta[k] = v
 		} else {
+			if ok {
+				changed = append(changed, k)
+			}
 			delete(oldMeta, k)
 		}
 	}
+	sort.Strings(changed)
+	return changed
+}
+
+// auditMetadata records the metadata keys of target changed by r.
+func (s *Server) auditMetadata(r *http.Request, target string, keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	s.audit(AuditEntry{Action: "metadata-updated", Target: target, Remote: r.RemoteAddr, Keys: keys})
 }
 
 func storeMetadata(name string, metadata map[string]string) error {
@@ -480,42 +910,62 @@ func storeMetadata(name string, metadata map[string]string) error {
 	if err != nil {
 		logger.Error(err)
 		return err
-	} else {
-		f, err := os.Create(name)
-		if err != nil {
-			logger.Error(err)
-			return err
-		}
-		defer f.Close()
-		if _, err := f.Write(jsonString); err != nil {
-			logger.Error(err)
-			return err
-		}
+	} else if err := writeFileAtomic(name, bytes.NewReader(jsonString)); err != nil {
+		logger.Error(err)
+		return err
 	}
 	return nil
 }
 
-func auth(inputUser, inputPwd, storedUser string, storedPass, tokenSecret []byte) (string, error) {
+func auth(inputUser, inputPwd, storedUser string, storedPass []byte) error {
 
 	if inputUser != storedUser {
-		return "", errors.New("access denied, you don't have permission to access this server")
+		return errors.New("access denied, you don't have permission to access this server")
 	}
 
 	err := bcrypt.CompareHashAndPassword(storedPass, []byte(inputPwd))
 	if err != nil {
-		return "", errors.New("access denied, you don't have permission to access this server")
+		return errors.New("access denied, you don't have permission to access this server")
 	}
+	return nil
+}
 
-	return createToken(tokenSecret)
+// tokenLifetime returns how long the tokens of the server are valid.
+func (s *Server) tokenLifetime() time.Duration {
+	if s.settings.TokenLifetimeMinutes > 0 {
+		return time.Duration(s.settings.TokenLifetimeMinutes) * time.Minute
+	}
+	return defaultTokenLifetime
 }
 
 // createToken generates a JWT token. It does not have to be JWT. It could be
 // anything representable as a string.
 func createToken(tokenSecret []byte) (string, error) {
+	return createAccountToken(tokenSecret, defaultTokenLifetime, "", "")
+}
+
+// createAccountToken returns a token for username of account, the subject
+// and audience of the token. Tokens of the default account have no audience.
+// Every token has a unique ID, so it can be revoked on its own.
+func createAccountToken(tokenSecret []byte, lifetime time.Duration, username, account string) (string, error) {
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
 
 	// Create claims
-	claims := &jwt.StandardClaims{
-		ExpiresAt: time.Now().Add(time.Minute * 15).Unix(),
+	now := time.Now()
+	claims := &tokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        hex.EncodeToString(id),
+			Issuer:    tokenIssuer,
+			Subject:   username,
+			Audience:  account,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(lifetime).Unix(),
+		},
+		IssuedAtNano: now.UnixNano(),
 	}
 
 	// Create token
@@ -529,14 +979,33 @@ func createToken(tokenSecret []byte) (string, error) {
 	return tokenString, nil
 }
 
-func verifyToken(tokenString []string, tokenSecret []byte) error {
+// tokenClaims are the claims of the tokens of the service. IssuedAtNano is
+// when the token was issued in nanoseconds, IssuedAt only has seconds, so a
+// token issued right after the tokens of its user were revoked stays valid.
+type tokenClaims struct {
+	jwt.StandardClaims
+	IssuedAtNano int64 `json:"iat_ns,omitempty"`
+}
+
+// issuedAt returns when the token was issued in nanoseconds. Tokens without
+// IssuedAtNano are taken as issued at the start of their second, so they are
+// revoked with the tokens of that second.
+func (c *tokenClaims) issuedAt() int64 {
+	if c.IssuedAtNano != 0 {
+		return c.IssuedAtNano
+	}
+	return c.IssuedAt * int64(time.Second)
+}
+
+// parseToken verifies a token and returns its claims.
+func parseToken(tokenString []string, tokenSecret []byte) (*tokenClaims, error) {
 
 	if len(tokenString) == 0 {
-		return errors.New("cannot verify empty token")
+		return nil, errors.New("cannot verify empty token")
 	}
 
 	// Parse token
-	token, err := jwt.ParseWithClaims(tokenString[0], &jwt.StandardClaims{}, func(token *jwt.Token) (interface{}, error) {
+	token, err := jwt.ParseWithClaims(tokenString[0], &tokenClaims{}, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
@@ -544,52 +1013,101 @@ func verifyToken(tokenString []string, tokenSecret []byte) error {
 		return tokenSecret, nil
 	})
 	if err != nil {
-		return fmt.Errorf("failed to parse Token: %v", err)
+		return nil, fmt.Errorf("failed to parse Token: %v", err)
 	}
 
 	// Validate token
 	// For a token to be valid it has to be signed by tokenSecret and not yet
 	// having reached its expiry time (as per StandardClaims.ExpiresAt).
-	if _, ok := token.Claims.(*jwt.StandardClaims); ok && token.Valid {
-		return nil
+	if claims, ok := token.Claims.(*tokenClaims); ok && token.Valid && claims.VerifyIssuer(tokenIssuer, true) {
+		return claims, nil
+	}
+	return nil, errors.New("failed to validate token")
+}
+
+// verifyToken verifies a token and returns its claims, unless the token has
+// been revoked.
+func (s *Server) verifyToken(tokenString []string) (*tokenClaims, error) {
+	_, tokenSecret, previous := s.credentials()
+	claims, err := parseToken(tokenString, tokenSecret)
+	if err != nil && previous != nil {
+		claims, err = parseToken(tokenString, previous.TokenSecret)
+	}
+	if err != nil {
+		return nil, err
 	}
-	return errors.New("failed to validate token")
+	if s.revoked != nil {
+		if err := s.revoked.check(claims); err != nil {
+			return nil, err
+		}
+	}
+	return claims, nil
 }
 
-func startHTTPSServer(settingsPath, ip, port string, index int, handler http.Handler) {
-	logger.Info("Server listens on " + ip + ":" + port + "...")
-	err := http.ListenAndServeTLS(ip+":"+port,
-		filepath.Join(settingsPath, buildCertName(index)),
-		filepath.Join(settingsPath, buildKeyName(index)),
-		handler)
+func startHTTPSServer(ip, port string, handler http.Handler, config *tls.Config) {
+	addr := net.JoinHostPort(ip, port)
+	logger.Info("Server listens on " + addr + "...")
+	server := &http.Server{Addr: addr, Handler: handler, TLSConfig: config}
+	// The certificate is served by config.GetCertificate
+	err := server.ListenAndServeTLS("", "")
 
 	if err != nil {
-		logger.Error("Failed to start server on " + ip + ":" + port + ", " + err.Error())
+		logger.Error("Failed to start server on " + addr + ", " + err.Error())
 	}
 }
 
 func startHTTPServer(ip, port string, handler http.Handler) {
-	logger.Info("Server listens on " + ip + ":" + port + "...")
-	err := http.ListenAndServe(ip+":"+port, handler)
+	addr := net.JoinHostPort(ip, port)
+	logger.Info("Server listens on " + addr + "...")
+	err := http.ListenAndServe(addr, handler)
 
 	if err != nil {
-		logger.Error("Failed to start server on " + ip + ":" + port + ", " + err.Error())
+		logger.Error("Failed to start server on " + addr + ", " + err.Error())
 	}
 
 }
 
 func (s *Server) Run(exit chan struct{}) {
 
+	// Nothing is uploading yet, so every temporary file was abandoned
+	for _, srv := range s.servers() {
+		if b, ok := srv.backend.(*FileBackend); ok {
+			if n, err := b.RemoveTempFiles(); err != nil {
+				logger.Errorf("Failed to remove temporary files: %v", err)
+			} else if n > 0 {
+				logger.Infof("Removed %d abandoned temporary files", n)
+			}
+		}
+	}
+	for _, srv := range s.servers() {
+		if n, err := srv.removeExpiredUploads(); err != nil {
+			logger.Errorf("Failed to remove expired uploads: %v", err)
+		} else if n > 0 {
+			logger.Infof("Removed %d expired partial uploads", n)
+		}
+	}
 	http.HandleFunc(RootAuthEndpoint, s.authentication)
-	http.HandleFunc(RootStorageEndpoint+"/", s.storageHandler)
+	http.HandleFunc(KeystoneAuthEndpoint, s.keystoneAuthentication)
+	http.HandleFunc(RootStoragePrefix, s.storageHandler)
+	http.HandleFunc(RootLegalHoldEndpoint+"/", s.legalHoldHandler)
 
 	handler := logRequestResponse(returnStatusFromEnv(http.DefaultServeMux))
 
 	if s.settings.UseHttps {
 		s.scheme = "https://"
+		config, err := s.tlsConfig()
+		if err != nil {
+			logger.Error("Failed to start https servers: " + err.Error())
+			return
+		}
+		certs := newCertManager(s.settingsPath, *s.settings)
+		certs.check(time.Now())
 		for i, ip := range s.settings.IPs {
-			go startHTTPSServer(s.settingsPath, ip, s.settings.Port, i, handler)
+			config := config.Clone()
+			config.GetCertificate = certs.getCertificate(i)
+			go startHTTPSServer(ip, s.settings.Port, handler, config)
 		}
+		go certs.runCertificateMonitor(exit)
 	} else {
 		s.scheme = "http://"
 
@@ -597,5 +1115,13 @@ func (s *Server) Run(exit chan struct{}) {
 			go startHTTPServer(ip, s.settings.Port, handler)
 		}
 	}
+	if s.settings.Retention != nil && !s.settings.Retention.KeepExpired {
+		for _, srv := range s.servers() {
+			go srv.runSweeper(exit)
+		}
+	}
+	if s.throttle != nil && s.throttle.settings.HighWatermark > 0 && len(s.storageLocations()) > 0 {
+		go s.runDiskMonitor(exit)
+	}
 	<-exit
 }
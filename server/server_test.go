@@ -12,9 +12,12 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/google/uuid"
+	"github.com/ncw/swift/v2/swifttest"
 )
 
 var (
@@ -23,85 +26,76 @@ var (
 
 // Check correct status is returned when doing a bad request
 func TestBadRequest(t *testing.T) {
-	// PATCH is unsupported and should trigger bad request.
-	req, err := http.NewRequest("PATCH", "/v1.0/abc/test/test.txt", nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-	token, err := createToken(tokenSecret)
-	if err != nil {
-		t.Errorf("failed generating token while setting up test %v", err)
-	}
-	req.Header.Add("X-Auth-Token", token)
-	req.Header.Add("X-Object-Meta-Test", "testObjectData")
-	rr := httptest.NewRecorder()
-	storageLocation, cleanUp := getStorageLocation(t)
-	defer cleanUp()
-	s := &Server{
-		settings: &Settings{StorageLocation: storageLocation, TokenSecret: tokenSecret},
-	}
-	s.storageHandler(rr, req)
-	if rr.Code != http.StatusBadRequest {
-		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
-	}
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		// PATCH is unsupported and should trigger bad request.
+		req, err := http.NewRequest("PATCH", "/v1.0/abc/test/test.txt", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := createToken(tokenSecret)
+		if err != nil {
+			t.Errorf("failed generating token while setting up test %v", err)
+		}
+		req.Header.Add("X-Auth-Token", token)
+		req.Header.Add("X-Object-Meta-Test", "testObjectData")
+		rr := httptest.NewRecorder()
+		s.storageHandler(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+		}
+	})
 }
 
 // Check GETing resources is forbidden
 func TestGETAccessDenied(t *testing.T) {
-	storageLocation, cleanUp := getStorageLocation(t)
-	defer cleanUp()
-	s := &Server{
-		settings: &Settings{StorageLocation: storageLocation, TokenSecret: tokenSecret},
-	}
-	token, err := createToken(tokenSecret)
-	if err != nil {
-		t.Errorf("failed generating token while setting up test %v", err)
-	}
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		token, err := createToken(tokenSecret)
+		if err != nil {
+			t.Errorf("failed generating token while setting up test %v", err)
+		}
 
-	// GETing resource that is allowed does not return 403, indicating our token is valid.
-	req, err := http.NewRequest("GET", "/v1.0/abc/System/Capabilities.json", nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-	req.Header.Add("X-Auth-Token", token)
-	req.Header.Add("X-Object-Meta-Test", "testObjectData")
-	rr := httptest.NewRecorder()
-	s.storageHandler(rr, req)
-	if rr.Result().StatusCode != http.StatusNotFound {
-		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
-	}
+		// GETing resource that is allowed does not return 403, indicating our token is valid.
+		req, err := http.NewRequest("GET", "/v1.0/abc/System/Capabilities.json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("X-Auth-Token", token)
+		req.Header.Add("X-Object-Meta-Test", "testObjectData")
+		rr := httptest.NewRecorder()
+		s.storageHandler(rr, req)
+		if rr.Result().StatusCode != http.StatusNotFound {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+		}
 
-	// GETing any other resource returns 403.
-	req, err = http.NewRequest("GET", "/v1.0/abc/Container/somefile", nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-	req.Header.Add("X-Auth-Token", token)
-	req.Header.Add("X-Object-Meta-Test", "testObjectData")
-	rr = httptest.NewRecorder()
-	s.storageHandler(rr, req)
-	if rr.Result().StatusCode != http.StatusForbidden {
-		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized)
-	}
+		// GETing any other resource returns 403.
+		req, err = http.NewRequest("GET", "/v1.0/abc/Container/somefile", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("X-Auth-Token", token)
+		req.Header.Add("X-Object-Meta-Test", "testObjectData")
+		rr = httptest.NewRecorder()
+		s.storageHandler(rr, req)
+		if rr.Result().StatusCode != http.StatusForbidden {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized)
+		}
+	})
 }
 
 // Check that it's not possible to do any put request without a token
 func TestCallWithoutToken(t *testing.T) {
-	req, err := http.NewRequest("PUT", "/v1.0/abc/test", nil)
-	if err != nil {
-		t.Fatal(err)
-	}
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		req, err := http.NewRequest("PUT", "/v1.0/abc/test", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	rr := httptest.NewRecorder()
-	storageLocation, cleanUp := getStorageLocation(t)
-	defer cleanUp()
-	s := &Server{
-		settings: &Settings{StorageLocation: storageLocation, TokenSecret: tokenSecret},
-	}
-	s.storageHandler(rr, req)
-	if rr.Code != http.StatusUnauthorized {
-		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized)
-	}
+		rr := httptest.NewRecorder()
+		s.storageHandler(rr, req)
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized)
+		}
+	})
 }
 
 // Check that it's not possible to authenticate without credentials
@@ -205,70 +199,63 @@ func TestBadRequestToAuthenticationEndpoint(t *testing.T) {
 
 // Check that a container is made, that correct response is sent back and that the meta is correctly updated
 func TestCreateContainer(t *testing.T) {
-	storageLocation, cleanUp := getStorageLocation(t)
-	defer cleanUp()
-	metadata := map[string]string{"Test-Container": "test"}
-	s := &Server{
-		settings: &Settings{StorageLocation: storageLocation, TokenSecret: tokenSecret},
-	}
-	status := createContainer(t, metadata, s)
-	if status != http.StatusCreated {
-		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
-	}
-	matchMeta(t, storageLocation+"/test/test.metadata.json", metadata)
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		metadata := map[string]string{"Test-Container": "test"}
+		status := createContainer(t, metadata, s)
+		if status != http.StatusCreated {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+		}
+		matchMeta(t, s, "test", metadata)
+	})
 }
 
 // Check that the response code is correct after making a duplicate container, check that the metadata is
 // updated and not overwritten
 func TestCreateDuplicateContainer(t *testing.T) {
-	storageLocation, cleanUp := getStorageLocation(t)
-	defer cleanUp()
-	metadata := map[string]string{"Test-Container": "test"}
-	s := &Server{settings: &Settings{StorageLocation: storageLocation, TokenSecret: tokenSecret}}
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		metadata := map[string]string{"Test-Container": "test"}
 
-	resp1 := createContainer(t, metadata, s)
-	if resp1 != http.StatusCreated {
-		t.Errorf("Error expected %v but got %v when creating a container", http.StatusCreated, resp1)
-	}
-	matchMeta(t, storageLocation+"/test/test.metadata.json", metadata)
-	metadata = map[string]string{"Test-Update-Container": "updateTest"}
+		resp1 := createContainer(t, metadata, s)
+		if resp1 != http.StatusCreated {
+			t.Errorf("Error expected %v but got %v when creating a container", http.StatusCreated, resp1)
+		}
+		matchMeta(t, s, "test", metadata)
+		metadata = map[string]string{"Test-Update-Container": "updateTest"}
 
-	resp1 = createContainer(t, metadata, s)
-	if resp1 != http.StatusAccepted {
-		t.Errorf("Error expected %v but got %v when creating a container", http.StatusAccepted, resp1)
-	}
-	metadata = map[string]string{"Test-Update-Container": "updateTest", "Test-Container": "test"}
+		resp1 = createContainer(t, metadata, s)
+		if resp1 != http.StatusAccepted {
+			t.Errorf("Error expected %v but got %v when creating a container", http.StatusAccepted, resp1)
+		}
+		metadata = map[string]string{"Test-Update-Container": "updateTest", "Test-Container": "test"}
 
-	matchMeta(t, storageLocation+"/test/test.metadata.json", metadata)
+		matchMeta(t, s, "test", metadata)
+	})
 }
 
 // Check that the response code is correct after making a duplicate container, check that metadata can be deleted
 // by sending empty values
 func TestDeleteContainerMetadataField(t *testing.T) {
-	storageLocation, cleanUp := getStorageLocation(t)
-	defer cleanUp()
-	metadata := map[string]string{"Test-Container": "test", "Test-Delete-Me": "deleteme"}
-	s := &Server{
-		settings: &Settings{StorageLocation: storageLocation, TokenSecret: tokenSecret},
-	}
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		metadata := map[string]string{"Test-Container": "test", "Test-Delete-Me": "deleteme"}
 
-	resp1 := createContainer(t, metadata, s)
-	if resp1 != http.StatusCreated {
-		t.Errorf("Error expected %v but got %v when creating a container", http.StatusCreated, resp1)
-	}
-	matchMeta(t, storageLocation+"/test/test.metadata.json", metadata)
-	metadata = map[string]string{"Test-Update-Container": "updateTest", "Test-Delete-Me": ""}
+		resp1 := createContainer(t, metadata, s)
+		if resp1 != http.StatusCreated {
+			t.Errorf("Error expected %v but got %v when creating a container", http.StatusCreated, resp1)
+		}
+		matchMeta(t, s, "test", metadata)
+		metadata = map[string]string{"Test-Update-Container": "updateTest", "Test-Delete-Me": ""}
 
-	resp1 = createContainer(t, metadata, s)
-	if resp1 != http.StatusAccepted {
-		t.Errorf("Error expected %v but got %v when creating a container", http.StatusAccepted, resp1)
-	}
-	metadata = map[string]string{"Test-Update-Container": "updateTest", "Test-Container": "test"}
+		resp1 = createContainer(t, metadata, s)
+		if resp1 != http.StatusAccepted {
+			t.Errorf("Error expected %v but got %v when creating a container", http.StatusAccepted, resp1)
+		}
+		metadata = map[string]string{"Test-Update-Container": "updateTest", "Test-Container": "test"}
 
-	matchMeta(t, storageLocation+"/test/test.metadata.json", metadata)
+		matchMeta(t, s, "test", metadata)
+	})
 }
 
-// Check post to corrupted meta
+// Check put to corrupted meta
 func TestPutToCorruptContainer(t *testing.T) {
 	//create a corrupted json file
 	storageLocation, cleanUp := getStorageLocation(t)
@@ -285,13 +272,17 @@ func TestPutToCorruptContainer(t *testing.T) {
 	metadata := map[string]string{"Test-Container2": "meta3", "Test-Container3": "meta4"}
 	s := &Server{
 		settings: &Settings{StorageLocation: storageLocation, TokenSecret: tokenSecret},
+		backend:  NewFileBackend(storageLocation),
 	}
+	// The unreadable metadata could hold a legal hold, so it isn't replaced
 	resp1 := createContainer(t, metadata, s)
-	if resp1 != http.StatusAccepted {
-		t.Errorf("Error expected %v but got %v when posting to a container", http.StatusAccepted, resp1)
+	if resp1 != http.StatusInternalServerError {
+		t.Errorf("Error expected %v but got %v when putting to a container", http.StatusInternalServerError, resp1)
+	}
+	if data, err := os.ReadFile(storageLocation + "/test/test.metadata.json"); err != nil || string(data) != string(d1) {
+		t.Errorf("corrupt metadata was replaced: %q %v", data, err)
 	}
 
-	matchMeta(t, storageLocation+"/test/test.metadata.json", metadata)
 	jsonFile, err := os.Open(storageLocation + "/test/test.metadata.json.bac")
 	if err != nil {
 		t.Fatal(err)
@@ -311,72 +302,63 @@ func TestPutToCorruptContainer(t *testing.T) {
 // Test that post to objects returns correct response codes
 // Test that meta data gets correctly overwritten
 func TestPostToObject(t *testing.T) {
-	storageLocation, cleanUp := getStorageLocation(t)
-	defer cleanUp()
-	metadata := map[string]string{"Test-Container": "test"}
-	s := &Server{
-		settings: &Settings{StorageLocation: storageLocation, TokenSecret: tokenSecret},
-	}
-	resp1 := createContainer(t, metadata, s)
-	if resp1 != http.StatusCreated {
-		t.Errorf("Error expected %v but got %v when creating a container", http.StatusCreated, resp1)
-	}
-	resp1 = createObject(t, s)
-	if resp1 != http.StatusCreated {
-		t.Errorf("Error expected %v but got %v when creating an object", http.StatusCreated, resp1)
-	}
-	metadata = map[string]string{"Test": "meta1", "Test2": "meta2", "Test3": "meta3"}
-	resp1 = postToObject("test.txt", metadata, t, s)
-	if resp1 != http.StatusAccepted {
-		t.Errorf("Error expected %v but got %v when posting to an object", http.StatusAccepted, resp1)
-	}
-	matchMeta(t, storageLocation+"/test/test.test.txt.metadata.json", metadata)
-	metadata = map[string]string{"Test4": "meta4", "Test5": "meta5"}
-	resp1 = postToObject("test.txt", metadata, t, s)
-	if resp1 != http.StatusAccepted {
-		t.Errorf("Error expected %v but got %v when posting to an object", http.StatusAccepted, resp1)
-	}
-	//check that data is overwritten and not updated.
-	matchMeta(t, storageLocation+"/test/test.test.txt.metadata.json", metadata)
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		metadata := map[string]string{"Test-Container": "test"}
+		resp1 := createContainer(t, metadata, s)
+		if resp1 != http.StatusCreated {
+			t.Errorf("Error expected %v but got %v when creating a container", http.StatusCreated, resp1)
+		}
+		resp1 = createObject(t, s)
+		if resp1 != http.StatusCreated {
+			t.Errorf("Error expected %v but got %v when creating an object", http.StatusCreated, resp1)
+		}
+		metadata = map[string]string{"Test": "meta1", "Test2": "meta2", "Test3": "meta3"}
+		resp1 = postToObject("test.txt", metadata, t, s)
+		if resp1 != http.StatusAccepted {
+			t.Errorf("Error expected %v but got %v when posting to an object", http.StatusAccepted, resp1)
+		}
+		matchMeta(t, s, "test/test.txt", metadata)
+		metadata = map[string]string{"Test4": "meta4", "Test5": "meta5"}
+		resp1 = postToObject("test.txt", metadata, t, s)
+		if resp1 != http.StatusAccepted {
+			t.Errorf("Error expected %v but got %v when posting to an object", http.StatusAccepted, resp1)
+		}
+		//check that data is overwritten and not updated.
+		matchMeta(t, s, "test/test.txt", metadata)
+	})
 }
 
 // Check that the response code is correct
 func TestPostToEmptyContainer(t *testing.T) {
-	storageLocation, cleanUp := getStorageLocation(t)
-	defer cleanUp()
-	metadata := map[string]string{"test": "meta1"}
-	s := &Server{
-		settings: &Settings{StorageLocation: storageLocation, TokenSecret: tokenSecret},
-	}
-	resp1 := postToContainer(metadata, t, s)
-	//check response code
-	if resp1 != http.StatusNotFound {
-		t.Errorf("Error expected %v but got %v when posting to a container that doesn't exist", http.StatusNotFound, resp1)
-	}
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		metadata := map[string]string{"test": "meta1"}
+		resp1 := postToContainer(metadata, t, s)
+		//check response code
+		if resp1 != http.StatusNotFound {
+			t.Errorf("Error expected %v but got %v when posting to a container that doesn't exist", http.StatusNotFound, resp1)
+		}
+	})
 }
 
 // Check that the response codes are correct
 // Check that the meta data is updated
 func TestPostToContainer(t *testing.T) {
-	storageLocation, cleanUp := getStorageLocation(t)
-	defer cleanUp()
-	metadata := map[string]string{"Test-Container": "test", "Test-Container2": "test2"}
-	s := &Server{
-		settings: &Settings{StorageLocation: storageLocation, TokenSecret: tokenSecret},
-	}
-	resp1 := createContainer(t, metadata, s)
-	if resp1 != http.StatusCreated {
-		t.Errorf("Error expected %v but got %v when creating a container", http.StatusCreated, resp1)
-	}
-	matchMeta(t, storageLocation+"/test/test.metadata.json", metadata)
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		metadata := map[string]string{"Test-Container": "test", "Test-Container2": "test2"}
+		resp1 := createContainer(t, metadata, s)
+		if resp1 != http.StatusCreated {
+			t.Errorf("Error expected %v but got %v when creating a container", http.StatusCreated, resp1)
+		}
+		matchMeta(t, s, "test", metadata)
 
-	metadata = map[string]string{"Test-Container2": "meta3", "Test-Container3": "meta4"}
-	resp1 = postToContainer(metadata, t, s)
-	if resp1 != http.StatusNoContent {
-		t.Errorf("Error expected %v but got %v when posting to a container", http.StatusNoContent, resp1)
-	}
-	metadata = map[string]string{"Test-Container": "test", "Test-Container2": "meta3", "Test-Container3": "meta4"}
-	matchMeta(t, storageLocation+"/test/test.metadata.json", metadata)
+		metadata = map[string]string{"Test-Container2": "meta3", "Test-Container3": "meta4"}
+		resp1 = postToContainer(metadata, t, s)
+		if resp1 != http.StatusNoContent {
+			t.Errorf("Error expected %v but got %v when posting to a container", http.StatusNoContent, resp1)
+		}
+		metadata = map[string]string{"Test-Container": "test", "Test-Container2": "meta3", "Test-Container3": "meta4"}
+		matchMeta(t, s, "test", metadata)
+	})
 }
 
 // Check post to corrupted meta
@@ -396,13 +378,14 @@ func TestPostToCorruptContainer(t *testing.T) {
 	metadata := map[string]string{"Test-Container2": "meta3", "Test-Container3": "meta4"}
 	s := &Server{
 		settings: &Settings{StorageLocation: storageLocation, TokenSecret: tokenSecret},
+		backend:  NewFileBackend(storageLocation),
 	}
 	resp1 := postToContainer(metadata, t, s)
 	if resp1 != http.StatusNoContent {
 		t.Errorf("Error expected %v but got %v when posting to a container", http.StatusNoContent, resp1)
 	}
 
-	matchMeta(t, storageLocation+"/test/test.metadata.json", metadata)
+	matchMeta(t, s, "test", metadata)
 	jsonFile, err := os.Open(storageLocation + "/test/test.metadata.json.bac")
 	if err != nil {
 		t.Fatal(err)
@@ -421,215 +404,321 @@ func TestPostToCorruptContainer(t *testing.T) {
 
 // Check that the correct response is sent when trying to put an object to a non existing container
 func TestPutObjectToNonExistingContainer(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		resp1 := createObject(t, s)
+		if resp1 != http.StatusNotFound {
+			t.Errorf("Error expected %v but got %v when using put to an empty container", http.StatusNotFound, resp1)
+		}
+	})
+}
+
+// Check that a file in the storage location isn't taken for a container
+func TestPutObjectToFile(t *testing.T) {
 	storageLocation, cleanUp := getStorageLocation(t)
 	defer cleanUp()
 	s := &Server{
 		settings: &Settings{StorageLocation: storageLocation, TokenSecret: tokenSecret},
+		backend:  NewFileBackend(storageLocation),
+	}
+	if err := os.WriteFile(filepath.Join(storageLocation, connectionFilename), []byte("{}"), 0666); err != nil {
+		t.Fatal(err)
 	}
-	resp1 := createObject(t, s)
-	if resp1 != http.StatusNotFound {
-		t.Errorf("Error expected %v but got %v when using put to an empty container", http.StatusNotFound, resp1)
+	rr := storageRequest(t, s, "PUT", "/v1.0/abc/"+connectionFilename+"/test.txt", strings.NewReader("data"), nil)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Error expected %v but got %v when using put to a file", http.StatusNotFound, rr.Code)
 	}
 }
 
 // Check that correct response is sent when trying to post to an object that doesn't exists
 func TestPostToEmptyObject(t *testing.T) {
-	storageLocation, cleanUp := getStorageLocation(t)
-	defer cleanUp()
-	metadata := map[string]string{"Test-Container": "test"}
-	s := &Server{
-		settings: &Settings{StorageLocation: storageLocation, TokenSecret: tokenSecret},
-	}
-	resp1 := createContainer(t, metadata, s)
-	if resp1 != http.StatusCreated {
-		t.Errorf("Error expected %v but got %v when creating a container", http.StatusCreated, resp1)
-	}
-	matchMeta(t, storageLocation+"/test/test.metadata.json", metadata)
-	metadata = map[string]string{"test": "meta1"}
-	resp1 = postToObject("hello.txt", metadata, t, s)
-	if resp1 != http.StatusNotFound {
-		t.Errorf("Error expected %v but got %v when posting to an empty object", http.StatusNotFound, resp1)
-	}
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		metadata := map[string]string{"Test-Container": "test"}
+		resp1 := createContainer(t, metadata, s)
+		if resp1 != http.StatusCreated {
+			t.Errorf("Error expected %v but got %v when creating a container", http.StatusCreated, resp1)
+		}
+		matchMeta(t, s, "test", metadata)
+		metadata = map[string]string{"test": "meta1"}
+		resp1 = postToObject("hello.txt", metadata, t, s)
+		if resp1 != http.StatusNotFound {
+			t.Errorf("Error expected %v but got %v when posting to an empty object", http.StatusNotFound, resp1)
+		}
+	})
 }
 
 // Check correct resp code when creating an object
 // Check that the object stored all data
 // Check that the meta data of the object is correct
 func TestCreateObject(t *testing.T) {
-	storageLocation, cleanUp := getStorageLocation(t)
-	defer cleanUp()
-	metadata := map[string]string{"Test-Container": "test"}
-	s := &Server{
-		settings: &Settings{StorageLocation: storageLocation, TokenSecret: tokenSecret},
-	}
-	resp1 := createContainer(t, metadata, s)
-	if resp1 != http.StatusCreated {
-		t.Errorf("Error expected %v but got %v when creating a container", http.StatusCreated, resp1)
-	}
-	resp1 = createObject(t, s)
-	if resp1 != http.StatusCreated {
-		t.Errorf("Error expected %v but got %v when creating an object", http.StatusCreated, resp1)
-	}
-	dat, err := os.ReadFile(storageLocation + "/test/test.txt")
-	if err != nil {
-		t.Fatal(err)
-	}
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		metadata := map[string]string{"Test-Container": "test"}
+		resp1 := createContainer(t, metadata, s)
+		if resp1 != http.StatusCreated {
+			t.Errorf("Error expected %v but got %v when creating a container", http.StatusCreated, resp1)
+		}
+		resp1 = createObject(t, s)
+		if resp1 != http.StatusCreated {
+			t.Errorf("Error expected %v but got %v when creating an object", http.StatusCreated, resp1)
+		}
+		dat, err := s.readObject("test/test.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	requestBody, _ := json.Marshal(map[string]string{
-		"name": "Mr tester",
-		"data": "axafkdsfksfs",
+		requestBody, _ := json.Marshal(map[string]string{
+			"name": "Mr tester",
+			"data": "axafkdsfksfs",
+		})
+		if string(requestBody) != string(dat) {
+			t.Fatal("Error expected" + string(requestBody) + " but got " + string(dat) + " when creating an object")
+		}
+		meta := map[string]string{"Test": "testObjectData"}
+		matchMeta(t, s, "test/test.txt", meta)
+	})
+}
+
+// Check that objects with slashes in their name can be created and read back
+// together with their metadata
+func TestCreateNestedObject(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		resp1 := createContainer(t, map[string]string{"Test-Container": "test"}, s)
+		if resp1 != http.StatusCreated {
+			t.Errorf("Error expected %v but got %v when creating a container", http.StatusCreated, resp1)
+		}
+		token, err := createToken(tokenSecret)
+		if err != nil {
+			t.Errorf("failed generating token while setting up test %v", err)
+		}
+		req, err := http.NewRequest("PUT", "/v1.0/abc/test/dir/sub/test.txt", bytes.NewBufferString("nested"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("X-Auth-Token", token)
+		req.Header.Add("X-Object-Meta-Test", "nestedObjectData")
+		rr := httptest.NewRecorder()
+		s.storageHandler(rr, req)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("Error expected %v but got %v when creating a nested object", http.StatusCreated, rr.Code)
+		}
+
+		dat, err := s.readObject("test/dir/sub/test.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(dat) != "nested" {
+			t.Errorf("Error expected nested but got %s when reading a nested object", string(dat))
+		}
+		matchMeta(t, s, "test/dir/sub/test.txt", map[string]string{"Test": "nestedObjectData"})
+
+		req, err = http.NewRequest("HEAD", "/v1.0/abc/test/dir/sub/test.txt", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("X-Auth-Token", token)
+		rr = httptest.NewRecorder()
+		s.storageHandler(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		if meta := rr.Result().Header.Get("X-Object-Meta-Test"); meta != "nestedObjectData" {
+			t.Errorf("HEAD returned wrong meta data: got %s want %s", meta, "nestedObjectData")
+		}
+
+		// A nested object must not create its container
+		req, err = http.NewRequest("PUT", "/v1.0/abc/missing/dir/test.txt", bytes.NewBufferString("nested"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("X-Auth-Token", token)
+		rr = httptest.NewRecorder()
+		s.storageHandler(rr, req)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("Error expected %v but got %v when using put to an empty container", http.StatusNotFound, rr.Code)
+		}
+	})
+}
+
+// Check that the file backend answers 409 when an object name is the
+// directory of another, and the object stores keep both
+func TestNestedObjectNameConflict(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		if code := createContainer(t, map[string]string{"Test-Container": "test"}, s); code != http.StatusCreated {
+			t.Fatalf("Error expected %v but got %v when creating a container", http.StatusCreated, code)
+		}
+		want := http.StatusCreated
+		if _, ok := s.backend.(*FileBackend); ok {
+			want = http.StatusConflict
+		}
+		for _, names := range [][2]string{{"a", "a/b"}, {"c/d", "c"}} {
+			if rr := storageRequest(t, s, "PUT", "/v1.0/abc/test/"+names[0], strings.NewReader("first"), nil); rr.Code != http.StatusCreated {
+				t.Fatalf("Error expected %v but got %v when creating %s", http.StatusCreated, rr.Code, names[0])
+			}
+			if rr := storageRequest(t, s, "PUT", "/v1.0/abc/test/"+names[1], strings.NewReader("second"), nil); rr.Code != want {
+				t.Errorf("Error expected %v but got %v when creating %s after %s", want, rr.Code, names[1], names[0])
+			}
+			dat, err := s.readObject("test/" + names[0])
+			if err != nil || string(dat) != "first" {
+				t.Errorf("%s changed: %q %v", names[0], dat, err)
+			}
+		}
+	})
+}
+
+// Check that names which could escape the storage location are rejected
+func TestInvalidObjectName(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		token, err := createToken(tokenSecret)
+		if err != nil {
+			t.Errorf("failed generating token while setting up test %v", err)
+		}
+		for _, name := range []string{"test/../escape", "test/./test.txt", "test//test.txt", "..", "test/dir\\test.txt"} {
+			req, err := http.NewRequest("PUT", "/v1.0/abc/test", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.URL.Path = "/v1.0/abc/" + name
+			req.Header.Add("X-Auth-Token", token)
+			rr := httptest.NewRecorder()
+			s.storageHandler(rr, req)
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("handler returned wrong status code for %q: got %v want %v", name, rr.Code, http.StatusBadRequest)
+			}
+		}
 	})
-	if string(requestBody) != string(dat) {
-		t.Fatal("Error expected" + string(requestBody) + " but got " + string(dat) + " when creating an object")
-	}
-	meta := map[string]string{"Test": "testObjectData"}
-	matchMeta(t, storageLocation+"/test/test.test.txt.metadata.json", meta)
 }
 
 // Check that a a container with the name userid_deviceid_date_time is created
 func TestContainerName(t *testing.T) {
-	storageLocation, cleanUp := getStorageLocation(t)
-	defer cleanUp()
-	s := &Server{
-		settings: &Settings{StorageLocation: storageLocation, TokenSecret: tokenSecret},
-	}
-	userid := createUser(t, s)
-	createDevice(t, s)
-	recordingName := userid + "_AABBCCDD1234_20190101_090909"
-	createRecording(t, recordingName, s)
-	_, err := os.Stat(filepath.Join(storageLocation, recordingName))
-	if err != nil {
-		t.Fatal(err)
-	}
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		userid := createUser(t, s)
+		createDevice(t, s)
+		recordingName := userid + "_AABBCCDD1234_20190101_090909"
+		createRecording(t, recordingName, s)
+		_, err := s.backend.Stat(recordingName)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
 }
 
 // Check that a file called "complete" is created when status Complete is recieved
 func TestCompleteFile(t *testing.T) {
-	storageLocation, cleanUp := getStorageLocation(t)
-	defer cleanUp()
-	s := &Server{
-		settings: &Settings{StorageLocation: storageLocation, TokenSecret: tokenSecret},
-	}
-	userid := createUser(t, s)
-	createDevice(t, s)
-	recordingName := userid + "_AABBCCDD1234_20190101_090909"
-	createRecording(t, recordingName, s)
-
-	_, err := os.Stat(filepath.Join(storageLocation, recordingName+"/complete"))
-	if err == nil {
-		t.Fatal("Error, didn't expect to find a complete file, the recording is still transfering...")
-	}
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		userid := createUser(t, s)
+		createDevice(t, s)
+		recordingName := userid + "_AABBCCDD1234_20190101_090909"
+		createRecording(t, recordingName, s)
+
+		_, err := s.backend.Stat(recordingName + "/complete")
+		if err == nil {
+			t.Fatal("Error, didn't expect to find a complete file, the recording is still transfering...")
+		}
 
-	req, err := http.NewRequest("POST", "/v1.0/abc/"+recordingName, nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-	token, err := createToken(tokenSecret)
-	if err != nil {
-		t.Errorf("failed generating token while setting up test %v", err)
-	}
-	req.Header.Add("X-Auth-Token", token)
-	req.Header.Add("X-Object-Meta-Status", "Complete")
+		req, err := http.NewRequest("POST", "/v1.0/abc/"+recordingName, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := createToken(tokenSecret)
+		if err != nil {
+			t.Errorf("failed generating token while setting up test %v", err)
+		}
+		req.Header.Add("X-Auth-Token", token)
+		req.Header.Add("X-Object-Meta-Status", "Complete")
 
-	rr := httptest.NewRecorder()
-	s.storageHandler(rr, req)
+		rr := httptest.NewRecorder()
+		s.storageHandler(rr, req)
 
-	_, err = os.Stat(filepath.Join(storageLocation, recordingName+"/complete"))
-	if err != nil {
-		t.Fatal(err)
-	}
+		_, err = s.backend.Stat(recordingName + "/complete")
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
 }
 
 // Check that it's possible to get metadata from an object and container
 func TestGetMetadata(t *testing.T) {
-	storageLocation, cleanUp := getStorageLocation(t)
-	defer cleanUp()
-	metadata := map[string]string{"Test-Container": "test"}
-	s := &Server{
-		settings: &Settings{StorageLocation: storageLocation, TokenSecret: tokenSecret},
-	}
-	resp1 := createContainer(t, metadata, s)
-	if resp1 != http.StatusCreated {
-		t.Errorf("Error expected %v but got %v when creating a container", http.StatusCreated, resp1)
-	}
-	resp1 = createObject(t, s)
-	if resp1 != http.StatusCreated {
-		t.Errorf("Error expected %v but got %v when creating an object", http.StatusCreated, resp1)
-	}
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		metadata := map[string]string{"Test-Container": "test"}
+		resp1 := createContainer(t, metadata, s)
+		if resp1 != http.StatusCreated {
+			t.Errorf("Error expected %v but got %v when creating a container", http.StatusCreated, resp1)
+		}
+		resp1 = createObject(t, s)
+		if resp1 != http.StatusCreated {
+			t.Errorf("Error expected %v but got %v when creating an object", http.StatusCreated, resp1)
+		}
 
-	req, err := http.NewRequest("HEAD", "/v1.0/abc/test/test.txt", nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-	token, err := createToken(tokenSecret)
-	if err != nil {
-		t.Errorf("failed generating token while setting up test %v", err)
-	}
-	req.Header.Add("X-Auth-Token", token)
+		req, err := http.NewRequest("HEAD", "/v1.0/abc/test/test.txt", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := createToken(tokenSecret)
+		if err != nil {
+			t.Errorf("failed generating token while setting up test %v", err)
+		}
+		req.Header.Add("X-Auth-Token", token)
 
-	rr := httptest.NewRecorder()
-	s.storageHandler(rr, req)
-	if rr.Code != http.StatusOK {
-		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
-	}
-	meta := rr.Result().Header.Get("X-Object-Meta-Test")
-	if meta != "testObjectData" {
-		t.Errorf("HEAD returned wrong meta data: got %s want %s", meta, "testObjectData")
-	}
+		rr := httptest.NewRecorder()
+		s.storageHandler(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		meta := rr.Result().Header.Get("X-Object-Meta-Test")
+		if meta != "testObjectData" {
+			t.Errorf("HEAD returned wrong meta data: got %s want %s", meta, "testObjectData")
+		}
 
-	req, err = http.NewRequest("HEAD", "/v1.0/abc/test", nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-	req.Header.Add("X-Auth-Token", token)
+		req, err = http.NewRequest("HEAD", "/v1.0/abc/test", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("X-Auth-Token", token)
 
-	rr = httptest.NewRecorder()
-	s.storageHandler(rr, req)
-	if rr.Code != http.StatusOK {
-		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
-	}
-	meta = rr.Result().Header.Get("X-Container-Meta-Test-Container")
-	if meta != "test" {
-		t.Errorf("HEAD returned wrong meta data: got %s want %s", meta, "test")
-	}
+		rr = httptest.NewRecorder()
+		s.storageHandler(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		meta = rr.Result().Header.Get("X-Container-Meta-Test-Container")
+		if meta != "test" {
+			t.Errorf("HEAD returned wrong meta data: got %s want %s", meta, "test")
+		}
+	})
 }
 
 // Check that we return the correct errors when trying to get metadata from a
 // non-existing object or container
 func TestGetNonexistingMetadata(t *testing.T) {
-	storageLocation, cleanUp := getStorageLocation(t)
-	defer cleanUp()
-	s := &Server{
-		settings: &Settings{StorageLocation: storageLocation, TokenSecret: tokenSecret},
-	}
+	forEachBackend(t, func(t *testing.T, s *Server) {
 
-	req, err := http.NewRequest("HEAD", "/v1.0/abc/test/test.txt", nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-	token, err := createToken(tokenSecret)
-	if err != nil {
-		t.Errorf("failed generating token while setting up test %v", err)
-	}
-	req.Header.Add("X-Auth-Token", token)
+		req, err := http.NewRequest("HEAD", "/v1.0/abc/test/test.txt", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := createToken(tokenSecret)
+		if err != nil {
+			t.Errorf("failed generating token while setting up test %v", err)
+		}
+		req.Header.Add("X-Auth-Token", token)
 
-	rr := httptest.NewRecorder()
-	s.storageHandler(rr, req)
-	if rr.Code != http.StatusNotFound {
-		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
-	}
+		rr := httptest.NewRecorder()
+		s.storageHandler(rr, req)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+		}
 
-	req, err = http.NewRequest("HEAD", "/v1.0/abc/test", nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-	req.Header.Add("X-Auth-Token", token)
+		req, err = http.NewRequest("HEAD", "/v1.0/abc/test", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("X-Auth-Token", token)
 
-	rr = httptest.NewRecorder()
-	s.storageHandler(rr, req)
-	if rr.Code != http.StatusNotFound {
-		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
-	}
+		rr = httptest.NewRecorder()
+		s.storageHandler(rr, req)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+		}
+	})
 }
 
 func createContainer(t *testing.T, meta map[string]string, s *Server) int {
@@ -652,22 +741,20 @@ func createContainer(t *testing.T, meta map[string]string, s *Server) int {
 	return rr.Code
 }
 
-func matchMeta(t *testing.T, metapath string, meta map[string]string) {
-	jsonFile, err := os.Open(metapath)
+func matchMeta(t *testing.T, s *Server, target string, meta map[string]string) {
+	result, err := s.backend.LoadMetadata(target)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer jsonFile.Close()
-
-	byteValue, _ := io.ReadAll(jsonFile)
-	var result map[string]string
-	json.Unmarshal(byteValue, &result)
+	// The system keys are checked by their own tests
+	result = userMetadata(result)
 	if !reflect.DeepEqual(meta, result) {
 		bytes, err := json.Marshal(meta)
 		if err != nil {
 			t.Fatal("Metadata doesn't match expected values")
 		}
-		t.Fatalf("Metadata doesn't match expected values, expected:\n%s\nbut got:\n%s", string(bytes), string(byteValue))
+		got, _ := json.Marshal(result)
+		t.Fatalf("Metadata doesn't match expected values, expected:\n%s\nbut got:\n%s", string(bytes), string(got))
 	}
 }
 
@@ -793,6 +880,36 @@ func createRecording(t *testing.T, recordingName string, s *Server) {
 	}
 }
 
+// storageRequest sends a request to the storage or legal hold endpoint,
+// authenticated as the test user unless headers has an X-Auth-Token. A
+// Content-Length header sets the length of body, -1 when unknown.
+func storageRequest(t *testing.T, s *Server, method, path string, body io.Reader, headers map[string]string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := createToken(tokenSecret)
+	if err != nil {
+		t.Fatalf("failed generating token while setting up test %v", err)
+	}
+	req.Header.Set("X-Auth-Token", token)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if length, ok := headers["Content-Length"]; ok {
+		if req.ContentLength, err = strconv.ParseInt(length, 10, 64); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rr := httptest.NewRecorder()
+	if strings.HasPrefix(path, RootLegalHoldEndpoint+"/") {
+		s.legalHoldHandler(rr, req)
+	} else {
+		s.storageHandler(rr, req)
+	}
+	return rr
+}
+
 func createObject(t *testing.T, s *Server) int {
 	requestBody, err := json.Marshal(map[string]string{
 		"name": "Mr tester",
@@ -838,6 +955,51 @@ func postToContainer(meta map[string]string, t *testing.T, s *Server) int {
 	return rr.Code
 }
 
+// backends lists the storage backends the storage tests are run against.
+var backends = []struct {
+	name       string
+	newBackend func(t *testing.T, storageLocation string) Backend
+}{
+	{"file", func(t *testing.T, storageLocation string) Backend {
+		return NewFileBackend(storageLocation)
+	}},
+	{"swift", func(t *testing.T, storageLocation string) Backend {
+		srv, err := swifttest.NewSwiftServer("localhost")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(srv.Close)
+		b, err := NewSwiftBackend(&SwiftSettings{
+			AuthURL:  srv.AuthURL,
+			UserName: swifttest.TEST_ACCOUNT,
+			ApiKey:   swifttest.TEST_ACCOUNT,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}},
+	{"s3", func(t *testing.T, storageLocation string) Backend {
+		return newS3TestBackend(t)
+	}},
+}
+
+// forEachBackend runs test once per backend, each time with a server using an
+// empty storage location.
+func forEachBackend(t *testing.T, test func(t *testing.T, s *Server)) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			storageLocation, cleanUp := getStorageLocation(t)
+			defer cleanUp()
+			s := &Server{
+				settings: &Settings{StorageLocation: storageLocation, TokenSecret: tokenSecret},
+				backend:  b.newBackend(t, storageLocation),
+			}
+			test(t, s)
+		})
+	}
+}
+
 func getStorageLocation(t *testing.T) (string, func()) {
 	dir, err := os.MkdirTemp("", "test")
 	if err != nil {
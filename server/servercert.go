@@ -0,0 +1,448 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// Server certificates from an enterprise PKI or an ACME server replace the
+// ones issued by the local CA. The certificate is installed for every IP, and
+// the root CAs it chains to are written to rootCAFilename and published in
+// the connection file.
+const (
+	rootCAFilename = "root_ca.crt"
+
+	// The connection file has room for 10 certificates
+	maxPublishedCertificates = 10
+)
+
+// ServerCertificate is where the server certificate comes from, when not
+// from the local CA. It is installed again when the files change, or renewed
+// before it expires when it comes from an ACME server.
+type ServerCertificate struct {
+	// CertFile is a PEM file of the certificate followed by its intermediate
+	// CAs, and KeyFile a PEM file of its key. PKCS12File holds both instead,
+	// protected by PKCS12Password. Relative paths are in the settings folder.
+	CertFile       string `json:",omitempty"`
+	KeyFile        string `json:",omitempty"`
+	PKCS12File     string `json:",omitempty"`
+	PKCS12Password string `json:",omitempty"`
+	// RootCAFile is a PEM file of the root CAs the chain ends in, needed
+	// unless the chain includes them
+	RootCAFile string        `json:",omitempty"`
+	ACME       *ACMESettings `json:",omitempty"`
+}
+
+// settingsFile returns the path of name, relative to the settings folder
+// unless absolute.
+func settingsFile(rootPath, name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(rootPath, name)
+}
+
+// sources returns the files the certificate is read from.
+func (c *ServerCertificate) sources() []string {
+	files := []string{c.CertFile, c.KeyFile, c.PKCS12File, c.RootCAFile}
+	if c.ACME != nil {
+		files = []string{c.RootCAFile}
+	}
+	sources := []string{}
+	for _, name := range files {
+		if name != "" {
+			sources = append(sources, name)
+		}
+	}
+	return sources
+}
+
+// parseCertificates returns the certificates in PEM data.
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+}
+
+// parsePrivateKey returns the first private key in PEM data.
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no private key found")
+		}
+		if !strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			continue
+		}
+		if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+			return key, nil
+		}
+		if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+			return key, nil
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported private key: %v", err)
+		}
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			return key, nil
+		case *ecdsa.PrivateKey:
+			return key, nil
+		}
+		return nil, errors.New("unsupported private key type")
+	}
+}
+
+// load reads the certificate chain and key from the PEM or PKCS#12 files.
+func (c *ServerCertificate) load(rootPath string) ([]*x509.Certificate, crypto.Signer, error) {
+	if c.PKCS12File != "" {
+		return c.loadPKCS12(rootPath)
+	}
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, nil, errors.New("no certificate and key files, or PKCS#12 file")
+	}
+	certData, err := os.ReadFile(settingsFile(rootPath, c.CertFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	keyData, err := os.ReadFile(settingsFile(rootPath, c.KeyFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	certs, err := parseCertificates(certData)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := parsePrivateKey(keyData)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sortChain(certs, key), key, nil
+}
+
+// loadPKCS12 reads the certificate chain and key from the PKCS#12 file,
+// encrypted with the legacy algorithms or with AES as exported by current
+// tools.
+func (c *ServerCertificate) loadPKCS12(rootPath string) ([]*x509.Certificate, crypto.Signer, error) {
+	data, err := os.ReadFile(settingsFile(rootPath, c.PKCS12File))
+	if err != nil {
+		return nil, nil, err
+	}
+	privateKey, cert, caCerts, err := pkcs12.DecodeChain(data, c.PKCS12Password)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read %s: %v", c.PKCS12File, err)
+	}
+	var key crypto.Signer
+	switch privateKey := privateKey.(type) {
+	case *rsa.PrivateKey:
+		key = privateKey
+	case *ecdsa.PrivateKey:
+		key = privateKey
+	default:
+		return nil, nil, errors.New("unsupported private key type")
+	}
+	return sortChain(append([]*x509.Certificate{cert}, caCerts...), key), key, nil
+}
+
+// samePublicKey reports whether a and b are the same key.
+func samePublicKey(a, b crypto.PublicKey) bool {
+	k, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && k.Equal(b)
+}
+
+// sortChain puts the certificate of key first, followed by the certificates
+// issuing it in order, and the rest last. PKCS#12 files have no order.
+func sortChain(certs []*x509.Certificate, key crypto.Signer) []*x509.Certificate {
+	sorted, rest := []*x509.Certificate{}, certs
+	next := func(cert *x509.Certificate) bool {
+		if len(sorted) == 0 {
+			return samePublicKey(key.Public(), cert.PublicKey)
+		}
+		last := sorted[len(sorted)-1]
+		return !bytes.Equal(last.RawIssuer, last.RawSubject) && bytes.Equal(last.RawIssuer, cert.RawSubject)
+	}
+	for found := true; found; {
+		found = false
+		for i, cert := range rest {
+			if next(cert) {
+				sorted = append(sorted, cert)
+				rest = append(rest[:i:i], rest[i+1:]...)
+				found = true
+				break
+			}
+		}
+	}
+	return append(sorted, rest...)
+}
+
+// isRoot reports whether cert is a self-signed CA.
+func isRoot(cert *x509.Certificate) bool {
+	return cert.IsCA && bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil
+}
+
+// verifyServerChain checks that chain starts with a certificate for every
+// host with key, and chains to one of the roots in it or in rootCAs. It returns
+// the chain without roots, and the roots to publish.
+func verifyServerChain(chain []*x509.Certificate, key crypto.Signer, rootCAs []*x509.Certificate, hosts []string, now time.Time) ([]*x509.Certificate, []*x509.Certificate, error) {
+	if len(chain) == 0 {
+		return nil, nil, errors.New("no certificate found")
+	}
+	leaf := chain[0]
+	if !samePublicKey(key.Public(), leaf.PublicKey) {
+		return nil, nil, errors.New("the private key doesn't match the certificate")
+	}
+	roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+	published, served := []*x509.Certificate{}, []*x509.Certificate{leaf}
+	for _, cert := range rootCAs {
+		roots.AddCert(cert)
+		published = append(published, cert)
+	}
+	for _, cert := range chain[1:] {
+		if isRoot(cert) {
+			if len(rootCAs) == 0 {
+				roots.AddCert(cert)
+				published = append(published, cert)
+			}
+			continue
+		}
+		intermediates.AddCert(cert)
+		served = append(served, cert)
+	}
+	if len(published) == 0 {
+		return nil, nil, errors.New("the chain doesn't end with a root CA, set RootCAFile")
+	}
+	verified, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, host := range hosts {
+		if err := leaf.VerifyHostname(host); err != nil {
+			return nil, nil, err
+		}
+	}
+	// Only publish the roots the certificate chains to
+	used := []*x509.Certificate{}
+	for _, cert := range published {
+		for _, chain := range verified {
+			if chain[len(chain)-1].Equal(cert) {
+				used = append(used, cert)
+				break
+			}
+		}
+	}
+	if len(used) > maxPublishedCertificates {
+		return nil, nil, fmt.Errorf("more than %d root CAs", maxPublishedCertificates)
+	}
+	return served, used, nil
+}
+
+// encodeCertificates returns certs as PEM.
+func encodeCertificates(certs []*x509.Certificate) []byte {
+	out := &bytes.Buffer{}
+	for _, cert := range certs {
+		pem.Encode(out, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return out.Bytes()
+}
+
+// installServerCertificate verifies chain and key, and writes them as the
+// certificate of every IP, the key first, and the roots to publish to
+// rootCAFilename.
+func installServerCertificate(rootPath string, s Settings, chain []*x509.Certificate, key crypto.Signer) error {
+	rootCAs := []*x509.Certificate{}
+	if name := s.ServerCertificate.RootCAFile; name != "" {
+		data, err := os.ReadFile(settingsFile(rootPath, name))
+		if err != nil {
+			return err
+		}
+		if rootCAs, err = parseCertificates(data); err != nil {
+			return err
+		}
+		if len(rootCAs) == 0 {
+			return fmt.Errorf("no certificates found in %s", name)
+		}
+	}
+	served, roots, err := verifyServerChain(chain, key, rootCAs, serverHosts(s), time.Now())
+	if err != nil {
+		return fmt.Errorf("invalid server certificate: %v", err)
+	}
+	block := pemBlockForKey(key)
+	if block == nil {
+		return errors.New("unsupported private key type")
+	}
+	keyPem := pem.EncodeToMemory(block)
+	certPem := encodeCertificates(served)
+	for i := range s.IPs {
+		if err := writeFileAtomic(filepath.Join(rootPath, buildKeyName(i)), bytes.NewReader(keyPem)); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(filepath.Join(rootPath, buildCertName(i)), bytes.NewReader(certPem)); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(filepath.Join(rootPath, rootCAFilename), bytes.NewReader(encodeCertificates(roots)))
+}
+
+// updateServerCertificate reads the server certificate from its files, or
+// orders it from the ACME server, and installs it.
+func updateServerCertificate(rootPath string, s Settings) error {
+	var chain []*x509.Certificate
+	var key crypto.Signer
+	var err error
+	if s.ServerCertificate.ACME != nil {
+		chain, key, err = orderACMECertificate(rootPath, s)
+	} else {
+		chain, key, err = s.ServerCertificate.load(rootPath)
+	}
+	if err != nil {
+		return err
+	}
+	return installServerCertificate(rootPath, s, chain, key)
+}
+
+// serverCertificateChanged reports whether the server certificate has not
+// been installed, or its files have changed since.
+func serverCertificateChanged(rootPath string, c *ServerCertificate) bool {
+	installed, err := os.Stat(filepath.Join(rootPath, rootCAFilename))
+	if err != nil {
+		return true
+	}
+	for _, name := range c.sources() {
+		if fi, err := os.Stat(settingsFile(rootPath, name)); err == nil && fi.ModTime().After(installed.ModTime()) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectServerCertificate asks where the server certificate comes from, it
+// returns nil for the local CA.
+func selectServerCertificate(scanner *bufio.Scanner) *ServerCertificate {
+	fmt.Println("Choose where the server certificate comes from >")
+	fmt.Println("0: issued by a local CA.")
+	fmt.Println("1: PEM certificate and key files.")
+	fmt.Println("2: a PKCS#12 file.")
+	fmt.Println("3: an ACME server.")
+	for {
+		var choice string
+		fmt.Println("Choose 0 - 3")
+		fmt.Scanln(&choice)
+		switch choice {
+		case "0":
+			return nil
+		case "1":
+			return &ServerCertificate{
+				CertFile:   ask(scanner, "Enter the certificate file, followed by its intermediate CAs >"),
+				KeyFile:    ask(scanner, "Enter the key file >"),
+				RootCAFile: ask(scanner, "Enter the root CA file or leave empty if the certificate file ends with it >"),
+			}
+		case "2":
+			return &ServerCertificate{
+				PKCS12File:     ask(scanner, "Enter the PKCS#12 file >"),
+				PKCS12Password: askSecret("Enter the PKCS#12 password >"),
+				RootCAFile:     ask(scanner, "Enter the root CA file or leave empty if the PKCS#12 file has it >"),
+			}
+		case "3":
+			return &ServerCertificate{
+				ACME: &ACMESettings{
+					DirectoryURL:  ask(scanner, "Enter the ACME directory URL >"),
+					Email:         ask(scanner, "Enter the contact email or leave empty >"),
+					ChallengePort: ask(scanner, "Enter the port the ACME server validates on or leave empty to use 80 >"),
+					CAFile:        ask(scanner, "Enter the CA file of the ACME server or leave empty to trust the system CAs >"),
+				},
+				RootCAFile: ask(scanner, "Enter the root CA file of the certificates the ACME server issues >"),
+			}
+		}
+	}
+}
+
+// SetServerCertificate replaces the server certificate with one from an
+// enterprise PKI or an ACME server, or the local CA again, and updates the
+// connection file of every account.
+func SetServerCertificate(configPath string) error {
+	settingsPath := filepath.Join(configPath, settingsFilename)
+	data, err := os.ReadFile(settingsPath)
+	if err != nil {
+		return err
+	}
+	settings := Settings{}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return err
+	}
+	if !settings.UseHttps {
+		return errors.New("the server doesn't use https, install again to use it")
+	}
+	settings.ServerCertificate = selectServerCertificate(bufio.NewScanner(os.Stdin))
+	if settings.ServerCertificate != nil {
+		err = updateServerCertificate(configPath, settings)
+	} else {
+		os.Remove(filepath.Join(configPath, rootCAFilename))
+		err = generateCertsFor(configPath, settings)
+	}
+	if err != nil {
+		return err
+	}
+	confJson, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(settingsPath, bytes.NewReader(confJson)); err != nil {
+		return err
+	}
+	certs, err := publishedCertificates(configPath, settings)
+	if err != nil {
+		return err
+	}
+	updated, err := updateConnectionFiles(settings, func(conf *Config) {
+		conf.HTTPSCertificate = certs
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println("Upload " + strings.Join(updated, ", ") + " to the system controller again, and restart the service.")
+	return nil
+}
+
+// generateCertsFor issues a certificate from the local CA for every IP.
+func generateCertsFor(rootPath string, s Settings) error {
+	for i, ip := range s.IPs {
+		if err := generateCert(rootPath, ip, endpointHosts(s), buildCertName(i), buildKeyName(i)); err != nil {
+			return fmt.Errorf("failed to generate certificate for ip %s: %v", ip, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// issueTestCert issues a certificate from template, self-signed unless parent
+// is set.
+func issueTestCert(t *testing.T, template, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if template.SerialNumber, err = randomSerial(); err != nil {
+		t.Fatal(err)
+	}
+	if template.NotBefore.IsZero() {
+		template.NotBefore = time.Now().Add(-time.Hour)
+		template.NotAfter = time.Now().Add(365 * 24 * time.Hour)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func testCA(t *testing.T, name string, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer) {
+	return issueTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, parent, parentKey)
+}
+
+func testServerCert(t *testing.T, ips []string, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer) {
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: ips[0]},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, ip := range ips {
+		template.IPAddresses = append(template.IPAddresses, net.ParseIP(ip))
+	}
+	return issueTestCert(t, template, parent, parentKey)
+}
+
+func writePem(t *testing.T, name string, certs []*x509.Certificate, key crypto.Signer) {
+	data := encodeCertificates(certs)
+	if key != nil {
+		data = append(data, pem.EncodeToMemory(pemBlockForKey(key))...)
+	}
+	if err := os.WriteFile(name, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Check that a certificate from another PKI is installed for every IP, and
+// only its root CA is published
+func TestServerCertificate(t *testing.T) {
+	configPath, storage := t.TempDir(), t.TempDir()
+	ips := []string{"127.0.0.1", "::1"}
+	root, rootKey := testCA(t, "Root CA", nil, nil)
+	intermediate, intermediateKey := testCA(t, "Intermediate CA", root, rootKey)
+	leaf, leafKey := testServerCert(t, ips, intermediate, intermediateKey)
+	// Out of order, as in PKCS#12 files
+	writePem(t, filepath.Join(configPath, "chain.pem"), []*x509.Certificate{root, leaf, intermediate}, nil)
+	writePem(t, filepath.Join(configPath, "key.pem"), nil, leafKey)
+
+	settings := Settings{StorageLocation: storage, IPs: ips, Port: "8080", UseHttps: true, Username: "test:tester",
+		ServerCertificate: &ServerCertificate{CertFile: "chain.pem", KeyFile: filepath.Join(configPath, "key.pem")}}
+	if err := updateServerCertificate(configPath, settings); err != nil {
+		t.Fatal(err)
+	}
+	for i := range ips {
+		data, err := os.ReadFile(filepath.Join(configPath, buildCertName(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		served, err := parseCertificates(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(served) != 2 || !served[0].Equal(leaf) || !served[1].Equal(intermediate) {
+			t.Errorf("wrong chain served for %s", ips[i])
+		}
+		if _, _, err := loadCert(configPath, buildCertName(i), buildKeyName(i)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err := generateConnectionFile(configPath, "test", settings); err != nil {
+		t.Fatal(err)
+	}
+	conf := readConnectionFile(t, storage)
+	if len(conf.HTTPSCertificate) != 1 {
+		t.Fatalf("wrong number of certificates in connection file: got %d want 1", len(conf.HTTPSCertificate))
+	}
+	data, err := base64.StdEncoding.DecodeString(conf.HTTPSCertificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if published, err := parseCertificates(data); err != nil || len(published) != 1 || !published[0].Equal(root) {
+		t.Error("root CA not published in the connection file")
+	}
+}
+
+// Check that a PKCS#12 file encrypted with AES, as exported by current tools,
+// is read with its chain
+func TestServerCertificatePKCS12(t *testing.T) {
+	configPath := t.TempDir()
+	ips := []string{"127.0.0.1"}
+	root, rootKey := testCA(t, "Root CA", nil, nil)
+	intermediate, intermediateKey := testCA(t, "Intermediate CA", root, rootKey)
+	leaf, leafKey := testServerCert(t, ips, intermediate, intermediateKey)
+	// PBES2 with PBKDF2 and AES-256-CBC
+	data, err := pkcs12.Modern2023.Encode(leafKey, leaf, []*x509.Certificate{root, intermediate}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(configPath, "server.p12"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &ServerCertificate{PKCS12File: "server.p12", PKCS12Password: "secret"}
+	chain, key, err := c.load(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 3 || !chain[0].Equal(leaf) || !chain[1].Equal(intermediate) || !chain[2].Equal(root) {
+		t.Error("wrong chain read from the PKCS#12 file")
+	}
+	if !samePublicKey(key.Public(), leafKey.Public()) {
+		t.Error("wrong key read from the PKCS#12 file")
+	}
+	c.PKCS12Password = "wrong"
+	if _, _, err := c.load(configPath); err == nil {
+		t.Error("PKCS#12 file read with the wrong password")
+	}
+}
+
+// Check that certificates that the system controller couldn't verify are
+// rejected
+func TestInvalidServerCertificate(t *testing.T) {
+	ips := []string{"127.0.0.1"}
+	root, rootKey := testCA(t, "Root CA", nil, nil)
+	leaf, leafKey := testServerCert(t, ips, root, rootKey)
+	other, _ := testServerCert(t, []string{"127.0.0.2"}, root, rootKey)
+	_, otherKey := testServerCert(t, ips, root, rootKey)
+	expired, expiredKey := issueTestCert(t, &x509.Certificate{
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:   time.Now().Add(-48 * time.Hour),
+		NotAfter:    time.Now().Add(-24 * time.Hour),
+	}, root, rootKey)
+	clientCert, clientKey := issueTestCert(t, &x509.Certificate{
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, root, rootKey)
+
+	for _, test := range []struct {
+		name    string
+		chain   []*x509.Certificate
+		key     crypto.Signer
+		rootCAs []*x509.Certificate
+		valid   bool
+	}{
+		{"valid", []*x509.Certificate{leaf, root}, leafKey, nil, true},
+		{"root CA file", []*x509.Certificate{leaf}, leafKey, []*x509.Certificate{root}, true},
+		{"no root CA", []*x509.Certificate{leaf}, leafKey, nil, false},
+		{"wrong key", []*x509.Certificate{leaf, root}, otherKey, nil, false},
+		{"wrong IP", []*x509.Certificate{other, root}, leafKey, nil, false},
+		{"expired", []*x509.Certificate{expired, root}, expiredKey, nil, false},
+		{"client certificate", []*x509.Certificate{clientCert, root}, clientKey, nil, false},
+	} {
+		served, roots, err := verifyServerChain(test.chain, test.key, test.rootCAs, ips, time.Now())
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: accepted", test.name)
+		}
+		if test.valid && (len(served) != 1 || len(roots) != 1 || !roots[0].Equal(root)) {
+			t.Errorf("%s: served %d certificates and published %d", test.name, len(served), len(roots))
+		}
+	}
+}
+
+// Check that the server certificate is installed again when its file is
+// replaced, and served without restarting
+func TestReplaceServerCertificate(t *testing.T) {
+	configPath, storage := t.TempDir(), t.TempDir()
+	ips := []string{"127.0.0.1"}
+	root, rootKey := testCA(t, "Root CA", nil, nil)
+	leaf, leafKey := testServerCert(t, ips, root, rootKey)
+	bundle := filepath.Join(configPath, "bundle.pem")
+	writePem(t, bundle, []*x509.Certificate{leaf, root}, leafKey)
+	settings := Settings{StorageLocation: storage, IPs: ips, Port: "8080", UseHttps: true, Username: "test:tester",
+		ServerCertificate: &ServerCertificate{CertFile: bundle, KeyFile: bundle}}
+	if err := updateServerCertificate(configPath, settings); err != nil {
+		t.Fatal(err)
+	}
+	if err := generateConnectionFile(configPath, "test", settings); err != nil {
+		t.Fatal(err)
+	}
+	m := newCertManager(configPath, settings)
+	m.check(time.Now())
+	if cert, err := m.load(0); err != nil || !cert.Leaf.Equal(leaf) {
+		t.Fatal("installed certificate not served")
+	}
+
+	newRoot, newRootKey := testCA(t, "New Root CA", nil, nil)
+	newLeaf, newLeafKey := testServerCert(t, ips, newRoot, newRootKey)
+	writePem(t, bundle, []*x509.Certificate{newLeaf, newRoot}, newLeafKey)
+	// Newer than the installed certificate, also with coarse timestamps
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(bundle, later, later); err != nil {
+		t.Fatal(err)
+	}
+	m.check(time.Now())
+	if cert, err := m.load(0); err != nil || !cert.Leaf.Equal(newLeaf) {
+		t.Error("replaced certificate not served")
+	}
+	data, err := base64.StdEncoding.DecodeString(readConnectionFile(t, storage).HTTPSCertificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if published, err := parseCertificates(data); err != nil || len(published) != 1 || !published[0].Equal(newRoot) {
+		t.Error("new root CA not published in the connection file")
+	}
+}
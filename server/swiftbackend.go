@@ -0,0 +1,225 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/ncw/swift/v2"
+)
+
+// SwiftSettings holds the credentials of an upstream Swift account that
+// uploads are forwarded to.
+type SwiftSettings struct {
+	AuthURL  string
+	UserName string
+	ApiKey   string
+	Tenant   string `json:",omitempty"`
+	Domain   string `json:",omitempty"`
+	Region   string `json:",omitempty"`
+}
+
+// SwiftBackend forwards containers, objects and their metadata to an upstream
+// Swift account. The BWS is still authenticated by Server, the upstream
+// credentials are never handed out.
+type SwiftBackend struct {
+	conn *swift.Connection
+}
+
+// NewSwiftBackend returns a Backend storing everything in the upstream Swift
+// account described by settings. Authentication is done on first use.
+func NewSwiftBackend(settings *SwiftSettings) (*SwiftBackend, error) {
+	if settings == nil || settings.AuthURL == "" {
+		return nil, errors.New("no upstream Swift auth URL configured")
+	}
+	return &SwiftBackend{
+		conn: &swift.Connection{
+			AuthUrl:  settings.AuthURL,
+			UserName: settings.UserName,
+			ApiKey:   settings.ApiKey,
+			Tenant:   settings.Tenant,
+			Domain:   settings.Domain,
+			Region:   settings.Region,
+		},
+	}, nil
+}
+
+// fromSwiftError translates upstream errors to the errors expected from a
+// Backend.
+func fromSwiftError(target string, err error) error {
+	var e *swift.Error
+	if errors.As(err, &e) {
+		switch e.StatusCode {
+		case http.StatusNotFound:
+			return &fs.PathError{Op: "swift", Path: target, Err: os.ErrNotExist}
+		case http.StatusInsufficientStorage:
+			return &fs.PathError{Op: "swift", Path: target, Err: syscall.ENOSPC}
+		case http.StatusUnprocessableEntity:
+			return &fs.PathError{Op: "swift", Path: target, Err: errChecksumMismatch}
+		}
+	}
+	return err
+}
+
+// metaPrefix returns the metadata header prefix used for target.
+func metaPrefix(target string) string {
+	if _, object := splitTarget(target); object != "" {
+		return ObjectMeta
+	}
+	return ContainerMeta
+}
+
+func (b *SwiftBackend) CreateContainer(container string) (bool, error) {
+	ctx := context.Background()
+	_, _, err := b.conn.Container(ctx, container)
+	if err == nil {
+		return false, nil
+	}
+	if !errors.Is(err, swift.ContainerNotFound) {
+		return false, fromSwiftError(container, err)
+	}
+	if err := b.conn.ContainerCreate(ctx, container, nil); err != nil {
+		return false, fromSwiftError(container, err)
+	}
+	return true, nil
+}
+
+// PutObject streams body to Swift, which checks the ETag and doesn't store
+// the object if it doesn't match.
+func (b *SwiftBackend) PutObject(target string, body io.Reader, etag string) error {
+	container, object := splitTarget(target)
+	_, err := b.conn.ObjectPut(context.Background(), container, object, body, etag != "", etag, "", nil)
+	return fromSwiftError(target, err)
+}
+
+func (b *SwiftBackend) GetObject(target string) (io.ReadSeekCloser, error) {
+	container, object := splitTarget(target)
+	file, _, err := b.conn.ObjectOpen(context.Background(), container, object, false, nil)
+	if err != nil {
+		return nil, fromSwiftError(target, err)
+	}
+	return swiftObject{file}, nil
+}
+
+// swiftObject adapts an open Swift object to io.Seeker.
+type swiftObject struct {
+	*swift.ObjectOpenFile
+}
+
+func (o swiftObject) Seek(offset int64, whence int) (int64, error) {
+	return o.ObjectOpenFile.Seek(context.Background(), offset, whence)
+}
+
+func (b *SwiftBackend) Stat(target string) (ObjectInfo, error) {
+	ctx := context.Background()
+	container, object := splitTarget(target)
+	if object == "" {
+		info, _, err := b.conn.Container(ctx, container)
+		if err != nil {
+			return ObjectInfo{}, fromSwiftError(target, err)
+		}
+		return ObjectInfo{Name: target, Size: info.Bytes, Container: true}, nil
+	}
+	info, _, err := b.conn.Object(ctx, container, object)
+	if err != nil {
+		return ObjectInfo{}, fromSwiftError(target, err)
+	}
+	return ObjectInfo{Name: target, Size: info.Bytes, ModTime: info.LastModified, Hash: info.Hash}, nil
+}
+
+func (b *SwiftBackend) headers(target string) (swift.Headers, error) {
+	ctx := context.Background()
+	container, object := splitTarget(target)
+	var headers swift.Headers
+	var err error
+	if object == "" {
+		_, headers, err = b.conn.Container(ctx, container)
+	} else {
+		_, headers, err = b.conn.Object(ctx, container, object)
+	}
+	return headers, fromSwiftError(target, err)
+}
+
+func (b *SwiftBackend) LoadMetadata(target string) (map[string]string, error) {
+	headers, err := b.headers(target)
+	if err != nil {
+		return nil, err
+	}
+	prefix := metaPrefix(target)
+	metadata := map[string]string{}
+	for k, v := range headers {
+		if strings.HasPrefix(k, prefix) && v != "" {
+			metadata[strings.TrimPrefix(k, prefix)] = URLDecode(v)
+		}
+	}
+	return metadata, nil
+}
+
+// StoreMetadata replaces the metadata of target. Keys that are no longer
+// present are sent with empty values, which removes them from containers and
+// clears them on objects where Swift doesn't already replace everything.
+func (b *SwiftBackend) StoreMetadata(target string, metadata map[string]string) error {
+	old, err := b.LoadMetadata(target)
+	if err != nil {
+		return err
+	}
+	prefix := metaPrefix(target)
+	headers := swift.Headers{}
+	for k := range old {
+		headers[prefix+k] = ""
+	}
+	for k, v := range metadata {
+		headers[prefix+k] = url.PathEscape(v)
+	}
+	ctx := context.Background()
+	container, object := splitTarget(target)
+	if object == "" {
+		err = b.conn.ContainerUpdate(ctx, container, headers)
+	} else {
+		err = b.conn.ObjectUpdate(ctx, container, object, headers)
+	}
+	return fromSwiftError(target, err)
+}
+
+// BackupMetadata is a no-op, metadata kept as Swift headers can't be corrupt.
+func (b *SwiftBackend) BackupMetadata(target string) error {
+	return nil
+}
+
+func (b *SwiftBackend) List(container string) ([]ObjectInfo, error) {
+	ctx := context.Background()
+	list := []ObjectInfo{}
+	if container == "" {
+		containers, err := b.conn.ContainersAll(ctx, nil)
+		if err != nil {
+			return nil, fromSwiftError(container, err)
+		}
+		for _, c := range containers {
+			list = append(list, ObjectInfo{Name: c.Name, Size: c.Bytes, Container: true})
+		}
+		return list, nil
+	}
+	objects, err := b.conn.ObjectsAll(ctx, container, nil)
+	if err != nil {
+		return nil, fromSwiftError(container, err)
+	}
+	for _, o := range objects {
+		list = append(list, ObjectInfo{Name: o.Name, Size: o.Bytes, ModTime: o.LastModified})
+	}
+	return list, nil
+}
+
+func (b *SwiftBackend) Delete(target string) error {
+	ctx := context.Background()
+	container, object := splitTarget(target)
+	if object == "" {
+		return fromSwiftError(target, b.conn.ContainerDelete(ctx, container))
+	}
+	return fromSwiftError(target, b.conn.ObjectDelete(ctx, container, object))
+}
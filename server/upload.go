@@ -0,0 +1,319 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ncw/swift/v2"
+)
+
+// Headers of resumable uploads. A PUT with X-Upload-Length is kept as a
+// partial upload until that many bytes have been received, and continued by
+// a PUT with X-Upload-Offset set to the number of bytes already received.
+const (
+	UploadLengthTag = "X-Upload-Length"
+	UploadOffsetTag = "X-Upload-Offset"
+
+	// Partial uploads are kept in the storage location, so they count
+	// toward the disk watermark, in a directory that isn't a container
+	uploadsDir = ".uploads"
+	// Partial uploads not continued for this long are removed at startup
+	uploadExpiry = 7 * 24 * time.Hour
+)
+
+// partialUpload is stored next to the data of a partial upload.
+type partialUpload struct {
+	Target  string
+	Length  int64
+	Started time.Time
+}
+
+// uploadPath returns the path of the data of a partial upload of target. The
+// description of the upload is kept in the same path with .json appended.
+func (s *Server) uploadPath(target string) string {
+	digest := sha256.Sum256([]byte(target))
+	return filepath.Join(s.settings.StorageLocation, uploadsDir, hex.EncodeToString(digest[:]))
+}
+
+// partialUploadBytes returns the bytes received by the partial uploads of the
+// account by container, leaving out the upload of except.
+func (s *Server) partialUploadBytes(except string) (map[string]int64, error) {
+	dir := filepath.Join(s.settings.StorageLocation, uploadsDir)
+	entries, err := os.ReadDir(dir)
+	if isNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	bytes := map[string]int64{}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") || isTempFile(e.Name()) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		upload := partialUpload{}
+		if err := json.Unmarshal(data, &upload); err != nil || upload.Target == except {
+			continue
+		}
+		fi, err := os.Stat(filepath.Join(dir, strings.TrimSuffix(e.Name(), ".json")))
+		if isNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		container, _ := splitTarget(upload.Target)
+		bytes[container] += fi.Size()
+	}
+	return bytes, nil
+}
+
+// loadPartialUpload returns the partial upload of target and the number of
+// bytes received so far.
+func (s *Server) loadPartialUpload(target string) (partialUpload, int64, error) {
+	upload := partialUpload{}
+	data, err := os.ReadFile(s.uploadPath(target) + ".json")
+	if err != nil {
+		return upload, 0, err
+	}
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return upload, 0, err
+	}
+	fi, err := os.Stat(s.uploadPath(target))
+	if err != nil {
+		return upload, 0, err
+	}
+	return upload, fi.Size(), nil
+}
+
+func (s *Server) removePartialUpload(target string) {
+	for _, p := range []string{s.uploadPath(target), s.uploadPath(target) + ".json"} {
+		if err := os.Remove(p); err != nil && !isNotExist(err) {
+			logger.Error(err)
+		}
+	}
+}
+
+// lockUpload marks target as being uploaded, it returns false if another
+// request already uploads it.
+func (s *Server) lockUpload(target string) bool {
+	s.uploadsMu.Lock()
+	defer s.uploadsMu.Unlock()
+	if s.uploading == nil {
+		s.uploading = map[string]bool{}
+	}
+	if s.uploading[target] {
+		return false
+	}
+	s.uploading[target] = true
+	return true
+}
+
+func (s *Server) unlockUpload(target string) {
+	s.uploadsMu.Lock()
+	defer s.uploadsMu.Unlock()
+	delete(s.uploading, target)
+}
+
+func parseUploadHeader(r *http.Request, key string) (int64, error) {
+	value := r.Header.Get(key)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s: %s", key, value)
+	}
+	return n, nil
+}
+
+// handleResumableUpload appends the request body to the partial upload of
+// target. Once all bytes have been received the object is stored like any
+// other upload, with the metadata of the last request. Until then 202 is
+// returned with the number of bytes received in X-Upload-Offset.
+func (s *Server) handleResumableUpload(w http.ResponseWriter, r *http.Request, target string) {
+	length, err := parseUploadHeader(r, UploadLengthTag)
+	if err == nil && length == 0 {
+		err = fmt.Errorf("invalid %s: 0", UploadLengthTag)
+	}
+	var offset int64
+	if err == nil {
+		offset, err = parseUploadHeader(r, UploadOffsetTag)
+	}
+	if err != nil {
+		logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	container, _ := splitTarget(target)
+	if _, err := s.backend.Stat(container); err != nil {
+		logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	// Refused before any bytes are received, putObject checks again once
+	// they all are
+	if err := s.checkRetention(container); err != nil {
+		retentionError(w, err)
+		return
+	}
+	if !s.lockUpload(target) {
+		logger.Error("Upload already in progress: " + target)
+		http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+		return
+	}
+	defer s.unlockUpload(target)
+
+	upload, received, err := s.loadPartialUpload(target)
+	if err != nil && !isNotExist(err) {
+		logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if offset > 0 && (err != nil || upload.Length != length || offset != received) {
+		// The client must continue from what was actually received
+		logger.Errorf("Can't continue upload of %s at %d, %d bytes received", target, offset, received)
+		w.Header().Set(UploadOffsetTag, strconv.FormatInt(received, 10))
+		http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+		return
+	}
+
+	// Other uploads may have used up the quota since the last request. The
+	// bytes received are counted as partial upload, nothing is reserved.
+	if err := s.checkQuota(target, length); err != nil {
+		quotaError(w, err)
+		return
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if offset == 0 {
+		// Starts the upload over
+		upload = partialUpload{Target: target, Length: length, Started: time.Now().UTC()}
+		data, err := json.Marshal(upload)
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(s.uploadPath(target)), 0700)
+		}
+		if err == nil {
+			err = writeFileAtomic(s.uploadPath(target)+".json", strings.NewReader(string(data)))
+		}
+		if err != nil {
+			logger.Error(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		flags |= os.O_TRUNC
+	}
+	part, err := os.OpenFile(s.uploadPath(target), flags, 0600)
+	if err != nil {
+		logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	// Whatever was received before the connection was lost is kept
+	n, copyErr := io.Copy(part, io.LimitReader(r.Body, length-offset))
+	if err := part.Sync(); err != nil {
+		logger.Error(err)
+	}
+	part.Close()
+	received = offset + n
+	if copyErr != nil {
+		logger.Errorf("Upload of %s interrupted at %d of %d bytes: %v", target, received, length, copyErr)
+		if isNoSpace(copyErr) {
+			http.Error(w, http.StatusText(http.StatusInsufficientStorage), http.StatusInsufficientStorage)
+			return
+		}
+	}
+	if received < length {
+		w.Header().Set(UploadOffsetTag, strconv.FormatInt(received, 10))
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	part, err = os.Open(s.uploadPath(target))
+	if err != nil {
+		logger.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer s.removePartialUpload(target)
+	defer part.Close()
+	s.putObject(w, r, target, part, length)
+}
+
+// handleUploadStatus returns the number of bytes received of a partial upload
+// in X-Upload-Offset, and its total length in X-Upload-Length.
+func (s *Server) handleUploadStatus(w http.ResponseWriter, r *http.Request, target string) {
+	upload, received, err := s.loadPartialUpload(target)
+	if err != nil {
+		logger.Error(err)
+		e := swift.ObjectNotFound
+		http.Error(w, e.Text, e.StatusCode)
+		return
+	}
+	w.Header().Set(UploadOffsetTag, strconv.FormatInt(received, 10))
+	w.Header().Set(UploadLengthTag, strconv.FormatInt(upload.Length, 10))
+}
+
+// handleUploadAbort discards a partial upload.
+func (s *Server) handleUploadAbort(w http.ResponseWriter, r *http.Request, target string) {
+	if _, _, err := s.loadPartialUpload(target); err != nil {
+		logger.Error(err)
+		e := swift.ObjectNotFound
+		http.Error(w, e.Text, e.StatusCode)
+		return
+	}
+	if !s.lockUpload(target) {
+		http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+		return
+	}
+	defer s.unlockUpload(target)
+	s.removePartialUpload(target)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeExpiredUploads removes partial uploads that haven't been continued
+// for uploadExpiry. It returns the number of removed uploads.
+func (s *Server) removeExpiredUploads() (int, error) {
+	dir := filepath.Join(s.settings.StorageLocation, uploadsDir)
+	entries, err := os.ReadDir(dir)
+	if isNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, e := range entries {
+		name := filepath.Join(dir, e.Name())
+		if strings.HasSuffix(name, ".json") {
+			// Left behind by a crash before any data was written
+			if _, err := os.Stat(strings.TrimSuffix(name, ".json")); isNotExist(err) {
+				os.Remove(name)
+			}
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return removed, err
+		}
+		if time.Since(info.ModTime()) < uploadExpiry {
+			continue
+		}
+		for _, p := range []string{name, name + ".json"} {
+			if err := os.Remove(p); err != nil && !isNotExist(err) {
+				return removed, err
+			}
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResumableUpload(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		s.settings.AllowDownload = true
+		createContainer(t, map[string]string{"Test-Container": "test"}, s)
+		path := "/v1.0/abc/test/clip.mkv"
+
+		// The connection is lost after five bytes
+		rr := storageRequest(t, s, "PUT", path, &failingReader{strings.NewReader("01234")}, map[string]string{UploadLengthTag: "10"})
+		if rr.Code != http.StatusAccepted || rr.Header().Get(UploadOffsetTag) != "5" {
+			t.Fatalf("wrong interrupted upload: got %v %s want %v 5", rr.Code, rr.Header().Get(UploadOffsetTag), http.StatusAccepted)
+		}
+		if _, err := s.backend.Stat("test/clip.mkv"); !isNotExist(err) {
+			t.Errorf("partial upload was stored as object: %v", err)
+		}
+
+		rr = storageRequest(t, s, "HEAD", path+"?upload", nil, nil)
+		if rr.Header().Get(UploadOffsetTag) != "5" || rr.Header().Get(UploadLengthTag) != "10" {
+			t.Errorf("wrong upload status: got %s of %s want 5 of 10", rr.Header().Get(UploadOffsetTag), rr.Header().Get(UploadLengthTag))
+		}
+
+		rr = storageRequest(t, s, "PUT", path, strings.NewReader("3456789"), map[string]string{UploadLengthTag: "10", UploadOffsetTag: "3"})
+		if rr.Code != http.StatusConflict || rr.Header().Get(UploadOffsetTag) != "5" {
+			t.Errorf("wrong continuation at the wrong offset: got %v %s want %v 5", rr.Code, rr.Header().Get(UploadOffsetTag), http.StatusConflict)
+		}
+
+		rr = storageRequest(t, s, "PUT", path, strings.NewReader("56789"), map[string]string{
+			UploadLengthTag:      "10",
+			UploadOffsetTag:      "5",
+			"Etag":               md5Hex("0123456789"),
+			"X-Object-Meta-Test": "resumedData",
+		})
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+		}
+		if body := storageRequest(t, s, "GET", path, nil, nil).Body.String(); body != "0123456789" {
+			t.Errorf("wrong body: got %q want %q", body, "0123456789")
+		}
+		matchMeta(t, s, "test/clip.mkv", map[string]string{"Test": "resumedData"})
+		if rr := storageRequest(t, s, "HEAD", path+"?upload", nil, nil); rr.Code != http.StatusNotFound {
+			t.Errorf("partial upload wasn't removed: got %v want %v", rr.Code, http.StatusNotFound)
+		}
+	})
+}
+
+func TestAbortResumableUpload(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		createContainer(t, map[string]string{"Test-Container": "test"}, s)
+		path := "/v1.0/abc/test/clip.mkv"
+
+		rr := storageRequest(t, s, "PUT", path, strings.NewReader("01234"), map[string]string{UploadLengthTag: "10"})
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusAccepted)
+		}
+		if rr := storageRequest(t, s, "DELETE", path+"?upload", nil, nil); rr.Code != http.StatusNoContent {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNoContent)
+		}
+		if rr := storageRequest(t, s, "HEAD", path+"?upload", nil, nil); rr.Code != http.StatusNotFound {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+		}
+		rr = storageRequest(t, s, "PUT", path, strings.NewReader("56789"), map[string]string{UploadLengthTag: "10", UploadOffsetTag: "5"})
+		if rr.Code != http.StatusConflict || rr.Header().Get(UploadOffsetTag) != "0" {
+			t.Errorf("wrong continuation of aborted upload: got %v %s want %v 0", rr.Code, rr.Header().Get(UploadOffsetTag), http.StatusConflict)
+		}
+	})
+}
+
+// Check that partial uploads count toward the quota on every request, and
+// aren't listed as a container
+func TestResumableUploadQuota(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s *Server) {
+		s.settings.Quota = &Quota{MaxBytes: 10}
+		createContainer(t, map[string]string{"Test-Container": "test"}, s)
+
+		rr := storageRequest(t, s, "PUT", "/v1.0/abc/test/first.mkv", strings.NewReader("0123"), map[string]string{UploadLengthTag: "8"})
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusAccepted)
+		}
+		// 4 bytes received of the first upload and 8 of the second would
+		// exceed the quota
+		rr = storageRequest(t, s, "PUT", "/v1.0/abc/test/second.mkv", strings.NewReader("0123"), map[string]string{UploadLengthTag: "8"})
+		if rr.Code != http.StatusInsufficientStorage {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusInsufficientStorage)
+		}
+
+		createDownloadObject(t, s, "clip.mkv", "012")
+		rr = storageRequest(t, s, "PUT", "/v1.0/abc/test/first.mkv", strings.NewReader("4567"), map[string]string{UploadLengthTag: "8", UploadOffsetTag: "4"})
+		if rr.Code != http.StatusInsufficientStorage {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusInsufficientStorage)
+		}
+
+		list, err := s.backend.List("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range list {
+			if c.Name != "test" {
+				t.Errorf("unexpected container %s", c.Name)
+			}
+		}
+		if rr := storageRequest(t, s, "PUT", "/v1.0/abc/"+uploadsDir, nil, nil); rr.Code != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+		}
+	})
+}
+
+func TestRemoveExpiredUploads(t *testing.T) {
+	root := t.TempDir()
+	s := &Server{
+		settings: &Settings{StorageLocation: root, TokenSecret: tokenSecret},
+		backend:  NewFileBackend(root),
+	}
+	if _, err := s.backend.CreateContainer("test"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"old.mkv", "new.mkv"} {
+		rr := storageRequest(t, s, "PUT", "/v1.0/abc/test/"+name, strings.NewReader("01234"), map[string]string{UploadLengthTag: "10"})
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusAccepted)
+		}
+	}
+	old := time.Now().Add(-uploadExpiry - time.Hour)
+	if err := os.Chtimes(s.uploadPath("test/old.mkv"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := s.removeExpiredUploads(); err != nil || n != 1 {
+		t.Errorf("wrong number of removed uploads: got %d want 1: %v", n, err)
+	}
+	if _, _, err := s.loadPartialUpload("test/old.mkv"); !isNotExist(err) {
+		t.Errorf("expired upload wasn't removed: %v", err)
+	}
+	if _, received, err := s.loadPartialUpload("test/new.mkv"); err != nil || received != 5 {
+		t.Errorf("wrong partial upload: %d bytes %v", received, err)
+	}
+}